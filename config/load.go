@@ -45,6 +45,7 @@ func LoadConfig(pathToTargets []string) (Config, error) {
 			}
 
 			fullConfig.Modules = append(fullConfig.Modules, ls.Modules...)
+			fullConfig.AllowedTargets = append(fullConfig.AllowedTargets, ls.AllowedTargets...)
 		}
 	}
 
@@ -0,0 +1,62 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+// accumulator sums up the increases of the values of a series.
+type accumulator struct {
+	last  float64
+	total float64
+}
+
+// add adds the increase of the given value over the last one to the total,
+// returning the new total. A decrease is treated as a reset of the source,
+// the value becoming the base of the following increases.
+func (a *accumulator) add(v float64) float64 {
+	if v >= a.last {
+		a.total += v - a.last
+	}
+	a.last = v
+
+	return a.total
+}
+
+// accumulate replaces the values of the accumulated metrics read from the
+// given target with the sum of their increases across scrapes.
+func (e *Exporter) accumulate(key connectionKey, metrics []metric) []metric {
+	e.seriesMu.Lock()
+	defer e.seriesMu.Unlock()
+
+	for i, m := range metrics {
+		if !m.Accumulate {
+			continue
+		}
+
+		accumulators, ok := e.accumulators[key]
+		if !ok {
+			accumulators = map[string]*accumulator{}
+			e.accumulators[key] = accumulators
+		}
+
+		id := seriesID(m)
+		a, ok := accumulators[id]
+		if !ok {
+			a = &accumulator{}
+			accumulators[id] = a
+		}
+
+		metrics[i].Value = a.add(m.Value)
+	}
+
+	return metrics
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+func TestAccumulate(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Metrics: []config.MetricDef{
+			{
+				Name:       "energy_total",
+				Address:    300001,
+				DataType:   config.ModbusUInt16,
+				MetricType: config.MetricTypeCounter,
+				Accumulate: true,
+			},
+		},
+	}
+
+	c := newFakeClient()
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	for i, step := range []struct {
+		value    uint16
+		expected float64
+	}{
+		{10, 10},
+		{20, 20},
+		// A decrease is a reset of the source.
+		{5, 20},
+		{15, 30},
+	} {
+		c.holdingRegisters[1] = step.value
+
+		reg, err := e.Scrape("localhost:502", 1, "my_module")
+		if err != nil {
+			t.Fatalf("step %v: %v", i, err)
+		}
+
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(families) != 1 {
+			t.Fatalf("step %v: expected 1 metric family but got %v", i, len(families))
+		}
+		if v := families[0].GetMetric()[0].GetCounter().GetValue(); v != step.expected {
+			t.Fatalf("step %v: expected %v but got %v", i, step.expected, v)
+		}
+	}
+
+	// Other targets are accumulated separately.
+	c.holdingRegisters[1] = 3
+	reg, err := e.Scrape("localhost:503", 1, "my_module")
+	if err != nil {
+		t.Fatal(err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := families[0].GetMetric()[0].GetCounter().GetValue(); v != 3 {
+		t.Fatalf("expected 3 for another target but got %v", v)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+// expandBitArray returns one metric per bit of the given metric's value, as
+// configured by the given bit array of a metric of the given data type. A NaN
+// value, e.g. of a failed read, yields NaN for each bit.
+func expandBitArray(a config.BitArray, dataType config.ModbusDataType, m metric) []metric {
+	bits := a.Bits
+	if bits == 0 {
+		bits = 16 * dataType.RegisterCount()
+	}
+
+	value := uint64(0)
+	if !math.IsNaN(m.Value) {
+		value = uint64(m.Value)
+	}
+
+	metrics := make([]metric, 0, bits)
+	for i := 0; i < bits; i++ {
+		bit := m
+		bit.Labels = copyLabels(m.Labels)
+		bit.Labels[a.Label] = strconv.Itoa(i)
+
+		switch {
+		case math.IsNaN(m.Value):
+		case value&(1<<uint(i)) != 0:
+			bit.Value = 1
+		default:
+			bit.Value = 0
+		}
+
+		metrics = append(metrics, bit)
+	}
+
+	return metrics
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+func TestScrapeMetricsBitArray(t *testing.T) {
+	c := newFakeClient()
+	c.holdingRegisters[1] = 0b1010
+
+	for _, test := range []struct {
+		name     string
+		bits     int
+		expected []float64
+	}{
+		{"configured bits", 4, []float64{0, 1, 0, 1}},
+		{"all bits", 0, []float64{0, 1, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+	} {
+		definitions := []config.MetricDef{
+			{
+				Name:       "zone_occupied",
+				Address:    300001,
+				DataType:   config.ModbusUInt16,
+				MetricType: config.MetricTypeGauge,
+				Labels:     map[string]string{"floor": "1"},
+				BitArray:   &config.BitArray{Label: "zone", Bits: test.bits},
+			},
+		}
+
+		metrics, err := scrapeMetrics(definitions, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(metrics) != len(test.expected) {
+			t.Fatalf("%v: expected %v metrics but got %v", test.name, len(test.expected), len(metrics))
+		}
+		for i, m := range metrics {
+			if m.Name != "zone_occupied" || m.Labels["floor"] != "1" || m.Labels["zone"] != fmt.Sprint(i) {
+				t.Errorf("%v: unexpected metric %v", test.name, m)
+			}
+			if m.Value != test.expected[i] {
+				t.Errorf("%v: expected zone %v to be %v but got %v", test.name, i, test.expected[i], m.Value)
+			}
+		}
+	}
+}
+
+func TestExpandBitArrayNaN(t *testing.T) {
+	m := metric{Name: "zone_occupied", Value: math.NaN(), MetricType: config.MetricTypeGauge}
+
+	metrics := expandBitArray(config.BitArray{Label: "zone", Bits: 2}, config.ModbusUInt16, m)
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics but got %v", len(metrics))
+	}
+	for _, m := range metrics {
+		if !math.IsNaN(m.Value) {
+			t.Errorf("expected zone %v to be NaN but got %v", m.Labels["zone"], m.Value)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+// breakerState is the state of a circuit breaker, exposed as the value of the
+// modbus_circuit_breaker_state metric.
+type breakerState int
+
+const (
+	// breakerClosed lets all scrapes through.
+	breakerClosed breakerState = iota
+	// breakerOpen fails all scrapes until the cooldown elapsed.
+	breakerOpen
+	// breakerHalfOpen lets a single scrape through to probe the target.
+	breakerHalfOpen
+)
+
+// breaker tracks the failed scrapes of a target.
+type breaker struct {
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// openings counts the times the breaker opened since it last closed,
+	// growing the cooldown.
+	openings int
+	cooldown time.Duration
+}
+
+// allowScrape returns an error if the circuit breaker of the given target is
+// open. Once the cooldown elapsed, the first caller is let through to probe
+// the target while further scrapes keep failing until the probe finished.
+func (e *Exporter) allowScrape(module *config.Module, key connectionKey) error {
+	if module.CircuitBreaker == nil {
+		return nil
+	}
+
+	e.breakersMu.Lock()
+	defer e.breakersMu.Unlock()
+
+	b, ok := e.breakers[key]
+	if !ok {
+		return nil
+	}
+
+	switch b.state {
+	case breakerOpen:
+		retry := b.openedAt.Add(b.cooldown)
+		if e.now().Before(retry) {
+			return fmt.Errorf("circuit breaker open for target %s via module %s until %v",
+				key.target, key.module, retry.Format(time.RFC3339))
+		}
+		e.setBreakerState(key, b, breakerHalfOpen)
+	case breakerHalfOpen:
+		return fmt.Errorf("circuit breaker open for target %s via module %s while probing the target",
+			key.target, key.module)
+	}
+
+	return nil
+}
+
+// recordScrape updates the circuit breaker of the given target with the result
+// of a scrape let through by allowScrape.
+func (e *Exporter) recordScrape(module *config.Module, key connectionKey, scrapeErr error) {
+	if module.CircuitBreaker == nil {
+		return
+	}
+
+	e.breakersMu.Lock()
+	defer e.breakersMu.Unlock()
+
+	b, ok := e.breakers[key]
+	if !ok {
+		b = &breaker{}
+		e.breakers[key] = b
+	}
+
+	if scrapeErr == nil {
+		b.failures = 0
+		b.openings = 0
+		e.setBreakerState(key, b, breakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= module.CircuitBreaker.FailureThreshold {
+		b.openings++
+		b.openedAt = e.now()
+		b.cooldown = module.CircuitBreaker.CooldownAfter(b.openings)
+		e.setBreakerState(key, b, breakerOpen)
+		return
+	}
+
+	e.setBreakerState(key, b, b.state)
+}
+
+// setBreakerState sets the state of the given breaker and the corresponding
+// metric. The caller has to hold breakersMu.
+func (e *Exporter) setBreakerState(key connectionKey, b *breaker, state breakerState) {
+	b.state = state
+	e.breakerState.WithLabelValues(key.module, key.target, strconv.Itoa(int(key.subTarget))).Set(float64(state))
+}
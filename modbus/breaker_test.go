@@ -0,0 +1,197 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		CircuitBreaker: &config.CircuitBreaker{
+			FailureThreshold: 2,
+			Cooldown:         time.Minute,
+		},
+		Metrics: []config.MetricDef{
+			{
+				Name:       "my_metric",
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+		},
+	}
+
+	now := time.Unix(1600000000, 0)
+	reachable := false
+	connects := 0
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.now = func() time.Time { return now }
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		connects++
+		if !reachable {
+			return nil, fmt.Errorf("unable to connect with target %s via module %s", target, module.Name)
+		}
+		return &connection{client: newFakeClient(), close: func() error { return nil }}, nil
+	}
+
+	scrape := func() error {
+		_, err := e.Scrape("localhost:502", 1, "my_module")
+		return err
+	}
+	expectState := func(step string, expected breakerState, expectedConnects int) {
+		t.Helper()
+		if v := testutil.ToFloat64(e.breakerState.WithLabelValues("my_module", "localhost:502", "1")); v != float64(expected) {
+			t.Fatalf("%v: expected breaker state %v but got %v", step, expected, v)
+		}
+		if connects != expectedConnects {
+			t.Fatalf("%v: expected %v connects but got %v", step, expectedConnects, connects)
+		}
+	}
+
+	// Failures below the threshold keep the breaker closed.
+	if err := scrape(); err == nil {
+		t.Fatal("expected first scrape to fail")
+	}
+	expectState("first failure", breakerClosed, 1)
+
+	// Reaching the threshold opens the breaker.
+	if err := scrape(); err == nil {
+		t.Fatal("expected second scrape to fail")
+	}
+	expectState("second failure", breakerOpen, 2)
+
+	// While open, scrapes fail without contacting the target.
+	reachable = true
+	now = now.Add(30 * time.Second)
+	if err := scrape(); err == nil {
+		t.Fatal("expected scrape with open breaker to fail")
+	}
+	expectState("open", breakerOpen, 2)
+
+	// After the cooldown, a failed probe opens the breaker again.
+	reachable = false
+	now = now.Add(time.Minute)
+	if err := scrape(); err == nil {
+		t.Fatal("expected failed probe to fail")
+	}
+	expectState("failed probe", breakerOpen, 3)
+
+	// A concurrent scrape during a probe fails without contacting the target.
+	now = now.Add(time.Minute)
+	key := connectionKey{"my_module", "localhost:502", 1}
+	if err := e.allowScrape(&module, key); err != nil {
+		t.Fatalf("expected probe to be allowed but got %v", err)
+	}
+	expectState("half-open", breakerHalfOpen, 3)
+	if err := scrape(); err == nil {
+		t.Fatal("expected scrape during probe to fail")
+	}
+	expectState("half-open", breakerHalfOpen, 3)
+
+	// A successful probe closes the breaker.
+	reachable = true
+	e.recordScrape(&module, key, nil)
+	expectState("successful probe", breakerClosed, 3)
+	if err := scrape(); err != nil {
+		t.Fatalf("expected scrape with closed breaker to succeed but got %v", err)
+	}
+	expectState("closed", breakerClosed, 4)
+
+	// The failure count is reset once the breaker closed.
+	reachable = false
+	if err := scrape(); err == nil {
+		t.Fatal("expected scrape to fail")
+	}
+	expectState("failure after close", breakerClosed, 5)
+}
+
+func TestCircuitBreakerBackoff(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		CircuitBreaker: &config.CircuitBreaker{
+			FailureThreshold: 1,
+			Cooldown:         time.Minute,
+			BackoffFactor:    2,
+			MaxCooldown:      3 * time.Minute,
+		},
+		Metrics: []config.MetricDef{
+			{
+				Name:       "my_metric",
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+		},
+	}
+
+	now := time.Unix(1600000000, 0)
+	reachable := false
+	connects := 0
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.now = func() time.Time { return now }
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		connects++
+		if !reachable {
+			return nil, fmt.Errorf("unable to connect with target %s via module %s", target, module.Name)
+		}
+		return &connection{client: newFakeClient(), close: func() error { return nil }}, nil
+	}
+
+	// scrapeAfter scrapes the target once the given duration passed,
+	// returning whether the target was contacted.
+	scrapeAfter := func(d time.Duration) bool {
+		t.Helper()
+		now = now.Add(d)
+		before := connects
+		_, err := e.Scrape("localhost:502", 1, "my_module")
+		if reachable && connects > before && err != nil {
+			t.Fatalf("expected scrape of reachable target to succeed but got %v", err)
+		}
+		return connects > before
+	}
+
+	for _, step := range []struct {
+		name      string
+		after     time.Duration
+		reachable bool
+		contacted bool
+	}{
+		{"first failure opens the breaker for the cooldown", 0, false, true},
+		{"backoff before the cooldown", 59 * time.Second, false, false},
+		{"failed probe doubles the cooldown", time.Second, false, true},
+		{"backoff before the doubled cooldown", 119 * time.Second, false, false},
+		{"failed probe grows the cooldown up to its maximum", time.Second, false, true},
+		{"backoff before the maximum cooldown", 179 * time.Second, false, false},
+		{"successful probe closes the breaker", time.Second, true, true},
+		{"failure after close opens the breaker for the cooldown", 0, false, true},
+		{"backoff after reset", 59 * time.Second, false, false},
+		{"probe after reset cooldown", time.Second, false, true},
+	} {
+		reachable = step.reachable
+		if contacted := scrapeAfter(step.after); contacted != step.contacted {
+			t.Fatalf("%v: expected target contacted to be %v but got %v", step.name, step.contacted, contacted)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeCacheKey identifies the scrapes of a target sharing a cached result.
+// The sub-target is empty for scrapes of all sub-targets of a module.
+type scrapeCacheKey struct {
+	module, target, subTarget string
+}
+
+// cachedResult is the result of a scrape, available once done is closed.
+type cachedResult struct {
+	done     chan struct{}
+	gatherer prometheus.Gatherer
+	err      error
+	expires  time.Time
+}
+
+// cachedScrape returns the result of the given scrape, sharing it with the
+// scrapes of the same target while it is in flight and, if it succeeded, for
+// the scrape cache duration of the module afterwards. Modules not caching
+// scrape results are scraped directly.
+func (e *Exporter) cachedScrape(key scrapeCacheKey, scrape func() (prometheus.Gatherer, error)) (prometheus.Gatherer, error) {
+	module := e.GetConfig().GetModule(key.module)
+	if module == nil || module.ScrapeCacheDuration == 0 {
+		return scrape()
+	}
+
+	e.scrapeCacheMu.Lock()
+	if r, ok := e.scrapeCache[key]; ok {
+		select {
+		case <-r.done:
+			if e.now().Before(r.expires) {
+				e.scrapeCacheMu.Unlock()
+				return r.gatherer, r.err
+			}
+		default:
+			e.scrapeCacheMu.Unlock()
+			<-r.done
+			return r.gatherer, r.err
+		}
+	}
+	r := &cachedResult{done: make(chan struct{})}
+	e.scrapeCache[key] = r
+	e.scrapeCacheMu.Unlock()
+
+	r.gatherer, r.err = scrape()
+
+	e.scrapeCacheMu.Lock()
+	if r.err != nil {
+		delete(e.scrapeCache, key)
+	} else {
+		r.expires = e.now().Add(module.ScrapeCacheDuration)
+	}
+	e.scrapeCacheMu.Unlock()
+	close(r.done)
+
+	return r.gatherer, r.err
+}
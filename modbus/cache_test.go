@@ -0,0 +1,124 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+func TestCachedScrape(t *testing.T) {
+	module := config.Module{
+		Name:                "my_module",
+		Protocol:            config.ModbusProtocolTCPIP,
+		ScrapeCacheDuration: 500 * time.Millisecond,
+		Metrics: []config.MetricDef{
+			{Name: "my_metric", Address: 300001, DataType: config.ModbusInt16, MetricType: config.MetricTypeGauge},
+		},
+	}
+
+	c := newFakeClient()
+	started, release := make(chan struct{}), make(chan struct{})
+	c.fail = func(fakeRequest) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+
+	now := time.Unix(100, 0)
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.now = func() time.Time { return now }
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	// Two simultaneous probes share a single read of the device.
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	probe := func() {
+		defer wg.Done()
+		_, err := e.Scrape("127.0.0.1:502", 1, "my_module")
+		errs <- err
+	}
+	wg.Add(2)
+	go probe()
+	<-started
+	go probe()
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(c.recorded()); n != 1 {
+		t.Fatalf("expected 1 read but got %v", n)
+	}
+
+	// Once the cache duration passed, the device is read again.
+	c.fail = nil
+	now = now.Add(500 * time.Millisecond)
+	if _, err := e.Scrape("127.0.0.1:502", 1, "my_module"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.recorded()); n != 2 {
+		t.Fatalf("expected 2 reads but got %v", n)
+	}
+
+	// Other sub-targets are not served from the cache.
+	if _, err := e.Scrape("127.0.0.1:502", 2, "my_module"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.recorded()); n != 3 {
+		t.Fatalf("expected 3 reads but got %v", n)
+	}
+}
+
+func TestCachedScrapeFailure(t *testing.T) {
+	module := config.Module{
+		Name:                "my_module",
+		Protocol:            config.ModbusProtocolTCPIP,
+		ScrapeCacheDuration: time.Second,
+		Metrics: []config.MetricDef{
+			{Name: "my_metric", Address: 300001, DataType: config.ModbusInt16, MetricType: config.MetricTypeGauge},
+		},
+	}
+
+	c := newFakeClient()
+	c.fail = func(fakeRequest) error { return fmt.Errorf("i/o timeout") }
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.now = func() time.Time { return time.Unix(100, 0) }
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	if _, err := e.Scrape("127.0.0.1:502", 1, "my_module"); err == nil {
+		t.Fatal("expected scrape to fail")
+	}
+
+	// Failed scrapes are not cached.
+	c.fail = nil
+	if _, err := e.Scrape("127.0.0.1:502", 1, "my_module"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.recorded()); n != 2 {
+		t.Fatalf("expected 2 reads but got %v", n)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import "math"
+
+// exportOnChange replaces the values of the metrics read from the given target
+// exported on change only with their last exported values, unless they
+// changed by more than their epsilon.
+func (e *Exporter) exportOnChange(key connectionKey, metrics []metric) []metric {
+	e.seriesMu.Lock()
+	defer e.seriesMu.Unlock()
+
+	for i, m := range metrics {
+		if m.ChangeEpsilon == nil {
+			continue
+		}
+
+		exported, ok := e.exported[key]
+		if !ok {
+			exported = map[string]float64{}
+			e.exported[key] = exported
+		}
+
+		id := seriesID(m)
+		if last, ok := exported[id]; ok && math.Abs(m.Value-last) <= *m.ChangeEpsilon {
+			metrics[i].Value = last
+			continue
+		}
+		exported[id] = m.Value
+	}
+
+	return metrics
+}
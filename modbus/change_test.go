@@ -0,0 +1,74 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+func TestExportOnChange(t *testing.T) {
+	epsilon := 0.5
+	factor := 0.1
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Metrics: []config.MetricDef{
+			{
+				Name:          "temperature_celsius",
+				Address:       300001,
+				DataType:      config.ModbusUInt16,
+				MetricType:    config.MetricTypeGauge,
+				Factor:        &factor,
+				ChangeEpsilon: &epsilon,
+			},
+		},
+	}
+
+	c := newFakeClient()
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	for i, step := range []struct {
+		raw      uint16
+		expected float64
+	}{
+		{200, 20},
+		// Fluctuations up to the epsilon keep the last exported value.
+		{203, 20},
+		{196, 20},
+		{204, 20},
+		// Larger changes are exported.
+		{210, 21},
+		{190, 19},
+	} {
+		c.holdingRegisters[1] = step.raw
+
+		reg, err := e.Scrape("localhost:502", 1, "my_module")
+		if err != nil {
+			t.Fatalf("step %v: %v", i, err)
+		}
+
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := families[0].GetMetric()[0].GetGauge().GetValue(); v != step.expected {
+			t.Fatalf("step %v: expected %v but got %v", i, step.expected, v)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+// countChanges counts the changes of the values of the metrics read from the
+// given target counting their changes over the values of the previous
+// scrape. The first value read of a series only becomes the base of the
+// following changes.
+func (e *Exporter) countChanges(key connectionKey, metrics []metric) {
+	e.seriesMu.Lock()
+	defer e.seriesMu.Unlock()
+
+	for _, m := range metrics {
+		if !m.CountChanges {
+			continue
+		}
+
+		lastValues, ok := e.lastValues[key]
+		if !ok {
+			lastValues = map[string]float64{}
+			e.lastValues[key] = lastValues
+		}
+
+		changes := e.valueChanges.WithLabelValues(key.module, key.target, m.Name)
+
+		id := seriesID(m)
+		if last, ok := lastValues[id]; ok && last != m.Value {
+			changes.Inc()
+		}
+		lastValues[id] = m.Value
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCountChanges(t *testing.T) {
+	zero := 0
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Metrics: []config.MetricDef{
+			{
+				Name:         "pump_running",
+				Address:      100001,
+				DataType:     config.ModbusBool,
+				BitOffset:    &zero,
+				MetricType:   config.MetricTypeGauge,
+				CountChanges: true,
+			},
+		},
+	}
+
+	c := newFakeClient()
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	for i, value := range []bool{false, true, true, false} {
+		c.coils[1] = value
+
+		if _, err := e.Scrape("localhost:502", 1, "my_module"); err != nil {
+			t.Fatalf("step %v: %v", i, err)
+		}
+	}
+
+	expected := `
+# HELP modbus_value_changes_total Number of changes of the value of a metric counting its changes between scrapes.
+# TYPE modbus_value_changes_total counter
+modbus_value_changes_total{metric="pump_running",module="my_module",target="localhost:502"} 2
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "modbus_value_changes_total"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+const (
+	// maxReadRegisters is the maximum quantity of the read holding / input
+	// registers functions.
+	maxReadRegisters = 125
+	// maxReadBits is the maximum quantity of the read coils / discrete inputs
+	// functions.
+	maxReadBits = 2000
+)
+
+// readBlock is a range of coils, discrete inputs or registers read with a
+// single request.
+type readBlock struct {
+	function uint64
+	address  int
+	quantity int
+	// metrics holds the names of the metrics read by the block.
+	metrics []string
+	// timeout is the read timeout of the metrics, 0 for the module's.
+	timeout time.Duration
+
+	read bool
+	data []byte
+	err  error
+}
+
+// contains returns whether the block covers the given range.
+func (b *readBlock) contains(function uint64, address, quantity int) bool {
+	return b.function == function && address >= b.address && address+quantity <= b.address+b.quantity
+}
+
+// size returns the number of bytes of the block's data covering the given
+// range within the block.
+func (b *readBlock) size(address, quantity int) int {
+	end := address - b.address + quantity
+	if b.function == 3 || b.function == 4 {
+		return 2 * end
+	}
+
+	return (end + 7) / 8
+}
+
+// slice returns the data of the given range within the block.
+func (b *readBlock) slice(address, quantity int) []byte {
+	offset := address - b.address
+
+	if b.function == 3 || b.function == 4 {
+		return b.data[2*offset : 2*(offset+quantity)]
+	}
+
+	bits := make([]byte, (quantity+7)/8)
+	for i := 0; i < quantity; i++ {
+		if b.data[(offset+i)/8]&(1<<uint((offset+i)%8)) != 0 {
+			bits[i/8] |= 1 << uint(i%8)
+		}
+	}
+
+	return bits
+}
+
+// planReads returns the reads of the given definitions in order, without
+// coalescing them.
+func planReads(definitions []config.MetricDef) ([]*readBlock, error) {
+	reads := []*readBlock{}
+	for _, definition := range definitions {
+		// Each of the explicitly listed registers is read on its own.
+		if len(definition.Addresses) > 0 {
+			for _, address := range definition.Addresses {
+				modFunction, modAddress, err := splitAddress(address)
+				if err != nil {
+					return nil, err
+				}
+
+				reads = append(reads, &readBlock{
+					function: modFunction,
+					address:  int(modAddress),
+					quantity: 1,
+					metrics:  []string{definition.Name},
+					timeout:  definition.ReadTimeout,
+				})
+			}
+			continue
+		}
+
+		modFunction, modAddress, err := splitAddress(definition.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		reads = append(reads, &readBlock{
+			function: modFunction,
+			address:  int(modAddress) - definition.PadBefore,
+			quantity: definition.PadBefore + definition.RegisterCount() + definition.PadAfter,
+			metrics:  []string{definition.Name},
+			timeout:  definition.ReadTimeout,
+		})
+	}
+
+	return reads, nil
+}
+
+// planBlocks groups the reads of the given definitions into as few blocks as
+// possible, merging reads of the same function code and read timeout at most
+// maxGap unused registers apart. Reads of coils and discrete inputs are grouped by the bytes
+// of the response instead, see withinGap. Blocks of registers span at most
+// maxRegisters registers, or the protocol maximum if 0.
+func planBlocks(definitions []config.MetricDef, maxGap, maxRegisters int) ([]*readBlock, error) {
+	reads, err := planReads(definitions)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(reads, func(i, j int) bool {
+		if reads[i].function != reads[j].function {
+			return reads[i].function < reads[j].function
+		}
+		return reads[i].address < reads[j].address
+	})
+
+	blocks := []*readBlock{}
+	for _, r := range reads {
+		if len(blocks) > 0 {
+			last := blocks[len(blocks)-1]
+
+			limit := maxReadRegisters
+			if maxRegisters > 0 {
+				limit = maxRegisters
+			}
+			if r.function == 1 || r.function == 2 {
+				limit = maxReadBits
+			}
+
+			end := r.address + r.quantity
+			if last.address+last.quantity > end {
+				end = last.address + last.quantity
+			}
+
+			if last.function == r.function && last.timeout == r.timeout && withinGap(last, r, maxGap) && end-last.address <= limit {
+				last.quantity = end - last.address
+				last.metrics = append(last.metrics, r.metrics...)
+				continue
+			}
+		}
+
+		blocks = append(blocks, r)
+	}
+
+	return blocks, nil
+}
+
+// withinGap returns whether the given read starts at most maxGap unused
+// registers after the end of the given block. Coils and discrete inputs are
+// packed eight to a byte in the response, so their reads are merged if they
+// fall into the same or an adjacent byte of the response, with maxGap counting
+// unused bytes in between. The blocks still start and end at the first and
+// last coil read, as devices may reject reads of coils they do not implement.
+func withinGap(b, r *readBlock, maxGap int) bool {
+	end := b.address + b.quantity
+	if r.function == 1 || r.function == 2 {
+		return r.address/8 <= (end-1)/8+1+maxGap
+	}
+
+	return r.address <= end+maxGap
+}
+
+// fallbackReadError is returned by a coalescingClient if both the coalesced
+// read and the individual read of a metric failed.
+type fallbackReadError struct {
+	err error
+}
+
+// Error implements the Golang error interface.
+func (e *fallbackReadError) Error() string {
+	return fmt.Sprintf("individual read after failed coalesced read: %v", e.err)
+}
+
+// Unwrap returns the error of the individual read.
+func (e *fallbackReadError) Unwrap() error {
+	return e.err
+}
+
+// coalescingClient is a modbus.Client serving reads within the planned blocks
+// from a single request per block, performed on the first read of the block.
+type coalescingClient struct {
+	modbus.Client
+
+	blocks []*readBlock
+	// fallback enables reading individually if a block read fails with a
+	// Modbus exception.
+	fallback bool
+}
+
+// newCoalescingClient returns a client coalescing the reads of the given
+// definitions, see planBlocks.
+func newCoalescingClient(c modbus.Client, definitions []config.MetricDef, maxGap, maxRegisters int, fallback bool) (*coalescingClient, error) {
+	blocks, err := planBlocks(definitions, maxGap, maxRegisters)
+	if err != nil {
+		return nil, err
+	}
+
+	return &coalescingClient{Client: c, blocks: blocks, fallback: fallback}, nil
+}
+
+func (c *coalescingClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	return c.read(1, c.Client.ReadCoils, address, quantity)
+}
+
+func (c *coalescingClient) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+	return c.read(2, c.Client.ReadDiscreteInputs, address, quantity)
+}
+
+func (c *coalescingClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	return c.read(3, c.Client.ReadHoldingRegisters, address, quantity)
+}
+
+func (c *coalescingClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	return c.read(4, c.Client.ReadInputRegisters, address, quantity)
+}
+
+func (c *coalescingClient) read(function uint64, f modbusFunc, address, quantity uint16) ([]byte, error) {
+	var b *readBlock
+	for _, block := range c.blocks {
+		if block.contains(function, int(address), int(quantity)) {
+			b = block
+			break
+		}
+	}
+	if b == nil {
+		return f(address, quantity)
+	}
+
+	if !b.read {
+		b.data, b.err = f(uint16(b.address), uint16(b.quantity))
+		b.read = true
+	}
+
+	if b.err != nil {
+		var modbusErr *modbus.ModbusError
+		if !c.fallback || !errors.As(b.err, &modbusErr) {
+			return nil, b.err
+		}
+
+		data, err := f(address, quantity)
+		if err != nil {
+			return nil, &fallbackReadError{err}
+		}
+		return data, nil
+	}
+
+	// Devices may return less data than requested, e.g. if their response
+	// length is ignored.
+	if size := b.size(int(address), int(quantity)); len(b.data) < size {
+		return nil, &InsufficientRegistersError{fmt.Sprintf("expected %v bytes of block at address %v, got %v", size, b.address, len(b.data))}
+	}
+
+	return b.slice(int(address), int(quantity)), nil
+}
@@ -0,0 +1,558 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+func TestPlanBlocks(t *testing.T) {
+	definitions := []config.MetricDef{
+		{Address: 300010, DataType: config.ModbusInt32},
+		{Address: 300001, DataType: config.ModbusInt16},
+		{Address: 300002, DataType: config.ModbusInt16},
+		// Overlapping the previous one.
+		{Address: 300002, DataType: config.ModbusInt32},
+		{Address: 400001, DataType: config.ModbusInt16},
+		{Address: 100005, DataType: config.ModbusBool},
+		{Address: 100003, DataType: config.ModbusBool},
+	}
+
+	for _, test := range []struct {
+		name     string
+		maxGap   int
+		expected []readBlock
+	}{
+		{
+			name:   "adjacent",
+			maxGap: 0,
+			expected: []readBlock{
+				// Coils within the same byte of the response.
+				{function: 1, address: 3, quantity: 3},
+				{function: 3, address: 1, quantity: 3},
+				{function: 3, address: 10, quantity: 2},
+				{function: 4, address: 1, quantity: 1},
+			},
+		},
+		{
+			name:   "with gaps",
+			maxGap: 6,
+			expected: []readBlock{
+				{function: 1, address: 3, quantity: 3},
+				{function: 3, address: 1, quantity: 11},
+				{function: 4, address: 1, quantity: 1},
+			},
+		},
+	} {
+		blocks, err := planBlocks(definitions, test.maxGap, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		planned := []readBlock{}
+		for _, b := range blocks {
+			planned = append(planned, readBlock{function: b.function, address: b.address, quantity: b.quantity})
+		}
+		if !reflect.DeepEqual(planned, test.expected) {
+			t.Errorf("%v: expected blocks %v but got %v", test.name, test.expected, planned)
+		}
+	}
+}
+
+func TestPlanBlocksRegisterTypes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "modbus.yml")
+	err := os.WriteFile(file, []byte(`modules:
+  - name: "my_module"
+    protocol: "tcp/ip"
+    defaultRegisterType: input
+    metrics:
+      - name: "inherited_1"
+        address: 1
+        dataType: uint16
+        metricType: gauge
+      - name: "inherited_2"
+        address: 2
+        dataType: uint16
+        metricType: gauge
+      - name: "overridden"
+        address: 1
+        registerType: holding
+        dataType: uint16
+        metricType: gauge
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := config.LoadConfig([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, err := planBlocks(c.Modules[0].Metrics, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Metrics are coalesced by their effective register type.
+	planned := []readBlock{}
+	for _, b := range blocks {
+		planned = append(planned, readBlock{function: b.function, address: b.address, quantity: b.quantity})
+	}
+	expected := []readBlock{
+		{function: 3, address: 1, quantity: 1},
+		{function: 4, address: 1, quantity: 2},
+	}
+	if !reflect.DeepEqual(planned, expected) {
+		t.Errorf("expected blocks %v but got %v", expected, planned)
+	}
+}
+
+func TestPlanBlocksLimit(t *testing.T) {
+	definitions := []config.MetricDef{
+		{Address: 300001, DataType: config.ModbusInt64},
+		{Address: 300123, DataType: config.ModbusInt64},
+	}
+
+	blocks, err := planBlocks(definitions, 200, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("expected blocks exceeding %v registers to be split, got %v blocks", maxReadRegisters, len(blocks))
+	}
+}
+
+func TestPlanBlocksCoils(t *testing.T) {
+	definitions := []config.MetricDef{}
+	for _, address := range []config.RegisterAddr{100001, 100004, 100009, 100012, 100016, 100033, 200001} {
+		definitions = append(definitions, config.MetricDef{Address: address, DataType: config.ModbusBool})
+	}
+	// Exceeding the maximum of a single read coils request.
+	definitions = append(definitions, config.MetricDef{Address: 102010, DataType: config.ModbusBool})
+
+	for _, test := range []struct {
+		name     string
+		maxGap   int
+		expected []readBlock
+	}{
+		{
+			name:   "adjacent bytes",
+			maxGap: 0,
+			expected: []readBlock{
+				{function: 1, address: 1, quantity: 16},
+				{function: 1, address: 33, quantity: 1},
+				{function: 1, address: 2010, quantity: 1},
+				{function: 2, address: 1, quantity: 1},
+			},
+		},
+		{
+			name:   "with gaps",
+			maxGap: 2,
+			expected: []readBlock{
+				{function: 1, address: 1, quantity: 33},
+				{function: 1, address: 2010, quantity: 1},
+				{function: 2, address: 1, quantity: 1},
+			},
+		},
+	} {
+		blocks, err := planBlocks(definitions, test.maxGap, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		planned := []readBlock{}
+		for _, b := range blocks {
+			planned = append(planned, readBlock{function: b.function, address: b.address, quantity: b.quantity})
+		}
+		if !reflect.DeepEqual(planned, test.expected) {
+			t.Errorf("%v: expected blocks %v but got %v", test.name, test.expected, planned)
+		}
+	}
+}
+
+func TestCoalescedCoilReads(t *testing.T) {
+	definitions := []config.MetricDef{}
+	for i, address := range []config.RegisterAddr{100002, 100005, 100008, 100011, 100017} {
+		definitions = append(definitions, config.MetricDef{
+			Name:       fmt.Sprintf("coil_%v", i),
+			Address:    address,
+			DataType:   config.ModbusBool,
+			BitOffset:  new(int),
+			MetricType: config.MetricTypeGauge,
+		})
+	}
+
+	fake := newFakeClient()
+	fake.coils[5] = true
+	fake.coils[11] = true
+	fake.coils[17] = true
+
+	c, err := newCoalescingClient(fake, definitions, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := scrapeMetrics(definitions, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]float64{}
+	for _, m := range metrics {
+		values[m.Name] = m.Value
+	}
+	expected := map[string]float64{"coil_0": 0, "coil_1": 1, "coil_2": 0, "coil_3": 1, "coil_4": 1}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %v but got %v", expected, values)
+	}
+
+	expectedRequests := []fakeRequest{{modbus.FuncCodeReadCoils, 2, 16}}
+	if r := fake.recorded(); !reflect.DeepEqual(r, expectedRequests) {
+		t.Fatalf("expected requests %v but got %v", expectedRequests, r)
+	}
+}
+
+func TestCoalescedReads(t *testing.T) {
+	definitions := []config.MetricDef{
+		{Name: "a", Address: 300001, DataType: config.ModbusInt16, MetricType: config.MetricTypeGauge},
+		{Name: "b", Address: 300002, DataType: config.ModbusUInt32, MetricType: config.MetricTypeGauge},
+		{Name: "c", Address: 300004, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge},
+		{Name: "d", Address: 100009, DataType: config.ModbusBool, BitOffset: new(int), MetricType: config.MetricTypeGauge},
+		{Name: "e", Address: 100010, DataType: config.ModbusBool, BitOffset: new(int), MetricType: config.MetricTypeGauge},
+	}
+
+	fake := newFakeClient()
+	fake.holdingRegisters[1] = 0xFFFF
+	fake.holdingRegisters[2] = 0x0001
+	fake.holdingRegisters[3] = 0x0002
+	fake.holdingRegisters[4] = 7
+	fake.coils[10] = true
+
+	c, err := newCoalescingClient(fake, definitions, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := scrapeMetrics(definitions, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]float64{}
+	for _, m := range metrics {
+		values[m.Name] = m.Value
+	}
+	expected := map[string]float64{"a": -1, "b": 0x00010002, "c": 7, "d": 0, "e": 1}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %v but got %v", expected, values)
+	}
+
+	expectedRequests := []fakeRequest{
+		{modbus.FuncCodeReadHoldingRegisters, 1, 4},
+		{modbus.FuncCodeReadCoils, 9, 2},
+	}
+	if r := fake.recorded(); !reflect.DeepEqual(r, expectedRequests) {
+		t.Fatalf("expected requests %v but got %v", expectedRequests, r)
+	}
+}
+
+// shortClient is a fake client returning only the first register of reads of
+// holding registers, like devices whose response length is ignored.
+type shortClient struct {
+	*fakeClient
+}
+
+func (c shortClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	data, err := c.fakeClient.ReadHoldingRegisters(address, quantity)
+	if err != nil || len(data) < 2 {
+		return data, err
+	}
+	return data[:2], nil
+}
+
+func TestCoalescedShortBlock(t *testing.T) {
+	definitions := []config.MetricDef{
+		{Name: "a", Address: 300001, DataType: config.ModbusInt16, MetricType: config.MetricTypeGauge},
+		{Name: "b", Address: 300002, DataType: config.ModbusInt16, MetricType: config.MetricTypeGauge},
+	}
+
+	fake := newFakeClient()
+	fake.holdingRegisters[1] = 1
+	fake.holdingRegisters[2] = 2
+
+	c, err := newCoalescingClient(shortClient{fake}, definitions, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = scrapeMetrics(definitions, c)
+	if err == nil || !strings.Contains(err.Error(), "insufficient amount of register data") {
+		t.Fatalf("expected a short block to fail with insufficient registers but got %v", err)
+	}
+}
+
+func TestBlockReadFallback(t *testing.T) {
+	definitions := []config.MetricDef{
+		{Name: "a", Address: 300001, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge},
+		{Name: "b", Address: 300002, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge},
+		{Name: "c", Address: 300003, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge},
+	}
+
+	newFake := func() *fakeClient {
+		fake := newFakeClient()
+		fake.holdingRegisters[1] = 1
+		fake.holdingRegisters[3] = 3
+		// Register 2 is not readable, failing any read including it.
+		fake.fail = func(r fakeRequest) error {
+			if r.address <= 2 && r.address+r.quantity > 2 {
+				return &modbus.ModbusError{
+					FunctionCode:  r.function | 0x80,
+					ExceptionCode: modbus.ExceptionCodeIllegalDataAddress,
+				}
+			}
+			return nil
+		}
+		return fake
+	}
+
+	t.Run("with fallback", func(t *testing.T) {
+		fake := newFake()
+		c, err := newCoalescingClient(fake, definitions, 0, 0, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		metrics, err := scrapeMetrics(definitions, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values := map[string]float64{}
+		for _, m := range metrics {
+			values[m.Name] = m.Value
+		}
+		expected := map[string]float64{"a": 1, "c": 3}
+		if !reflect.DeepEqual(values, expected) {
+			t.Fatalf("expected %v but got %v", expected, values)
+		}
+
+		expectedRequests := []fakeRequest{
+			{modbus.FuncCodeReadHoldingRegisters, 1, 3},
+			{modbus.FuncCodeReadHoldingRegisters, 1, 1},
+			{modbus.FuncCodeReadHoldingRegisters, 2, 1},
+			{modbus.FuncCodeReadHoldingRegisters, 3, 1},
+		}
+		if r := fake.recorded(); !reflect.DeepEqual(r, expectedRequests) {
+			t.Fatalf("expected requests %v but got %v", expectedRequests, r)
+		}
+	})
+
+	t.Run("without fallback", func(t *testing.T) {
+		c, err := newCoalescingClient(newFake(), definitions, 0, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := scrapeMetrics(definitions, c); err == nil {
+			t.Fatal("expected failed block read to fail the scrape")
+		}
+	})
+}
+
+func TestDiscontiguousAddresses(t *testing.T) {
+	definitions := []config.MetricDef{
+		{
+			Name:       "energy",
+			Addresses:  []config.RegisterAddr{300100, 300500},
+			DataType:   config.ModbusInt32,
+			MetricType: config.MetricTypeGauge,
+		},
+		{
+			Name:       "power",
+			Address:    300101,
+			DataType:   config.ModbusInt16,
+			MetricType: config.MetricTypeGauge,
+		},
+	}
+
+	fake := newFakeClient()
+	fake.holdingRegisters[100] = 0xFFFE // high word
+	fake.holdingRegisters[101] = 3
+	fake.holdingRegisters[500] = 0x0000 // low word
+
+	t.Run("individual reads", func(t *testing.T) {
+		metrics, err := scrapeMetrics(definitions, fake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := metrics[0].Value; v != float64(int32(-0x20000)) {
+			t.Fatalf("expected %v but got %v", int32(-0x20000), v)
+		}
+	})
+
+	t.Run("coalesced reads", func(t *testing.T) {
+		fake.requests = nil
+		c, err := newCoalescingClient(fake, definitions, 0, 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		metrics, err := scrapeMetrics(definitions, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := metrics[0].Value; v != float64(int32(-0x20000)) {
+			t.Fatalf("expected %v but got %v", int32(-0x20000), v)
+		}
+		if v := metrics[1].Value; v != 3 {
+			t.Fatalf("expected 3 but got %v", v)
+		}
+
+		// The high word is read together with the adjacent metric.
+		expectedRequests := []fakeRequest{
+			{modbus.FuncCodeReadHoldingRegisters, 100, 2},
+			{modbus.FuncCodeReadHoldingRegisters, 500, 1},
+		}
+		if r := fake.recorded(); !reflect.DeepEqual(r, expectedRequests) {
+			t.Fatalf("expected requests %v but got %v", expectedRequests, r)
+		}
+	})
+}
+
+// float32Block returns the definitions of count consecutive float32 input
+// registers in the given endianness and a fake client holding the values
+// i + 0.5 in them.
+func float32Block(count int, endianness config.EndiannessType) ([]config.MetricDef, *fakeClient) {
+	definitions := make([]config.MetricDef, 0, count)
+	c := newFakeClient()
+
+	for i := 0; i < count; i++ {
+		address := 1 + 2*i
+		definitions = append(definitions, config.MetricDef{
+			Name:       fmt.Sprintf("measurement_%v", i),
+			Address:    config.RegisterAddr(400000 + address),
+			DataType:   config.ModbusFloat32,
+			MetricType: config.MetricTypeGauge,
+			Endianness: endianness,
+		})
+
+		bigEndian := make([]byte, 4)
+		binary.BigEndian.PutUint32(bigEndian, math.Float32bits(float32(i)+0.5))
+		// The byte orders are their own inverse.
+		raw, _ := convertEndianness32b(endianness, bigEndian)
+		c.inputRegisters[uint16(address)] = binary.BigEndian.Uint16(raw[0:2])
+		c.inputRegisters[uint16(address+1)] = binary.BigEndian.Uint16(raw[2:4])
+	}
+
+	return definitions, c
+}
+
+func TestCoalescedFloat32Block(t *testing.T) {
+	for _, endianness := range []config.EndiannessType{
+		config.EndiannessBigEndian,
+		config.EndiannessLittleEndian,
+		config.EndiannessMixedEndian,
+		config.EndiannessYolo,
+	} {
+		t.Run(string(endianness), func(t *testing.T) {
+			definitions, c := float32Block(50, endianness)
+
+			client, err := newCoalescingClient(c, definitions, 0, 0, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			metrics, err := scrapeMetrics(definitions, client)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(metrics) != 50 {
+				t.Fatalf("expected 50 metrics but got %v", len(metrics))
+			}
+			for i, m := range metrics {
+				if expected := float64(i) + 0.5; m.Value != expected {
+					t.Fatalf("expected %v to be %v but got %v", m.Name, expected, m.Value)
+				}
+			}
+
+			// The 100 registers are read with a single request.
+			expectedRequests := []fakeRequest{{modbus.FuncCodeReadInputRegisters, 1, 100}}
+			if r := c.recorded(); !reflect.DeepEqual(r, expectedRequests) {
+				t.Fatalf("expected requests %v but got %v", expectedRequests, r)
+			}
+		})
+	}
+}
+
+func TestCoalescedMaxRegistersPerRead(t *testing.T) {
+	definitions, c := float32Block(50, config.EndiannessBigEndian)
+
+	client, err := newCoalescingClient(c, definitions, 0, 32, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := scrapeMetrics(definitions, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(metrics) != 50 {
+		t.Fatalf("expected 50 metrics but got %v", len(metrics))
+	}
+	for i, m := range metrics {
+		if expected := float64(i) + 0.5; m.Value != expected {
+			t.Fatalf("expected %v to be %v but got %v", m.Name, expected, m.Value)
+		}
+	}
+
+	// The 100 registers are split into reads of at most 32 registers.
+	expectedRequests := []fakeRequest{
+		{modbus.FuncCodeReadInputRegisters, 1, 32},
+		{modbus.FuncCodeReadInputRegisters, 33, 32},
+		{modbus.FuncCodeReadInputRegisters, 65, 32},
+		{modbus.FuncCodeReadInputRegisters, 97, 4},
+	}
+	if r := c.recorded(); !reflect.DeepEqual(r, expectedRequests) {
+		t.Fatalf("expected requests %v but got %v", expectedRequests, r)
+	}
+}
+
+func BenchmarkParseFloat32Block(b *testing.B) {
+	definitions, c := float32Block(50, config.EndiannessMixedEndian)
+	data, err := c.ReadInputRegisters(1, 100)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j, definition := range definitions {
+			if _, err := parseMetric(definition, data[4*j:4*j+4]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+// applyConditions removes the metrics whose condition does not hold for the
+// value the referenced metric was read with, or whose referenced metric was
+// not read. Conditions are evaluated once all metrics were read, thus
+// independently of the order of the metrics.
+func applyConditions(metrics []metric) []metric {
+	values := map[string]float64{}
+	conditional := false
+	for _, m := range metrics {
+		values[m.Name] = m.Value
+		if m.Condition != nil {
+			conditional = true
+		}
+	}
+
+	if !conditional {
+		return metrics
+	}
+
+	emitted := make([]metric, 0, len(metrics))
+	for _, m := range metrics {
+		if m.Condition != nil {
+			v, ok := values[m.Condition.Metric]
+			if !ok || !m.Condition.Holds(v) {
+				continue
+			}
+		}
+
+		emitted = append(emitted, m)
+	}
+
+	return emitted
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+func TestScrapeMetricsCondition(t *testing.T) {
+	// The conditional metric precedes the metric it references.
+	definitions := []config.MetricDef{
+		{
+			Name:       "error_code",
+			Address:    300002,
+			DataType:   config.ModbusUInt16,
+			MetricType: config.MetricTypeGauge,
+			Condition: &config.Condition{
+				Metric:   "has_error",
+				Operator: config.ConditionEqual,
+				Value:    1,
+			},
+		},
+		{
+			Name:       "has_error",
+			Address:    300001,
+			DataType:   config.ModbusUInt16,
+			MetricType: config.MetricTypeGauge,
+		},
+	}
+
+	for _, test := range []struct {
+		flag     uint16
+		expected []string
+	}{
+		{flag: 0, expected: []string{"has_error"}},
+		{flag: 1, expected: []string{"error_code", "has_error"}},
+	} {
+		t.Run(fmt.Sprint(test.flag), func(t *testing.T) {
+			c := newFakeClient()
+			c.holdingRegisters[1] = test.flag
+			c.holdingRegisters[2] = 42
+
+			metrics, err := scrapeMetrics(definitions, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := []string{}
+			for _, m := range metrics {
+				names = append(names, m.Name)
+			}
+			if fmt.Sprint(names) != fmt.Sprint(test.expected) {
+				t.Fatalf("expected metrics %v but got %v", test.expected, names)
+			}
+		})
+	}
+}
+
+func TestApplyConditionsUnreadMetric(t *testing.T) {
+	metrics := []metric{
+		{Name: "error_code", Value: 42, Condition: &config.Condition{Metric: "has_error", Operator: config.ConditionNotEqual, Value: 0}},
+	}
+
+	if emitted := applyConditions(metrics); len(emitted) != 0 {
+		t.Fatalf("expected metric referencing an unread metric to be suppressed but got %v", emitted)
+	}
+}
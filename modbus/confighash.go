@@ -0,0 +1,67 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+// scrapeConfigHashes reads the register blocks of the given config hashes,
+// returning a gauge with the hash of each block.
+func scrapeConfigHashes(hashes []config.ConfigHash, c modbus.Client) ([]metric, error) {
+	metrics := []metric{}
+
+	for _, h := range hashes {
+		modFunction, modAddress, err := splitAddress(h.Address)
+		if err != nil {
+			return []metric{}, err
+		}
+
+		f := registerReadFunc(c, modFunction)
+		if f == nil {
+			return []metric{}, fmt.Errorf("config hash address '%v' is not a holding or input register address", h.Address)
+		}
+
+		data := make([]byte, 0, 2*h.Length)
+		for offset := 0; offset < h.Length; offset += maxReadRegisters {
+			quantity := h.Length - offset
+			if quantity > maxReadRegisters {
+				quantity = maxReadRegisters
+			}
+
+			chunk, err := f(uint16(int(modAddress)+offset), uint16(quantity))
+			if err != nil {
+				return []metric{}, fmt.Errorf("config hash '%v', address '%v': %v", h.Name, h.Address, err)
+			}
+			data = append(data, chunk...)
+		}
+
+		metrics = append(metrics, metric{Name: h.Name, Help: h.Help, Labels: copyLabels(h.Labels), Value: float64(hashRegisters(data)), MetricType: config.MetricTypeGauge})
+	}
+
+	return metrics, nil
+}
+
+// hashRegisters returns the 32-bit FNV-1a hash of the given register data,
+// which is exactly representable as a float64 sample value.
+func hashRegisters(data []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(data)
+
+	return h.Sum32()
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+func TestHashRegisters(t *testing.T) {
+	data := []byte{0x00, 0x01, 0x12, 0x34, 0xAB, 0xCD}
+
+	if hashRegisters(data) != hashRegisters(append([]byte{}, data...)) {
+		t.Error("expected identical bytes to produce the same hash")
+	}
+
+	changed := append([]byte{}, data...)
+	changed[3] = 0x35
+	if hashRegisters(data) == hashRegisters(changed) {
+		t.Error("expected a one byte change to produce a different hash")
+	}
+}
+
+func TestScrapeConfigHashes(t *testing.T) {
+	hashes := []config.ConfigHash{
+		{Name: "settings_hash", Help: "hash of the settings", Labels: map[string]string{"block": "settings"}, Address: 300001, Length: 130},
+	}
+
+	c := newFakeClient()
+	for i := uint16(1); i <= 130; i++ {
+		c.holdingRegisters[i] = i
+	}
+
+	metrics, err := scrapeConfigHashes(hashes, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks exceeding the maximum of a single read are split.
+	expectedRequests := []fakeRequest{
+		{0x03, 1, 125},
+		{0x03, 126, 5},
+	}
+	if len(c.requests) != len(expectedRequests) {
+		t.Fatalf("expected requests %v but got %v", expectedRequests, c.requests)
+	}
+	for i, r := range expectedRequests {
+		if c.requests[i] != r {
+			t.Errorf("expected request %v but got %v", r, c.requests[i])
+		}
+	}
+
+	data := make([]byte, 0, 260)
+	for i := 1; i <= 130; i++ {
+		data = append(data, byte(i>>8), byte(i))
+	}
+	if len(metrics) != 1 || metrics[0].Value != float64(hashRegisters(data)) || metrics[0].Labels["block"] != "settings" {
+		t.Fatalf("expected the hash of the block but got %v", metrics)
+	}
+
+	// The hash changes with any register of the block.
+	c.holdingRegisters[128] = 0
+	changed, err := scrapeConfigHashes(hashes, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed[0].Value == metrics[0].Value {
+		t.Error("expected a changed register to change the hash")
+	}
+}
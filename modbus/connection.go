@@ -0,0 +1,434 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	stdlog "log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/goburrow/modbus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// connection is an established connection to a modbus target.
+type connection struct {
+	// handler is used for requests the client does not implement.
+	handler modbus.ClientHandler
+	client  modbus.Client
+	close   func() error
+	// setTimeout sets the timeout of the following requests, returning the
+	// previous one. Nil if the connection does not support it.
+	setTimeout func(time.Duration) time.Duration
+
+	// malformed counts the malformed responses to requests sent via the
+	// handler. Nil if the connection does not count them.
+	malformed prometheus.Counter
+
+	// prepared is set once the module's pre-scrape writes were performed on
+	// the connection.
+	prepared bool
+}
+
+// countMalformed counts the given error of a request sent via the handler if
+// it is a malformed response, and returns it.
+func (c *connection) countMalformed(err error) error {
+	var malformed *MalformedResponseError
+	if c.malformed != nil && errors.As(err, &malformed) {
+		c.malformed.Inc()
+	}
+
+	return err
+}
+
+// connectionKey identifies the connections which can be reused for a scrape.
+type connectionKey struct {
+	module    string
+	target    string
+	subTarget byte
+}
+
+// connectTCP establishes a new modbus TCP connection to the given target,
+// through the module's proxy if it configures one.
+func (e *Exporter) connectTCP(module *config.Module, target string, subTarget byte) (*connection, error) {
+	if module.ProxyURL != "" {
+		return e.connectStream(module, target, subTarget, dialProxy)
+	}
+
+	handler := e.newTCPClientHandler(module, target, subTarget)
+	if err := connectWithRetries(module, handler.Connect); err != nil {
+		return nil, fmt.Errorf("unable to connect with target %s via module %s",
+			target, module.Name)
+	}
+
+	if module.Workarounds.SleepAfterConnect > 0 {
+		time.Sleep(module.Workarounds.SleepAfterConnect)
+	}
+
+	counting := e.countBytes(module, target, handler)
+
+	return &connection{
+		handler: counting,
+		client:  modbus.NewClient(counting),
+		close:   handler.Close,
+		setTimeout: func(timeout time.Duration) time.Duration {
+			previous := handler.Timeout
+			handler.Timeout = timeout
+			return previous
+		},
+	}, nil
+}
+
+// newTCPClientHandler returns a modbus TCP client handler for the given
+// target, not connected yet.
+func (e *Exporter) newTCPClientHandler(module *config.Module, target string, subTarget byte) *tcpClientHandler {
+	handler := &tcpClientHandler{
+		TCPClientHandler: modbus.NewTCPClientHandler(target),
+		lax:              module.TransactionIDMatching == config.TransactionIDMatchingLax,
+		mismatches:       e.transactionIDMismatches.WithLabelValues(module.Name, target),
+	}
+	if module.Timeout != 0 {
+		handler.Timeout = time.Duration(module.Timeout) * time.Millisecond
+	}
+	if module.ReuseConnection {
+		// The handler would close idle connections and silently reconnect
+		// on the next request, losing the state established by the
+		// pre-scrape writes, e.g. a login, which are only performed once per
+		// connection.
+		handler.IdleTimeout = 0
+	}
+	handler.SlaveId = subTarget
+	// Frames are traced at debug level only, as filtered by the logger.
+	handler.Logger = stdlog.New(log.NewStdlibAdapter(
+		level.Debug(log.With(e.Logger, "module", module.Name, "target", target, "sub_target", subTarget)),
+	), "", 0)
+
+	return handler
+}
+
+// tcpClientHandler is a modbus TCP client handler counting responses with a
+// mismatching transaction ID, which it only accepts in lax mode.
+type tcpClientHandler struct {
+	*modbus.TCPClientHandler
+
+	lax        bool
+	mismatches prometheus.Counter
+}
+
+// Verify implements modbus.Packager.
+func (h *tcpClientHandler) Verify(aduRequest []byte, aduResponse []byte) error {
+	if len(aduRequest) >= 2 && len(aduResponse) >= 2 && !bytes.Equal(aduRequest[:2], aduResponse[:2]) {
+		h.mismatches.Inc()
+
+		if h.lax {
+			// Verify the rest of the header as if the transaction IDs
+			// matched.
+			response := append([]byte{}, aduResponse...)
+			copy(response, aduRequest[:2])
+			return h.TCPClientHandler.Verify(aduRequest, response)
+		}
+	}
+
+	return h.TCPClientHandler.Verify(aduRequest, aduResponse)
+}
+
+// countingClientHandler is a modbus.ClientHandler counting the bytes of the
+// frames sent to and received from a target.
+type countingClientHandler struct {
+	modbus.ClientHandler
+
+	written prometheus.Counter
+	read    prometheus.Counter
+}
+
+// countBytes returns the given handler counting the bytes transferred in the
+// connection bytes counter if the module enables it.
+func (e *Exporter) countBytes(module *config.Module, target string, handler modbus.ClientHandler) modbus.ClientHandler {
+	if !module.CountConnectionBytes {
+		return handler
+	}
+
+	return &countingClientHandler{
+		ClientHandler: handler,
+		written:       e.connectionBytes.WithLabelValues(module.Name, target, "written"),
+		read:          e.connectionBytes.WithLabelValues(module.Name, target, "read"),
+	}
+}
+
+// Send implements modbus.Transporter. Requests failing to be sent are
+// counted as written nonetheless.
+func (h *countingClientHandler) Send(aduRequest []byte) ([]byte, error) {
+	aduResponse, err := h.ClientHandler.Send(aduRequest)
+	h.written.Add(float64(len(aduRequest)))
+	h.read.Add(float64(len(aduResponse)))
+
+	return aduResponse, err
+}
+
+// connectWithRetries calls connect, retrying a failed connection establishment
+// as configured by the module's workarounds.
+func connectWithRetries(module *config.Module, connect func() error) error {
+	err := connect()
+	for i := 0; err != nil && i < module.Workarounds.ConnectRetries; i++ {
+		time.Sleep(module.Workarounds.ConnectRetryDelay)
+		err = connect()
+	}
+
+	return err
+}
+
+// acquireConnection returns an idle connection to the given target if the
+// module reuses connections and one is available, otherwise it establishes a
+// new one. Connections are never shared by concurrent scrapes.
+func (e *Exporter) acquireConnection(module *config.Module, target string, subTarget byte) (*connection, error) {
+	key := connectionKey{module.Name, target, subTarget}
+
+	if module.ReuseConnection {
+		e.connectionsMu.Lock()
+		conn, ok := e.connections[key]
+		delete(e.connections, key)
+		e.connectionsMu.Unlock()
+
+		if ok {
+			return conn, nil
+		}
+	}
+
+	conn, err := e.connect(module, target, subTarget)
+	if err != nil {
+		return nil, err
+	}
+	conn.client = e.paceReads(e.instrumentClient(e.validateResponses(conn.client, module, target), module.Name, target), module)
+	conn.handler = e.instrumentHandler(conn.handler, module.Name, target, conn.client)
+	conn.malformed = e.malformedResponses.WithLabelValues(module.Name, target)
+
+	e.connectionsMu.Lock()
+	reconnect := e.dropped[key]
+	delete(e.dropped, key)
+	e.connectionsMu.Unlock()
+
+	if reconnect {
+		e.reconnects.WithLabelValues(module.Name, target).Inc()
+	}
+
+	return conn, nil
+}
+
+// releaseConnection hands back a connection after a scrape. The connection is
+// kept for reuse if the module reuses connections and the scrape did not fail,
+// as a failed request might leave the connection in an unknown state.
+func (e *Exporter) releaseConnection(module *config.Module, target string, subTarget byte, conn *connection, scrapeErr error) {
+	key := connectionKey{module.Name, target, subTarget}
+
+	if module.ReuseConnection && scrapeErr == nil {
+		e.connectionsMu.Lock()
+		_, ok := e.connections[key]
+		if !ok {
+			e.connections[key] = conn
+		}
+		e.connectionsMu.Unlock()
+
+		if !ok {
+			return
+		}
+	}
+
+	if module.ReuseConnection && scrapeErr != nil {
+		// The next connection established to the target replaces the
+		// dropped one.
+		e.connectionsMu.Lock()
+		e.dropped[key] = true
+		e.connectionsMu.Unlock()
+	}
+
+	conn.close()
+}
+
+// acquireHostSlot blocks until fewer than MaxConnectionsPerHost scrapes of
+// targets on the host of the given target are in progress, returning the
+// function releasing the slot again.
+func (e *Exporter) acquireHostSlot(target string) func() {
+	if e.MaxConnectionsPerHost <= 0 {
+		return func() {}
+	}
+
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+
+	e.connectionsMu.Lock()
+	slots, ok := e.hostSlots[host]
+	if !ok {
+		slots = make(chan struct{}, e.MaxConnectionsPerHost)
+		e.hostSlots[host] = slots
+	}
+	e.connectionsMu.Unlock()
+
+	slots <- struct{}{}
+
+	return func() { <-slots }
+}
+
+// instrumentedClient is a modbus.Client observing the duration of each
+// request and counting the registers read.
+type instrumentedClient struct {
+	modbus.Client
+
+	now           func() time.Time
+	observe       func(function byte, start time.Time)
+	registersRead prometheus.Counter
+}
+
+// instrumentClient returns the given client observing the duration of each
+// request in the request duration histogram and counting the registers read
+// successfully in the registers read counter.
+func (e *Exporter) instrumentClient(c modbus.Client, module, target string) modbus.Client {
+	return &instrumentedClient{
+		Client: c,
+		now:    e.now,
+		observe: func(function byte, start time.Time) {
+			e.requestDuration.WithLabelValues(module, target, strconv.Itoa(int(function))).
+				Observe(e.now().Sub(start).Seconds())
+		},
+		registersRead: e.registersRead.WithLabelValues(module, target),
+	}
+}
+
+// instrumentedHandler is a modbus.ClientHandler observing the duration of the
+// requests the client does not implement, paced together with the reads of the
+// client.
+type instrumentedHandler struct {
+	modbus.ClientHandler
+
+	// function is the function code of the request encoded last.
+	function byte
+	now      func() time.Time
+	wait     func()
+	observe  func(function byte, start time.Time)
+}
+
+// instrumentHandler returns the given handler observing the duration of each
+// request in the request duration histogram. If the given client paces reads,
+// the requests wait for the scan cycle like its reads. Requests are not
+// verified, as reading FIFO queues removes the values read.
+func (e *Exporter) instrumentHandler(handler modbus.ClientHandler, module, target string, c modbus.Client) modbus.ClientHandler {
+	if handler == nil {
+		return nil
+	}
+
+	wait := func() {}
+	if paced, ok := c.(*pacedClient); ok {
+		wait = paced.wait
+	}
+
+	return &instrumentedHandler{
+		ClientHandler: handler,
+		now:           e.now,
+		wait:          wait,
+		observe: func(function byte, start time.Time) {
+			e.requestDuration.WithLabelValues(module, target, strconv.Itoa(int(function))).
+				Observe(e.now().Sub(start).Seconds())
+		},
+	}
+}
+
+// Encode implements modbus.Packager, remembering the function code of the
+// request.
+func (h *instrumentedHandler) Encode(pdu *modbus.ProtocolDataUnit) ([]byte, error) {
+	h.function = pdu.FunctionCode
+	return h.ClientHandler.Encode(pdu)
+}
+
+// Send implements modbus.Transporter.
+func (h *instrumentedHandler) Send(aduRequest []byte) ([]byte, error) {
+	h.wait()
+	defer h.observe(h.function, h.now())
+	return h.ClientHandler.Send(aduRequest)
+}
+
+// countRegisters counts the given quantity of registers as read unless the
+// read failed.
+func (c *instrumentedClient) countRegisters(quantity uint16, data []byte, err error) ([]byte, error) {
+	if err == nil {
+		c.registersRead.Add(float64(quantity))
+	}
+
+	return data, err
+}
+
+func (c *instrumentedClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	defer c.observe(modbus.FuncCodeReadCoils, c.now())
+	return c.Client.ReadCoils(address, quantity)
+}
+
+func (c *instrumentedClient) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+	defer c.observe(modbus.FuncCodeReadDiscreteInputs, c.now())
+	return c.Client.ReadDiscreteInputs(address, quantity)
+}
+
+func (c *instrumentedClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	defer c.observe(modbus.FuncCodeReadHoldingRegisters, c.now())
+	data, err := c.Client.ReadHoldingRegisters(address, quantity)
+	return c.countRegisters(quantity, data, err)
+}
+
+func (c *instrumentedClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	defer c.observe(modbus.FuncCodeReadInputRegisters, c.now())
+	data, err := c.Client.ReadInputRegisters(address, quantity)
+	return c.countRegisters(quantity, data, err)
+}
+
+func (c *instrumentedClient) WriteSingleCoil(address, value uint16) ([]byte, error) {
+	defer c.observe(modbus.FuncCodeWriteSingleCoil, c.now())
+	return c.Client.WriteSingleCoil(address, value)
+}
+
+func (c *instrumentedClient) WriteMultipleCoils(address, quantity uint16, value []byte) ([]byte, error) {
+	defer c.observe(modbus.FuncCodeWriteMultipleCoils, c.now())
+	return c.Client.WriteMultipleCoils(address, quantity, value)
+}
+
+func (c *instrumentedClient) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	defer c.observe(modbus.FuncCodeWriteSingleRegister, c.now())
+	return c.Client.WriteSingleRegister(address, value)
+}
+
+func (c *instrumentedClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	defer c.observe(modbus.FuncCodeWriteMultipleRegisters, c.now())
+	return c.Client.WriteMultipleRegisters(address, quantity, value)
+}
+
+func (c *instrumentedClient) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) ([]byte, error) {
+	defer c.observe(modbus.FuncCodeReadWriteMultipleRegisters, c.now())
+	data, err := c.Client.ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity, value)
+	return c.countRegisters(readQuantity, data, err)
+}
+
+func (c *instrumentedClient) MaskWriteRegister(address, andMask, orMask uint16) ([]byte, error) {
+	defer c.observe(modbus.FuncCodeMaskWriteRegister, c.now())
+	return c.Client.MaskWriteRegister(address, andMask, orMask)
+}
+
+func (c *instrumentedClient) ReadFIFOQueue(address uint16) ([]byte, error) {
+	defer c.observe(modbus.FuncCodeReadFIFOQueue, c.now())
+	return c.Client.ReadFIFOQueue(address)
+}
@@ -0,0 +1,721 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/goburrow/modbus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestPreScrapeWrites(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		PreScrapeWrites: []config.RegisterWrite{
+			{Address: 300100, Values: []uint16{1234}},
+			{Address: 300101, Values: []uint16{5, 6}},
+		},
+		Metrics: []config.MetricDef{
+			{
+				Name:       "my_metric",
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+		},
+	}
+
+	login := []fakeRequest{
+		{modbus.FuncCodeWriteSingleRegister, 100, 1},
+		{modbus.FuncCodeWriteMultipleRegisters, 101, 2},
+	}
+	read := fakeRequest{modbus.FuncCodeReadHoldingRegisters, 1, 1}
+
+	for _, test := range []struct {
+		name            string
+		reuseConnection bool
+		connects        int
+		closes          int
+		expected        []fakeRequest
+	}{
+		{
+			name:            "reused connection",
+			reuseConnection: true,
+			connects:        1,
+			closes:          0,
+			expected:        append(append([]fakeRequest{}, login...), read, read),
+		},
+		{
+			name:            "new connection per scrape",
+			reuseConnection: false,
+			connects:        2,
+			closes:          2,
+			expected:        append(append(append(append([]fakeRequest{}, login...), read), login...), read),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			module := module
+			module.ReuseConnection = test.reuseConnection
+
+			c := newFakeClient()
+			connects := 0
+			closes := 0
+
+			e := NewExporter(config.Config{Modules: []config.Module{module}})
+			e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+				connects++
+				return &connection{
+					client: c,
+					close: func() error {
+						closes++
+						return nil
+					},
+				}, nil
+			}
+
+			for i := 0; i < 2; i++ {
+				if _, err := e.Scrape("127.0.0.1:502", 1, "my_module"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if connects != test.connects {
+				t.Fatalf("expected %v connects but got %v", test.connects, connects)
+			}
+			if closes != test.closes {
+				t.Fatalf("expected %v closes but got %v", test.closes, closes)
+			}
+
+			if requests := c.recorded(); !reflect.DeepEqual(requests, test.expected) {
+				t.Fatalf("expected requests %v but got %v", test.expected, requests)
+			}
+		})
+	}
+}
+
+func TestReleaseConnectionClosesOnError(t *testing.T) {
+	module := &config.Module{Name: "my_module", ReuseConnection: true}
+	e := NewExporter(config.Config{})
+
+	closed := false
+	conn := &connection{close: func() error {
+		closed = true
+		return nil
+	}}
+
+	e.releaseConnection(module, "127.0.0.1:502", 1, conn, fmt.Errorf("i/o timeout"))
+
+	if !closed {
+		t.Fatal("expected connection to be closed after a failed scrape")
+	}
+	if len(e.connections) != 0 {
+		t.Fatal("expected connection not to be kept for reuse after a failed scrape")
+	}
+}
+
+func TestReconnectsCounter(t *testing.T) {
+	module := config.Module{
+		Name:            "my_module",
+		Protocol:        config.ModbusProtocolTCPIP,
+		ReuseConnection: true,
+		Metrics: []config.MetricDef{
+			{
+				Name:       "my_metric",
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+		},
+	}
+
+	c := newFakeClient()
+	connects := 0
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		connects++
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+	reconnects := e.reconnects.WithLabelValues("my_module", "127.0.0.1:502")
+
+	for _, step := range []struct {
+		fail               bool
+		expectedConnects   int
+		expectedReconnects float64
+	}{
+		{fail: false, expectedConnects: 1, expectedReconnects: 0},
+		{fail: false, expectedConnects: 1, expectedReconnects: 0},
+		// The failed scrape drops the reused connection.
+		{fail: true, expectedConnects: 1, expectedReconnects: 0},
+		{fail: false, expectedConnects: 2, expectedReconnects: 1},
+		{fail: false, expectedConnects: 2, expectedReconnects: 1},
+	} {
+		c.fail = nil
+		if step.fail {
+			c.fail = func(fakeRequest) error { return fmt.Errorf("i/o timeout") }
+		}
+
+		_, err := e.Scrape("127.0.0.1:502", 1, "my_module")
+		if step.fail && err == nil {
+			t.Fatal("expected scrape to fail")
+		}
+		if !step.fail && err != nil {
+			t.Fatal(err)
+		}
+
+		if connects != step.expectedConnects {
+			t.Fatalf("expected %v connects but got %v", step.expectedConnects, connects)
+		}
+		if r := testutil.ToFloat64(reconnects); r != step.expectedReconnects {
+			t.Fatalf("expected %v reconnects but got %v", step.expectedReconnects, r)
+		}
+	}
+}
+
+func TestMaxConnectionsPerHost(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Metrics: []config.MetricDef{
+			{
+				Name:       "my_metric",
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+		},
+	}
+
+	var mu sync.Mutex
+	active := map[string]int{}
+	maxActive := map[string]int{}
+	connects := 0
+	gate := make(chan struct{})
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.MaxConnectionsPerHost = 2
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		host, _, _ := net.SplitHostPort(target)
+
+		mu.Lock()
+		connects++
+		active[host]++
+		if active[host] > maxActive[host] {
+			maxActive[host] = active[host]
+		}
+		mu.Unlock()
+
+		<-gate
+
+		return &connection{client: newFakeClient(), close: func() error {
+			mu.Lock()
+			active[host]--
+			mu.Unlock()
+			return nil
+		}}, nil
+	}
+
+	var wg sync.WaitGroup
+	for _, target := range []string{"10.0.0.1:502", "10.0.0.1:503", "10.0.0.2:502"} {
+		for subTarget := byte(1); subTarget <= 2; subTarget++ {
+			wg.Add(1)
+			go func(target string, subTarget byte) {
+				defer wg.Done()
+				if _, err := e.Scrape(target, subTarget, "my_module"); err != nil {
+					t.Error(err)
+				}
+			}(target, subTarget)
+		}
+	}
+
+	// Two scrapes of each host get to connect, the others have to wait.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		c := connects
+		mu.Unlock()
+		if c == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 4 concurrent connects but got %v", c)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	if connects != 4 {
+		t.Errorf("expected the connection limit to hold back further connects, got %v connects", connects)
+	}
+	mu.Unlock()
+
+	close(gate)
+	wg.Wait()
+
+	if connects != 6 {
+		t.Fatalf("expected 6 connects but got %v", connects)
+	}
+	for host, expected := range map[string]int{"10.0.0.1": 2, "10.0.0.2": 2} {
+		if maxActive[host] != expected {
+			t.Errorf("expected at most %v concurrent connections to %v but got %v", expected, host, maxActive[host])
+		}
+	}
+}
+
+func TestRequestDuration(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Metrics: []config.MetricDef{
+			{
+				Name:       "my_metric",
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+			{
+				Name:       "my_other_metric",
+				Address:    400001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+		},
+	}
+
+	now := time.Unix(1600000000, 0)
+	c := newFakeClient()
+	// Each holding register read takes 20ms, input register reads take 5ms.
+	c.fail = func(r fakeRequest) error {
+		if r.function == modbus.FuncCodeReadHoldingRegisters {
+			now = now.Add(20 * time.Millisecond)
+		} else {
+			now = now.Add(5 * time.Millisecond)
+		}
+		return nil
+	}
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.now = func() time.Time { return now }
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := e.Scrape("127.0.0.1:502", 1, "my_module"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e)
+	metricFamilies, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	observed := map[string]*dto.Histogram{}
+	for _, mf := range metricFamilies {
+		if mf.GetName() != "modbus_request_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "function_code" {
+					observed[l.GetValue()] = m.GetHistogram()
+				}
+			}
+		}
+	}
+
+	for functionCode, expectedSum := range map[string]float64{"3": 0.04, "4": 0.01} {
+		h, ok := observed[functionCode]
+		if !ok {
+			t.Fatalf("expected observations for function code %v", functionCode)
+		}
+		if h.GetSampleCount() != 2 {
+			t.Errorf("expected 2 observations for function code %v but got %v", functionCode, h.GetSampleCount())
+		}
+		if math.Abs(h.GetSampleSum()-expectedSum) > 1e-9 {
+			t.Errorf("expected observed sum %v for function code %v but got %v", expectedSum, functionCode, h.GetSampleSum())
+		}
+	}
+}
+
+func TestInstrumentedHandler(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	sleeps := []time.Duration{}
+
+	e := NewExporter(config.Config{})
+	e.now = func() time.Time { return now }
+
+	paced := &pacedClient{
+		Client:    newFakeClient(),
+		scanCycle: 100 * time.Millisecond,
+		now:       e.now,
+		sleep: func(d time.Duration) {
+			sleeps = append(sleeps, d)
+			now = now.Add(d)
+		},
+	}
+	// Each FIFO queue read takes 10ms.
+	h := e.instrumentHandler(newFakeHandler(func(request *modbus.ProtocolDataUnit) *modbus.ProtocolDataUnit {
+		now = now.Add(10 * time.Millisecond)
+		return fifoResponse([]uint16{1, 2})
+	}), "my_module", "localhost:502", paced)
+
+	for i := 0; i < 2; i++ {
+		if _, err := readFIFOQueue(h, 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second read waits for the rest of the scan cycle.
+	if expected := []time.Duration{90 * time.Millisecond}; !reflect.DeepEqual(sleeps, expected) {
+		t.Fatalf("expected sleeps %v but got %v", expected, sleeps)
+	}
+
+	m := &dto.Metric{}
+	if err := e.requestDuration.WithLabelValues("my_module", "localhost:502", "24").(prometheus.Metric).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if c := m.GetHistogram().GetSampleCount(); c != 2 {
+		t.Fatalf("expected 2 observations for function code 24 but got %v", c)
+	}
+	if s := m.GetHistogram().GetSampleSum(); math.Abs(s-0.02) > 1e-9 {
+		t.Fatalf("expected observed sum 0.02 but got %v", s)
+	}
+}
+
+func TestRegistersRead(t *testing.T) {
+	module := config.Module{
+		Name:           "my_module",
+		Protocol:       config.ModbusProtocolTCPIP,
+		CoalesceReads:  true,
+		CoalesceMaxGap: 1,
+		Metrics: []config.MetricDef{
+			{Name: "energy", Address: 300001, DataType: config.ModbusUInt32, MetricType: config.MetricTypeCounter},
+			{Name: "energy_high_word", Address: 300001, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge},
+			{Name: "energy_low_word", Address: 300002, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge},
+			{Name: "status", Address: 300004, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge},
+		},
+	}
+
+	c := newFakeClient()
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := e.Scrape("127.0.0.1:502", 1, "my_module"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each scrape reads registers 1 to 4 with a single request rather than
+	// the 5 registers of the metrics.
+	expected := `
+# HELP modbus_registers_read_total Number of holding and input registers read from a target, counting the registers of coalesced reads rather than of the metrics read.
+# TYPE modbus_registers_read_total counter
+modbus_registers_read_total{module="my_module",target="127.0.0.1:502"} 8
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "modbus_registers_read_total"); err != nil {
+		t.Fatal(err)
+	}
+	if r := c.recorded(); len(r) != 2 {
+		t.Fatalf("expected 2 requests but got %v", r)
+	}
+}
+
+func TestConnectWithRetries(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		retries  int
+		failures int
+		attempts int
+		fail     bool
+	}{
+		{name: "established after retry", retries: 2, failures: 1, attempts: 2},
+		{name: "established without retry", retries: 2, failures: 0, attempts: 1},
+		{name: "no retries", retries: 0, failures: 1, attempts: 1, fail: true},
+		{name: "retries exhausted", retries: 2, failures: 3, attempts: 3, fail: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			module := &config.Module{
+				Name: "my_module",
+				Workarounds: config.Workarounds{
+					ConnectRetries:    test.retries,
+					ConnectRetryDelay: time.Millisecond,
+				},
+			}
+
+			attempts := 0
+			dial := func() error {
+				attempts++
+				if attempts <= test.failures {
+					return fmt.Errorf("connection refused")
+				}
+				return nil
+			}
+
+			err := connectWithRetries(module, dial)
+			if test.fail && err == nil {
+				t.Fatal("expected connection establishment to fail")
+			}
+			if !test.fail && err != nil {
+				t.Fatalf("expected connection to be established but got %v", err)
+			}
+			if attempts != test.attempts {
+				t.Fatalf("expected %v connection attempts but got %v", test.attempts, attempts)
+			}
+		})
+	}
+}
+
+func TestFrameLogging(t *testing.T) {
+	serv, address := startFakeServer(t)
+	serv.HoldingRegisters[1] = 42
+
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Metrics: []config.MetricDef{
+			{
+				Name:       "my_metric",
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+		},
+	}
+
+	for _, test := range []struct {
+		name   string
+		level  level.Option
+		frames bool
+	}{
+		{"debug", level.AllowDebug(), true},
+		{"info", level.AllowInfo(), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			e := NewExporter(config.Config{Modules: []config.Module{module}})
+			e.Logger = level.NewFilter(log.NewLogfmtLogger(&logs), test.level)
+
+			if _, err := e.Scrape(address, 1, "my_module"); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, frame := range []string{"modbus: sending", "modbus: received"} {
+				if strings.Contains(logs.String(), frame) != test.frames {
+					t.Fatalf("expected %q to be logged %v but got %q", frame, test.frames, logs.String())
+				}
+			}
+			if test.frames && !strings.Contains(logs.String(), "level=debug") {
+				t.Fatalf("expected frames to be logged at debug level but got %q", logs.String())
+			}
+		})
+	}
+}
+
+func TestTransactionIDMatching(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		matching config.TransactionIDMatching
+		fail     bool
+	}{
+		{name: "strict by default", matching: "", fail: true},
+		{name: "strict", matching: config.TransactionIDMatchingStrict, fail: true},
+		{name: "lax", matching: config.TransactionIDMatchingLax, fail: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			target := serveFixedTransactionID(t, 0x0042)
+
+			module := &config.Module{Name: "my_module", TransactionIDMatching: test.matching}
+			e := NewExporter(config.Config{})
+			conn, err := e.connect(module, target, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.close()
+
+			data, err := conn.client.ReadHoldingRegisters(0, 1)
+			if test.fail && err == nil {
+				t.Fatal("expected read with mismatching transaction ID to fail")
+			}
+			if !test.fail {
+				if err != nil {
+					t.Fatalf("expected read with mismatching transaction ID to succeed but got %v", err)
+				}
+				if !reflect.DeepEqual(data, []byte{0x12, 0x34}) {
+					t.Fatalf("expected register value 0x1234 but got % x", data)
+				}
+			}
+
+			if v := testutil.ToFloat64(e.transactionIDMismatches.WithLabelValues("my_module", target)); v != 1 {
+				t.Fatalf("expected 1 transaction ID mismatch but got %v", v)
+			}
+		})
+	}
+}
+
+func TestReusedConnectionIdleTimeout(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		reuse    bool
+		accepted int
+	}{
+		// Connections not reused are closed when idle and reestablished.
+		{name: "not reused", reuse: false, accepted: 2},
+		{name: "reused", reuse: true, accepted: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			target, accepted := serveCountingConnections(t)
+
+			module := &config.Module{Name: "my_module", ReuseConnection: test.reuse}
+			e := NewExporter(config.Config{})
+			conn, err := e.connect(module, target, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.close()
+
+			handler := conn.handler.(*tcpClientHandler)
+			if test.reuse {
+				if handler.IdleTimeout != 0 {
+					t.Fatalf("expected no idle timeout of reused connections but got %v", handler.IdleTimeout)
+				}
+			} else {
+				handler.IdleTimeout = 10 * time.Millisecond
+			}
+
+			for i := 0; i < 2; i++ {
+				if _, err := conn.client.ReadHoldingRegisters(0, 1); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			if n := accepted(); n != test.accepted {
+				t.Fatalf("expected %v connections to be accepted but got %v", test.accepted, n)
+			}
+		})
+	}
+}
+
+// serveCountingConnections serves Modbus TCP connections responding to read
+// holding registers requests of a single register with the value 0x1234,
+// returning the address and a function returning the number of connections
+// accepted.
+func serveCountingConnections(t *testing.T) (string, func() int) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var (
+		mu       sync.Mutex
+		accepted int
+	)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			accepted++
+			mu.Unlock()
+
+			go func() {
+				defer conn.Close()
+
+				request := make([]byte, 12)
+				for {
+					if _, err := io.ReadFull(conn, request); err != nil {
+						return
+					}
+
+					response := []byte{request[0], request[1], 0, 0, 0, 5, request[6], request[7], 2, 0x12, 0x34}
+					if _, err := conn.Write(response); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String(), func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return accepted
+	}
+}
+
+// serveFixedTransactionID serves a single Modbus TCP connection responding to
+// read holding registers requests of a single register with the value 0x1234,
+// always echoing the given transaction ID.
+func serveFixedTransactionID(t *testing.T, transactionID uint16) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		request := make([]byte, 12)
+		for {
+			if _, err := io.ReadFull(conn, request); err != nil {
+				return
+			}
+
+			response := []byte{0, 0, 0, 0, 0, 5, request[6], request[7], 2, 0x12, 0x34}
+			binary.BigEndian.PutUint16(response, transactionID)
+			if _, err := conn.Write(response); err != nil {
+				return
+			}
+		}
+	}()
+
+	return l.Addr().String()
+}
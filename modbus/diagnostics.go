@@ -0,0 +1,161 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+// funcCodeDiagnostics is the Modbus function code 08 (diagnostics), which is
+// not implemented by the underlying modbus client.
+const funcCodeDiagnostics = 8
+
+// diagnosticCounter describes the Prometheus counter exposing the result of a
+// diagnostics sub-function.
+type diagnosticCounter struct {
+	subFunction uint16
+	name        string
+	help        string
+}
+
+var diagnosticCounters = map[config.DiagnosticCounter]diagnosticCounter{
+	config.DiagnosticBusMessageCount: {
+		0x0B, "modbus_bus_message_total",
+		"Number of messages the device detected on the bus.",
+	},
+	config.DiagnosticBusCommErrorCount: {
+		0x0C, "modbus_bus_comm_error_total",
+		"Number of CRC errors the device encountered.",
+	},
+	config.DiagnosticBusExceptionErrorCount: {
+		0x0D, "modbus_bus_exception_error_total",
+		"Number of exception responses the device returned.",
+	},
+	config.DiagnosticServerMessageCount: {
+		0x0E, "modbus_server_message_total",
+		"Number of messages addressed to the device.",
+	},
+	config.DiagnosticServerNoResponseCount: {
+		0x0F, "modbus_server_no_response_total",
+		"Number of messages addressed to the device it did not respond to.",
+	},
+	config.DiagnosticServerNAKCount: {
+		0x10, "modbus_server_nak_total",
+		"Number of negative acknowledge exception responses the device returned.",
+	},
+	config.DiagnosticServerBusyCount: {
+		0x11, "modbus_server_busy_total",
+		"Number of server device busy exception responses the device returned.",
+	},
+	config.DiagnosticBusCharacterOverrunCount: {
+		0x12, "modbus_bus_character_overrun_total",
+		"Number of messages the device could not handle due to a character overrun.",
+	},
+}
+
+// diagnosticFunc sends the given diagnostics sub-function returning the
+// counter value.
+type diagnosticFunc func(subFunction uint16) (uint16, error)
+
+// scrapeDiagnostics returns one counter metric per given diagnostics counter.
+// Counters the device answers with a Modbus exception, e.g. because it does
+// not support function code 08, are skipped.
+func scrapeDiagnostics(counters []config.DiagnosticCounter, f diagnosticFunc) ([]metric, error) {
+	metrics := []metric{}
+
+	for _, c := range counters {
+		d, ok := diagnosticCounters[c]
+		if !ok {
+			return []metric{}, fmt.Errorf("unknown diagnostics counter '%v'", c)
+		}
+
+		v, err := f(d.subFunction)
+		if err != nil {
+			var modbusErr *modbus.ModbusError
+			if errors.As(err, &modbusErr) {
+				continue
+			}
+			return []metric{}, fmt.Errorf("diagnostics counter '%v': %v", c, err)
+		}
+
+		metrics = append(metrics, metric{Name: d.name, Help: d.help, Value: float64(v), MetricType: config.MetricTypeCounter})
+	}
+
+	return metrics, nil
+}
+
+// readDiagnostic sends a diagnostics request with the given sub-function via
+// the given handler and returns the 16 bit data field of the response. Both
+// request and response consist of the 2 byte sub-function followed by a 2 byte
+// data field, which is zero in the request.
+func readDiagnostic(handler modbus.ClientHandler, subFunction uint16) (uint16, error) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint16(data, subFunction)
+
+	response, err := sendRequest(handler, &modbus.ProtocolDataUnit{
+		FunctionCode: funcCodeDiagnostics,
+		Data:         data,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(response.Data) != 4 {
+		return 0, &MalformedResponseError{funcCodeDiagnostics, 4, len(response.Data)}
+	}
+	if sf := binary.BigEndian.Uint16(response.Data); sf != subFunction {
+		return 0, fmt.Errorf("diagnostics response sub-function '%v' does not match request '%v'", sf, subFunction)
+	}
+
+	return binary.BigEndian.Uint16(response.Data[2:]), nil
+}
+
+// sendRequest sends the given request via the given handler, for function codes
+// the underlying modbus client does not implement. Exception responses are
+// returned as *modbus.ModbusError.
+func sendRequest(handler modbus.ClientHandler, request *modbus.ProtocolDataUnit) (*modbus.ProtocolDataUnit, error) {
+	aduRequest, err := handler.Encode(request)
+	if err != nil {
+		return nil, err
+	}
+	aduResponse, err := handler.Send(aduRequest)
+	if err != nil {
+		return nil, err
+	}
+	if err := handler.Verify(aduRequest, aduResponse); err != nil {
+		return nil, err
+	}
+	response, err := handler.Decode(aduResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.FunctionCode != request.FunctionCode {
+		if response.FunctionCode == request.FunctionCode|0x80 && len(response.Data) > 0 {
+			return nil, &modbus.ModbusError{
+				FunctionCode:  response.FunctionCode,
+				ExceptionCode: response.Data[0],
+			}
+		}
+		return nil, fmt.Errorf("unexpected function code '%v' in response to function code '%v'",
+			response.FunctionCode, request.FunctionCode)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeHandler implements modbus.ClientHandler answering each request with the
+// PDU returned by respond.
+type fakeHandler struct {
+	*modbus.TCPClientHandler
+	respond func(request *modbus.ProtocolDataUnit) *modbus.ProtocolDataUnit
+}
+
+func newFakeHandler(respond func(request *modbus.ProtocolDataUnit) *modbus.ProtocolDataUnit) *fakeHandler {
+	return &fakeHandler{modbus.NewTCPClientHandler(""), respond}
+}
+
+func (h *fakeHandler) Send(aduRequest []byte) ([]byte, error) {
+	request, err := h.Decode(aduRequest)
+	if err != nil {
+		return nil, err
+	}
+	response := h.respond(request)
+
+	// Reuse the MBAP header of the request, adjusting the length.
+	aduResponse := make([]byte, 7, 8+len(response.Data))
+	copy(aduResponse, aduRequest[:7])
+	binary.BigEndian.PutUint16(aduResponse[4:], uint16(2+len(response.Data)))
+	aduResponse = append(aduResponse, response.FunctionCode)
+	aduResponse = append(aduResponse, response.Data...)
+
+	return aduResponse, nil
+}
+
+func TestScrapeDiagnostics(t *testing.T) {
+	canned := map[uint16]uint16{
+		0x0B: 1000,
+		0x0C: 3,
+	}
+	f := func(subFunction uint16) (uint16, error) {
+		v, ok := canned[subFunction]
+		if !ok {
+			return 0, &modbus.ModbusError{FunctionCode: 0x88, ExceptionCode: modbus.ExceptionCodeIllegalFunction}
+		}
+		return v, nil
+	}
+
+	metrics, err := scrapeDiagnostics([]config.DiagnosticCounter{
+		config.DiagnosticBusMessageCount,
+		config.DiagnosticBusCommErrorCount,
+		// Not supported by the fake device, thus skipped.
+		config.DiagnosticServerBusyCount,
+	}, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	if _, err := registerMetrics(reg, "my_module", metrics, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := testutil.CollectAndCount(reg); c != 2 {
+		t.Fatalf("expected 2 metrics but got %v", c)
+	}
+
+	for name, expected := range map[string]float64{
+		"modbus_bus_message_total":    1000,
+		"modbus_bus_comm_error_total": 3,
+	} {
+		found := false
+		for _, m := range metrics {
+			if m.Name != name {
+				continue
+			}
+			found = true
+			if m.Value != expected {
+				t.Errorf("expected %v to be %v but got %v", name, expected, m.Value)
+			}
+			if m.MetricType != config.MetricTypeCounter {
+				t.Errorf("expected %v to be a counter but got %v", name, m.MetricType)
+			}
+		}
+		if !found {
+			t.Errorf("expected metric %v", name)
+		}
+	}
+}
+
+func TestScrapeDiagnosticsTransportError(t *testing.T) {
+	f := func(subFunction uint16) (uint16, error) {
+		return 0, fmt.Errorf("i/o timeout")
+	}
+
+	_, err := scrapeDiagnostics([]config.DiagnosticCounter{config.DiagnosticBusMessageCount}, f)
+	if err == nil {
+		t.Fatal("expected error but got nil")
+	}
+}
+
+func TestReadDiagnostic(t *testing.T) {
+	t.Run("returns counter", func(t *testing.T) {
+		h := newFakeHandler(func(request *modbus.ProtocolDataUnit) *modbus.ProtocolDataUnit {
+			data := make([]byte, 4)
+			copy(data, request.Data[:2])
+			binary.BigEndian.PutUint16(data[2:], 42)
+			return &modbus.ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: data}
+		})
+
+		v, err := readDiagnostic(h, 0x0C)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != 42 {
+			t.Fatalf("expected 42 but got %v", v)
+		}
+	})
+
+	t.Run("returns exception", func(t *testing.T) {
+		h := newFakeHandler(func(request *modbus.ProtocolDataUnit) *modbus.ProtocolDataUnit {
+			return &modbus.ProtocolDataUnit{
+				FunctionCode: request.FunctionCode | 0x80,
+				Data:         []byte{modbus.ExceptionCodeIllegalFunction},
+			}
+		})
+
+		_, err := readDiagnostic(h, 0x0C)
+		modbusErr, ok := err.(*modbus.ModbusError)
+		if !ok {
+			t.Fatalf("expected modbus error but got %v", err)
+		}
+		if modbusErr.ExceptionCode != modbus.ExceptionCodeIllegalFunction {
+			t.Fatalf("expected exception code %v but got %v", modbus.ExceptionCodeIllegalFunction, modbusErr.ExceptionCode)
+		}
+	})
+}
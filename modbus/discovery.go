@@ -0,0 +1,84 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/goburrow/modbus"
+)
+
+// maxUnitID is the highest unit ID assignable to a device on a Modbus bus.
+const maxUnitID = 247
+
+// DiscoverUnitIDs probes each unit ID from 1 to 247 on the given target, e.g.
+// a gateway, with the discovery read configured by the given module, one
+// after another. It returns the unit IDs responding, including those
+// responding with an exception other than the gateway exceptions reporting
+// that no device answered.
+func (e *Exporter) DiscoverUnitIDs(targetAddress string, moduleName string) ([]int, error) {
+	module := e.GetConfig().GetModule(moduleName)
+	if module == nil {
+		return nil, fmt.Errorf("failed to find '%v' in config", moduleName)
+	}
+	if module.Discovery == nil {
+		return nil, fmt.Errorf("module '%v' does not configure discovery", moduleName)
+	}
+
+	modFunction, modAddress, err := splitAddress(module.Discovery.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	release := e.acquireHostSlot(targetAddress)
+	defer release()
+
+	unitIDs := []int{}
+	for unitID := 1; unitID <= maxUnitID; unitID++ {
+		conn, err := e.connect(module, targetAddress, byte(unitID))
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = registerReadFunc(conn.client, modFunction)(uint16(modAddress), 1)
+		if closeErr := conn.close(); closeErr != nil {
+			return nil, closeErr
+		}
+
+		if respondedToProbe(err) {
+			unitIDs = append(unitIDs, unitID)
+		}
+	}
+
+	return unitIDs, nil
+}
+
+// respondedToProbe returns whether a device responded to a discovery read
+// failing with the given error, if any. A gateway reports unit IDs without a
+// device answering via the gateway exceptions, other exceptions are responses
+// of a device.
+func respondedToProbe(err error) bool {
+	if err == nil {
+		return true
+	}
+
+	var modbusErr *modbus.ModbusError
+	if !errors.As(err, &modbusErr) {
+		return false
+	}
+
+	return modbusErr.ExceptionCode != modbus.ExceptionCodeGatewayPathUnavailable &&
+		modbusErr.ExceptionCode != modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+func TestDiscoverUnitIDs(t *testing.T) {
+	module := config.Module{
+		Name:      "my_module",
+		Protocol:  config.ModbusProtocolTCPIP,
+		Discovery: &config.Discovery{Address: 300001},
+	}
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	connections := 0
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		connections++
+
+		c := newFakeClient()
+		c.fail = func(r fakeRequest) error {
+			switch subTarget {
+			case 3:
+				return nil
+			case 7:
+				// An exception is a response of a device as well.
+				return &modbus.ModbusError{FunctionCode: 0x83, ExceptionCode: modbus.ExceptionCodeIllegalDataAddress}
+			case 9:
+				return &modbus.ModbusError{FunctionCode: 0x83, ExceptionCode: modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond}
+			default:
+				return errors.New("timeout")
+			}
+		}
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	unitIDs, err := e.DiscoverUnitIDs("127.0.0.1:502", "my_module")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []int{3, 7}; !reflect.DeepEqual(unitIDs, expected) {
+		t.Fatalf("expected unit IDs %v but got %v", expected, unitIDs)
+	}
+	if connections != 247 {
+		t.Fatalf("expected 247 unit IDs to be probed but got %v", connections)
+	}
+
+	if _, err := e.DiscoverUnitIDs("127.0.0.1:502", "other"); err == nil {
+		t.Fatal("expected discovery of an unknown module to fail")
+	}
+}
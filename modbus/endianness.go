@@ -0,0 +1,79 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+// endiannessTypes holds the endianness types tried by SuggestEndianness.
+var endiannessTypes = []config.EndiannessType{
+	config.EndiannessBigEndian,
+	config.EndiannessLittleEndian,
+	config.EndiannessMixedEndian,
+	config.EndiannessYolo,
+}
+
+// SuggestEndianness returns the endianness types decoding the given register
+// data of the given numeric data type into the expected value within the
+// given tolerance, e.g. to find the endianness of a device given a known
+// reading while commissioning it.
+func SuggestEndianness(data []byte, dataType config.ModbusDataType, expected, tolerance float64) ([]config.EndiannessType, error) {
+	switch dataType {
+	case config.ModbusBool, config.ModbusString, config.ModbusRawHex, config.ModbusIPv4, config.ModbusMAC, config.ModbusFraction:
+		return nil, fmt.Errorf("endianness cannot be suggested for %v data type", dataType)
+	}
+
+	if len(data) != 2*dataType.RegisterCount() {
+		return nil, &InsufficientRegistersError{fmt.Sprintf("expected %v bytes for data type %v, got %v", 2*dataType.RegisterCount(), dataType, len(data))}
+	}
+
+	matches := []config.EndiannessType{}
+	for _, endianness := range endiannessTypes {
+		v, err := parseModbusData(config.MetricDef{DataType: dataType, Endianness: endianness}, data)
+		if err != nil {
+			return nil, err
+		}
+
+		if math.Abs(v-expected) <= tolerance {
+			matches = append(matches, endianness)
+		}
+	}
+
+	return matches, nil
+}
+
+// arrangeBigEndian rearranges the given registers, read with the bytes of each
+// register and the registers in the given orders, into big endian order in
+// the given destination of the same length, returning it.
+func arrangeBigEndian(dst, b []byte, byteOrder, wordOrder config.Order) []byte {
+	words := len(b) / 2
+	for i := 0; i < words; i++ {
+		src := i
+		if wordOrder == config.OrderLittle {
+			src = words - 1 - i
+		}
+
+		high, low := b[2*src], b[2*src+1]
+		if byteOrder == config.OrderLittle {
+			high, low = low, high
+		}
+		dst[2*i], dst[2*i+1] = high, low
+	}
+
+	return dst
+}
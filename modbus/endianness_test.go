@@ -0,0 +1,68 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+func TestSuggestEndianness(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		data      []byte
+		dataType  config.ModbusDataType
+		expected  float64
+		tolerance float64
+		suggested []config.EndiannessType
+	}{
+		{
+			name:      "word swap",
+			data:      []byte{0x00, 0x02, 0x00, 0x01},
+			dataType:  config.ModbusUInt32,
+			expected:  0x00010002,
+			suggested: []config.EndiannessType{config.EndiannessYolo},
+		},
+		{
+			// 123.456 as float32 is 0x42F6E979.
+			name:      "float within tolerance",
+			data:      []byte{0xE9, 0x79, 0x42, 0xF6},
+			dataType:  config.ModbusFloat32,
+			expected:  123.456,
+			tolerance: 0.001,
+			suggested: []config.EndiannessType{config.EndiannessYolo},
+		},
+		{
+			name:      "no match",
+			data:      []byte{0x00, 0x02, 0x00, 0x01},
+			dataType:  config.ModbusUInt32,
+			expected:  42,
+			suggested: []config.EndiannessType{},
+		},
+	} {
+		suggested, err := SuggestEndianness(test.data, test.dataType, test.expected, test.tolerance)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(suggested, test.suggested) {
+			t.Errorf("%v: expected %v but got %v", test.name, test.suggested, suggested)
+		}
+	}
+
+	if _, err := SuggestEndianness([]byte{0x00, 0x01}, config.ModbusUInt32, 1, 0); err == nil {
+		t.Fatal("expected error for insufficient data")
+	}
+}
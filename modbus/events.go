@@ -0,0 +1,106 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+// eventCounter counts the events written to a circular event buffer.
+type eventCounter struct {
+	pointer int
+	total   float64
+}
+
+// add adds the advance of the given write pointer over the last one modulo
+// the given buffer size to the total, returning the new total.
+func (c *eventCounter) add(pointer, size int) float64 {
+	c.total += float64(((pointer-c.pointer)%size + size) % size)
+	c.pointer = pointer
+
+	return c.total
+}
+
+// scrapeEventPointers reads the registers of the given event pointers,
+// returning a metric with the value of each pointer, replaced by the count of
+// events written by countEvents.
+func scrapeEventPointers(pointers []config.EventPointer, c modbus.Client) ([]metric, error) {
+	metrics := []metric{}
+
+	for _, p := range pointers {
+		modFunction, modAddress, err := splitAddress(p.Address)
+		if err != nil {
+			return []metric{}, err
+		}
+
+		f := registerReadFunc(c, modFunction)
+		if f == nil {
+			return []metric{}, fmt.Errorf("event pointer address '%v' is not a holding or input register address", p.Address)
+		}
+
+		data, err := f(uint16(modAddress), 1)
+		if err != nil {
+			return []metric{}, fmt.Errorf("event pointer '%v', address '%v': %v", p.Name, p.Address, err)
+		}
+		if len(data) < 2 {
+			return []metric{}, fmt.Errorf("event pointer '%v', address '%v': %v", p.Name, p.Address, &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(data))})
+		}
+
+		metrics = append(metrics, metric{
+			Name:            p.Name,
+			Help:            p.Help,
+			Labels:          copyLabels(p.Labels),
+			Value:           float64(binary.BigEndian.Uint16(data)),
+			MetricType:      config.MetricTypeCounter,
+			EventBufferSize: p.BufferSize,
+		})
+	}
+
+	return metrics, nil
+}
+
+// countEvents replaces the values of the event pointers read from the given
+// target with the count of events written since the first scrape.
+func (e *Exporter) countEvents(key connectionKey, metrics []metric) []metric {
+	e.seriesMu.Lock()
+	defer e.seriesMu.Unlock()
+
+	for i, m := range metrics {
+		if m.EventBufferSize == 0 {
+			continue
+		}
+
+		counters, ok := e.eventCounters[key]
+		if !ok {
+			counters = map[string]*eventCounter{}
+			e.eventCounters[key] = counters
+		}
+
+		// The first scrape only records the pointer.
+		id := seriesID(m)
+		c, ok := counters[id]
+		if !ok {
+			c = &eventCounter{pointer: int(m.Value)}
+			counters[id] = c
+		}
+
+		metrics[i].Value = c.add(int(m.Value), m.EventBufferSize)
+	}
+
+	return metrics
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+func TestEventCounterAdd(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		pointers []int
+		expected []float64
+	}{
+		{"advancing", []int{3, 5, 9}, []float64{0, 2, 6}},
+		{"unchanged", []int{7, 7}, []float64{0, 0}},
+		{"wraparound", []int{98, 99, 2}, []float64{0, 1, 4}},
+		{"wraparound to zero", []int{95, 0, 10}, []float64{0, 5, 15}},
+		{"full buffer", []int{10, 10, 9}, []float64{0, 0, 99}},
+	} {
+		c := &eventCounter{pointer: test.pointers[0]}
+		for i, p := range test.pointers {
+			if total := c.add(p, 100); total != test.expected[i] {
+				t.Errorf("%v: expected %v events after pointer %v but got %v", test.name, test.expected[i], p, total)
+			}
+		}
+	}
+}
+
+func TestCountEvents(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		EventPointers: []config.EventPointer{
+			{Name: "events_total", Help: "Events logged.", Address: 300010, BufferSize: 16},
+		},
+	}
+
+	c := newFakeClient()
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	for i, step := range []struct {
+		pointer  uint16
+		expected float64
+	}{
+		{12, 0},
+		{14, 2},
+		// The pointer wraps around after the last record.
+		{3, 7},
+		{3, 7},
+	} {
+		c.holdingRegisters[10] = step.pointer
+
+		reg, err := e.Scrape("localhost:502", 1, "my_module")
+		if err != nil {
+			t.Fatalf("step %v: %v", i, err)
+		}
+
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(families) != 1 {
+			t.Fatalf("step %v: expected 1 metric family but got %v", i, len(families))
+		}
+		if v := families[0].GetMetric()[0].GetCounter().GetValue(); v != step.expected {
+			t.Fatalf("step %v: expected %v but got %v", i, step.expected, v)
+		}
+	}
+}
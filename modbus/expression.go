@@ -0,0 +1,104 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+
+	"github.com/Knetic/govaluate"
+	"github.com/go-kit/log/level"
+)
+
+// evaluateExpressions replaces the values of the metrics read from the given
+// target configuring an expression with its result, remembering the values
+// read as the previous values of the next scrape. Series whose expressions
+// reference the previous value are dropped on their first scrape, as are
+// series whose expressions fail.
+func (e *Exporter) evaluateExpressions(key connectionKey, metrics []metric) []metric {
+	e.seriesMu.Lock()
+	defer e.seriesMu.Unlock()
+
+	evaluated := metrics[:0]
+	for _, m := range metrics {
+		if m.Expression == nil {
+			evaluated = append(evaluated, m)
+			continue
+		}
+
+		prevValues, ok := e.prevValues[key]
+		if !ok {
+			prevValues = map[string]float64{}
+			e.prevValues[key] = prevValues
+		}
+
+		id := seriesID(m)
+		prev, ok := prevValues[id]
+		prevValues[id] = m.Value
+
+		parameters := map[string]interface{}{"value": m.Value}
+		if ok {
+			parameters["prev"] = prev
+		} else if referencesPrev(m.Expression) {
+			continue
+		}
+
+		v, err := evaluateExpression(m.Expression, parameters)
+		if err != nil {
+			level.Warn(e.Logger).Log("msg", "failed to evaluate expression", "module", key.module,
+				"target", key.target, "sub_target", key.subTarget, "metric", m.Name, "err", err)
+			continue
+		}
+
+		m.Value = v
+		evaluated = append(evaluated, m)
+	}
+
+	return evaluated
+}
+
+// referencesPrev returns whether the given expression references the value of
+// the previous scrape.
+func referencesPrev(e *govaluate.EvaluableExpression) bool {
+	for _, v := range e.Vars() {
+		if v == "prev" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// evaluateExpression evaluates the given expression with the given parameters
+// into a value.
+func evaluateExpression(e *govaluate.EvaluableExpression, parameters map[string]interface{}) (value float64, err error) {
+	// Expressions failing unexpectedly fail the metric rather than the
+	// exporter.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("expression '%v' failed: %v", e, r)
+		}
+	}()
+
+	result, err := e.Evaluate(parameters)
+	if err != nil {
+		return 0, err
+	}
+
+	v, ok := result.(float64)
+	if !ok {
+		return 0, fmt.Errorf("expression '%v' resulted in %T instead of a number", e, result)
+	}
+
+	return v, nil
+}
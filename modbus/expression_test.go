@@ -0,0 +1,80 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEvaluateExpressions(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Metrics: []config.MetricDef{
+			{
+				Name:       "energy_delta_wh",
+				Help:       "energy since the previous scrape",
+				Address:    300001,
+				DataType:   config.ModbusUInt16,
+				MetricType: config.MetricTypeGauge,
+				Expression: "value - prev",
+			},
+			{
+				Name:       "energy_kwh",
+				Help:       "energy meter reading",
+				Address:    300001,
+				DataType:   config.ModbusUInt16,
+				MetricType: config.MetricTypeGauge,
+				Expression: "value / 1000",
+			},
+		},
+	}
+
+	c := newFakeClient()
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	scrape := func(value uint16, expected string) {
+		t.Helper()
+		c.holdingRegisters[1] = value
+		reg, err := e.Scrape("localhost:502", 1, "my_module")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "energy_delta_wh", "energy_kwh"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The delta is undefined on the first scrape, so it is not exported.
+	scrape(1500, `
+# HELP energy_kwh energy meter reading
+# TYPE energy_kwh gauge
+energy_kwh{module="my_module"} 1.5
+`)
+	scrape(1750, `
+# HELP energy_delta_wh energy since the previous scrape
+# TYPE energy_delta_wh gauge
+energy_delta_wh{module="my_module"} 250
+# HELP energy_kwh energy meter reading
+# TYPE energy_kwh gauge
+energy_kwh{module="my_module"} 1.75
+`)
+}
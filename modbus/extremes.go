@@ -0,0 +1,88 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"math"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+// extremes holds the minimum and maximum of the values of a series.
+type extremes struct {
+	min float64
+	max float64
+}
+
+// trackExtremes appends the minimum and maximum of the values read from the
+// given target so far as <name>_min and <name>_max gauges to each metric
+// tracking its extremes. NaN values, e.g. of failed reads, are ignored.
+func (e *Exporter) trackExtremes(key connectionKey, metrics []metric) []metric {
+	e.seriesMu.Lock()
+	defer e.seriesMu.Unlock()
+
+	tracked := make([]metric, 0, len(metrics))
+	for _, m := range metrics {
+		tracked = append(tracked, m)
+		if !m.TrackExtremes {
+			continue
+		}
+
+		seriesExtremes, ok := e.extremes[key]
+		if !ok {
+			seriesExtremes = map[string]*extremes{}
+			e.extremes[key] = seriesExtremes
+		}
+
+		id := seriesID(m)
+		x, ok := seriesExtremes[id]
+		if math.IsNaN(m.Value) {
+			if !ok {
+				continue
+			}
+		} else if !ok {
+			x = &extremes{min: m.Value, max: m.Value}
+			seriesExtremes[id] = x
+		} else {
+			x.min = math.Min(x.min, m.Value)
+			x.max = math.Max(x.max, m.Value)
+		}
+
+		for _, extreme := range []struct {
+			suffix string
+			value  float64
+		}{{"_min", x.min}, {"_max", x.max}} {
+			tracked = append(tracked, metric{
+				Name:       m.Name + extreme.suffix,
+				Help:       m.Help,
+				Labels:     copyLabels(m.Labels),
+				Value:      extreme.value,
+				MetricType: config.MetricTypeGauge,
+				Timestamp:  m.Timestamp,
+				Condition:  m.Condition,
+			})
+		}
+	}
+
+	return tracked
+}
+
+// ResetExtremes resets the tracked minima and maxima of all targets, the
+// next values read becoming the new extremes.
+func (e *Exporter) ResetExtremes() {
+	e.seriesMu.Lock()
+	defer e.seriesMu.Unlock()
+
+	e.extremes = map[connectionKey]map[string]*extremes{}
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTrackExtremes(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Metrics: []config.MetricDef{
+			{
+				Name:          "pressure",
+				Help:          "pressure in bar",
+				Address:       300001,
+				DataType:      config.ModbusUInt16,
+				MetricType:    config.MetricTypeGauge,
+				TrackExtremes: true,
+			},
+		},
+	}
+
+	c := newFakeClient()
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	scrape := func(values ...uint16) prometheus.Gatherer {
+		var reg prometheus.Gatherer
+		for _, v := range values {
+			c.holdingRegisters[1] = v
+
+			var err error
+			reg, err = e.Scrape("localhost:502", 1, "my_module")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return reg
+	}
+
+	expected := `
+# HELP pressure pressure in bar
+# TYPE pressure gauge
+pressure{module="my_module"} %v
+# HELP pressure_max pressure in bar
+# TYPE pressure_max gauge
+pressure_max{module="my_module"} %v
+# HELP pressure_min pressure in bar
+# TYPE pressure_min gauge
+pressure_min{module="my_module"} %v
+`
+
+	reg := scrape(5, 3, 8)
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(expected, 8, 8, 3))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next value read after a reset becomes the new extremes.
+	e.ResetExtremes()
+	reg = scrape(6)
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(expected, 6, 6, 6))); err != nil {
+		t.Fatal(err)
+	}
+}
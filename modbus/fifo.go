@@ -0,0 +1,110 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+// maxFIFOCount is the maximum number of values a FIFO queue can hold according
+// to the Modbus specification.
+const maxFIFOCount = 31
+
+// fifoFunc reads the FIFO queue at the given pointer address returning the
+// queued values.
+type fifoFunc func(address uint16) ([]uint16, error)
+
+// scrapeFIFOQueues returns a gauge with the number of queued values per given
+// FIFO queue and, if configured, one gauge per queued value.
+func scrapeFIFOQueues(queues []config.FIFOQueue, f fifoFunc) ([]metric, error) {
+	metrics := []metric{}
+
+	for _, q := range queues {
+		values, err := f(q.Address)
+		if err != nil {
+			return []metric{}, fmt.Errorf("fifo queue '%v', address '%v': %v", q.Name, q.Address, err)
+		}
+
+		metrics = append(metrics, metric{Name: q.Name, Help: q.Help, Labels: copyLabels(q.Labels), Value: float64(len(values)), MetricType: config.MetricTypeGauge})
+
+		if !q.ExportValues {
+			continue
+		}
+
+		help := fmt.Sprintf("Values of the FIFO queue %v by their index in the queue.", q.Name)
+		for i, v := range values {
+			labels := copyLabels(q.Labels)
+			labels["index"] = strconv.Itoa(i)
+			metrics = append(metrics, metric{Name: q.Name + "_value", Help: help, Labels: labels, Value: float64(v), MetricType: config.MetricTypeGauge})
+		}
+	}
+
+	return metrics, nil
+}
+
+// readFIFOQueue reads the FIFO queue at the given pointer address via the given
+// handler. The response consists of the 2 byte byte count, the 2 byte FIFO
+// count and the queued register values.
+//
+// The function is implemented here instead of using the one of the modbus
+// client, which miscalculates the expected byte count.
+func readFIFOQueue(handler modbus.ClientHandler, address uint16) ([]uint16, error) {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, address)
+
+	response, err := sendRequest(handler, &modbus.ProtocolDataUnit{
+		FunctionCode: modbus.FuncCodeReadFIFOQueue,
+		Data:         data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response.Data) < 4 {
+		return nil, fmt.Errorf("expected at least 4 bytes in fifo response, got %v", len(response.Data))
+	}
+	byteCount := int(binary.BigEndian.Uint16(response.Data))
+	if byteCount != len(response.Data)-2 {
+		return nil, &MalformedResponseError{modbus.FuncCodeReadFIFOQueue, 2 + byteCount, len(response.Data)}
+	}
+	count := int(binary.BigEndian.Uint16(response.Data[2:]))
+	if count > maxFIFOCount {
+		return nil, fmt.Errorf("fifo count '%v' is greater than the maximum of '%v'", count, maxFIFOCount)
+	}
+	if 2*count != len(response.Data)-4 {
+		return nil, &MalformedResponseError{modbus.FuncCodeReadFIFOQueue, 4 + 2*count, len(response.Data)}
+	}
+
+	values := make([]uint16, count)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(response.Data[4+2*i:])
+	}
+
+	return values, nil
+}
+
+// copyLabels returns a copy of the given labels which is never nil.
+func copyLabels(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		c[k] = v
+	}
+
+	return c
+}
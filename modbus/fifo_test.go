@@ -0,0 +1,118 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"strconv"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+func TestScrapeFIFOQueues(t *testing.T) {
+	queues := map[uint16][]uint16{
+		100: {7, 8, 9},
+		200: {},
+	}
+	f := func(address uint16) ([]uint16, error) {
+		return queues[address], nil
+	}
+
+	metrics, err := scrapeFIFOQueues([]config.FIFOQueue{
+		{Name: "events", Help: "Number of queued events.", Address: 100, ExportValues: true},
+		{Name: "alarms", Address: 200},
+	}, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(metrics) != 5 {
+		t.Fatalf("expected 5 metrics but got %v", len(metrics))
+	}
+
+	if metrics[0].Name != "events" || metrics[0].Value != 3 {
+		t.Fatalf("expected events queue count 3 but got %v %v", metrics[0].Name, metrics[0].Value)
+	}
+	for i, expected := range []float64{7, 8, 9} {
+		m := metrics[1+i]
+		if m.Name != "events_value" || m.Value != expected {
+			t.Fatalf("expected events_value %v but got %v %v", expected, m.Name, m.Value)
+		}
+		if m.Help != "Values of the FIFO queue events by their index in the queue." {
+			t.Fatalf("expected the help of the values but got %q", m.Help)
+		}
+		if m.Labels["index"] != strconv.Itoa(i) {
+			t.Fatalf("expected index label %v but got %v", i, m.Labels["index"])
+		}
+	}
+
+	if metrics[4].Name != "alarms" || metrics[4].Value != 0 {
+		t.Fatalf("expected empty alarms queue but got %v %v", metrics[4].Name, metrics[4].Value)
+	}
+}
+
+// fifoResponse returns a read FIFO queue response PDU holding the given values.
+func fifoResponse(values []uint16) *modbus.ProtocolDataUnit {
+	data := make([]byte, 4+2*len(values))
+	binary.BigEndian.PutUint16(data, uint16(2+2*len(values)))
+	binary.BigEndian.PutUint16(data[2:], uint16(len(values)))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(data[4+2*i:], v)
+	}
+
+	return &modbus.ProtocolDataUnit{FunctionCode: modbus.FuncCodeReadFIFOQueue, Data: data}
+}
+
+func TestReadFIFOQueue(t *testing.T) {
+	t.Run("returns queued values", func(t *testing.T) {
+		h := newFakeHandler(func(request *modbus.ProtocolDataUnit) *modbus.ProtocolDataUnit {
+			if address := binary.BigEndian.Uint16(request.Data); address != 1000 {
+				t.Errorf("expected pointer address 1000 but got %v", address)
+			}
+			return fifoResponse([]uint16{1, 2, 3, 4})
+		})
+
+		values, err := readFIFOQueue(h, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 4 || values[0] != 1 || values[3] != 4 {
+			t.Fatalf("expected values [1 2 3 4] but got %v", values)
+		}
+	})
+
+	t.Run("rejects more than 31 values", func(t *testing.T) {
+		h := newFakeHandler(func(request *modbus.ProtocolDataUnit) *modbus.ProtocolDataUnit {
+			return fifoResponse(make([]uint16, 32))
+		})
+
+		if _, err := readFIFOQueue(h, 1000); err == nil {
+			t.Fatal("expected error but got nil")
+		}
+	})
+
+	t.Run("rejects mismatching byte count", func(t *testing.T) {
+		h := newFakeHandler(func(request *modbus.ProtocolDataUnit) *modbus.ProtocolDataUnit {
+			response := fifoResponse([]uint16{1, 2})
+			binary.BigEndian.PutUint16(response.Data, 10)
+			return response
+		})
+
+		if _, err := readFIFOQueue(h, 1000); err == nil {
+			t.Fatal("expected error but got nil")
+		}
+	})
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+const (
+	// funcCodeReadFileRecord is the Modbus function code 20 (read file
+	// record), which is not implemented by the underlying modbus client.
+	funcCodeReadFileRecord = 20
+
+	// fileRecordReferenceType is the reference type every sub-request and
+	// sub-response of a file record read starts with.
+	fileRecordReferenceType = 6
+
+	// maxFileRecordByteCount is the maximum byte count of both the request
+	// and the response of a file record read.
+	maxFileRecordByteCount = 0xF5
+)
+
+// fileRecordFunc reads the given file records with a single request returning
+// the register data of each record in order.
+type fileRecordFunc func(records []config.FileRecord) ([][]byte, error)
+
+// scrapeFileRecords reads the given file records, combining as many records
+// into a single request as fit into both request and response, returning one
+// metric per field.
+func scrapeFileRecords(records []config.FileRecord, f fileRecordFunc) ([]metric, error) {
+	metrics := []metric{}
+
+	for _, batch := range batchFileRecords(records) {
+		data, err := f(batch)
+		if err != nil {
+			return []metric{}, fmt.Errorf("file %v, record %v: %v", batch[0].File, batch[0].Record, err)
+		}
+
+		for i, r := range batch {
+			fields, err := parseFields(r.Fields, data[i])
+			if err != nil {
+				return []metric{}, fmt.Errorf("file %v, record %v: %v", r.File, r.Record, err)
+			}
+			metrics = append(metrics, fields...)
+		}
+	}
+
+	return metrics, nil
+}
+
+// batchFileRecords splits the given file records into batches each read with a
+// single request. Every sub-request takes 7 bytes of the request, every
+// sub-response 2 bytes plus the record data of the response.
+func batchFileRecords(records []config.FileRecord) [][]config.FileRecord {
+	batches := [][]config.FileRecord{}
+
+	var batch []config.FileRecord
+	requestSize, responseSize := 0, 0
+	for _, r := range records {
+		rs := 2 + 2*r.Size()
+		if len(batch) > 0 && (requestSize+7 > maxFileRecordByteCount || responseSize+rs > maxFileRecordByteCount) {
+			batches = append(batches, batch)
+			batch, requestSize, responseSize = nil, 0, 0
+		}
+		batch = append(batch, r)
+		requestSize += 7
+		responseSize += rs
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+// readFileRecords reads the given file records via the given handler. The
+// request consists of the byte count followed by one sub-request per record of
+// the reference type, the 2 byte file number, the 2 byte record number and the
+// 2 byte record length. The response consists of the byte count followed by
+// one sub-response per record of its length in bytes, the reference type and
+// the record data.
+func readFileRecords(handler modbus.ClientHandler, records []config.FileRecord) ([][]byte, error) {
+	data := make([]byte, 1, 1+7*len(records))
+	data[0] = byte(7 * len(records))
+	for _, r := range records {
+		sub := make([]byte, 7)
+		sub[0] = fileRecordReferenceType
+		binary.BigEndian.PutUint16(sub[1:], r.File)
+		binary.BigEndian.PutUint16(sub[3:], r.Record)
+		binary.BigEndian.PutUint16(sub[5:], uint16(r.Size()))
+		data = append(data, sub...)
+	}
+
+	response, err := sendRequest(handler, &modbus.ProtocolDataUnit{
+		FunctionCode: funcCodeReadFileRecord,
+		Data:         data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response.Data) < 1 {
+		return nil, fmt.Errorf("expected at least 1 byte in file record response, got %v", len(response.Data))
+	}
+	byteCount := int(response.Data[0])
+	if byteCount != len(response.Data)-1 {
+		return nil, &MalformedResponseError{funcCodeReadFileRecord, 1 + byteCount, len(response.Data)}
+	}
+
+	values := make([][]byte, 0, len(records))
+	rest := response.Data[1:]
+	for _, r := range records {
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("file record response is missing the sub-response of file %v, record %v", r.File, r.Record)
+		}
+		length, referenceType := int(rest[0]), rest[1]
+		if referenceType != fileRecordReferenceType {
+			return nil, fmt.Errorf("unexpected reference type '%v' in file record sub-response", referenceType)
+		}
+		if length < 1 || length > len(rest)-1 {
+			return nil, fmt.Errorf("file record sub-response length '%v' exceeds the remaining %v bytes", length, len(rest)-1)
+		}
+		if length-1 != 2*r.Size() {
+			return nil, fmt.Errorf("expected %v bytes for file %v, record %v, got %v", 2*r.Size(), r.File, r.Record, length-1)
+		}
+
+		values = append(values, rest[2:1+length])
+		rest = rest[1+length:]
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("unexpected %v trailing bytes in file record response", len(rest))
+	}
+
+	return values, nil
+}
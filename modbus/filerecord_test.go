@@ -0,0 +1,123 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+func TestReadFileRecords(t *testing.T) {
+	records := []config.FileRecord{
+		{File: 4, Record: 1, Fields: []config.MetricDef{
+			{Name: "setpoint", DataType: config.ModbusInt16, MetricType: config.MetricTypeGauge},
+		}},
+		{File: 3, Record: 9, Fields: []config.MetricDef{
+			{Name: "serial", DataType: config.ModbusUInt32, MetricType: config.MetricTypeGauge},
+		}},
+	}
+
+	var request []byte
+	h := newFakeHandler(func(r *modbus.ProtocolDataUnit) *modbus.ProtocolDataUnit {
+		request = r.Data
+		return &modbus.ProtocolDataUnit{FunctionCode: r.FunctionCode, Data: []byte{
+			0x0A,
+			0x03, 0x06, 0xFF, 0x38,
+			0x05, 0x06, 0x00, 0x01, 0x00, 0x02,
+		}}
+	})
+
+	metrics, err := scrapeFileRecords(records, func(records []config.FileRecord) ([][]byte, error) {
+		return readFileRecords(h, records)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedRequest := []byte{
+		0x0E,
+		0x06, 0x00, 0x04, 0x00, 0x01, 0x00, 0x01,
+		0x06, 0x00, 0x03, 0x00, 0x09, 0x00, 0x02,
+	}
+	if !reflect.DeepEqual(request, expectedRequest) {
+		t.Fatalf("expected request %v but got %v", expectedRequest, request)
+	}
+
+	expected := []metric{
+		{Name: "setpoint", Value: -200, MetricType: config.MetricTypeGauge},
+		{Name: "serial", Value: 65538, MetricType: config.MetricTypeGauge},
+	}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Fatalf("expected %v but got %v", expected, metrics)
+	}
+}
+
+func TestReadFileRecordsInvalidResponse(t *testing.T) {
+	records := []config.FileRecord{
+		{File: 1, Record: 0, Fields: []config.MetricDef{
+			{Name: "setpoint", DataType: config.ModbusInt16, MetricType: config.MetricTypeGauge},
+		}},
+	}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"wrong byte count", []byte{0x05, 0x03, 0x06, 0x00, 0x01}},
+		{"wrong reference type", []byte{0x04, 0x03, 0x07, 0x00, 0x01}},
+		{"short record", []byte{0x03, 0x02, 0x06, 0x00}},
+		{"trailing bytes", []byte{0x05, 0x03, 0x06, 0x00, 0x01, 0x00}},
+	} {
+		h := newFakeHandler(func(r *modbus.ProtocolDataUnit) *modbus.ProtocolDataUnit {
+			return &modbus.ProtocolDataUnit{FunctionCode: r.FunctionCode, Data: test.data}
+		})
+
+		if _, err := readFileRecords(h, records); err == nil {
+			t.Errorf("%v: expected error but got nil", test.name)
+		}
+	}
+}
+
+func TestBatchFileRecords(t *testing.T) {
+	large := config.FileRecord{File: 1, Length: 100}
+	small := config.FileRecord{File: 1, Length: 1}
+
+	records := []config.FileRecord{large, small, large}
+	batches := batchFileRecords(records)
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Fatalf("expected batches of 2 and 1 records but got %v", batches)
+	}
+
+	// At most 35 sub-requests fit into a single request.
+	records = make([]config.FileRecord, 36)
+	for i := range records {
+		records[i] = small
+	}
+	batches = batchFileRecords(records)
+	if len(batches) != 2 || len(batches[0]) != 35 {
+		t.Fatalf("expected batches of 35 and 1 records but got %v batches", len(batches))
+	}
+	for _, b := range batches {
+		var size int
+		for _, r := range b {
+			size += 2 + 2*r.Size()
+		}
+		if size > maxFileRecordByteCount || 7*len(b) > maxFileRecordByteCount {
+			t.Fatalf("batch of %v records exceeds the maximum byte count", len(b))
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"errors"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+// defaultLastErrorsSize is the default of Exporter.LastErrorsSize.
+const defaultLastErrorsSize = 100
+
+// ScrapeError is a failed read of a metric. Only the reads of the metrics of
+// a module and of its selector cases are covered, not those of layouts, file
+// records, FIFO queues or of registers read alongside metrics, e.g. scale
+// factors, which fail the whole scrape instead.
+type ScrapeError struct {
+	Module    string              `json:"module"`
+	Target    string              `json:"target"`
+	SubTarget byte                `json:"subTarget"`
+	Metric    string              `json:"metric"`
+	Address   config.RegisterAddr `json:"address"`
+	// Class of the error, see classifyError.
+	Class     string    `json:"class"`
+	Error     string    `json:"error"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// errorRing holds the most recent errors up to its size.
+type errorRing struct {
+	errors []ScrapeError
+	// next is the index the next error is written to once the ring is full.
+	next int
+}
+
+// add adds the given error, replacing the oldest one if the ring holds the
+// given number of errors already.
+func (r *errorRing) add(size int, err ScrapeError) {
+	if len(r.errors) < size {
+		r.errors = append(r.errors, err)
+		return
+	}
+
+	r.errors[r.next] = err
+	r.next = (r.next + 1) % len(r.errors)
+}
+
+// list returns the errors of the ring, the most recent first.
+func (r *errorRing) list() []ScrapeError {
+	errs := make([]ScrapeError, 0, len(r.errors))
+	for i := len(r.errors) - 1; i >= 0; i-- {
+		errs = append(errs, r.errors[(r.next+i)%len(r.errors)])
+	}
+
+	return errs
+}
+
+// classifyError returns the class of the given error of the read of a metric.
+func classifyError(err error) string {
+	var modbusErr *modbus.ModbusError
+	var insufficientErr *InsufficientRegistersError
+	var fallbackErr *fallbackReadError
+
+	switch {
+	case errors.As(err, &modbusErr):
+		return "exception"
+	case isTimeout(err):
+		return "timeout"
+	case errors.As(err, &fallbackErr):
+		return "fallback_read"
+	case errors.As(err, &insufficientErr):
+		return "insufficient_registers"
+	case errors.Is(err, errAllZero):
+		return "all_zero"
+	case errors.Is(err, errZeroDenominator):
+		return "zero_denominator"
+	case errors.Is(err, errBadQuality):
+		return "bad_quality"
+	case errors.Is(err, errScaleFactorNotImplemented):
+		return "scale_factor_not_implemented"
+	default:
+		return "other"
+	}
+}
+
+// recordError records the given error of the read of the given metric of the
+// given target, keeping the most recent LastErrorsSize errors per module.
+func (e *Exporter) recordError(module, target string, subTarget byte, name string, address config.RegisterAddr, err error) {
+	if e.LastErrorsSize <= 0 {
+		return
+	}
+
+	e.lastErrorsMu.Lock()
+	defer e.lastErrorsMu.Unlock()
+
+	r, ok := e.lastErrors[module]
+	if !ok {
+		r = &errorRing{}
+		e.lastErrors[module] = r
+	}
+	r.add(e.LastErrorsSize, ScrapeError{
+		Module:    module,
+		Target:    target,
+		SubTarget: subTarget,
+		Metric:    name,
+		Address:   address,
+		Class:     classifyError(err),
+		Error:     err.Error(),
+		Timestamp: e.now(),
+	})
+}
+
+// LastErrors returns the most recent failed reads of metrics of the given
+// module, the most recent first.
+func (e *Exporter) LastErrors(module string) []ScrapeError {
+	e.lastErrorsMu.Lock()
+	defer e.lastErrorsMu.Unlock()
+
+	r, ok := e.lastErrors[module]
+	if !ok {
+		return []ScrapeError{}
+	}
+
+	return r.list()
+}
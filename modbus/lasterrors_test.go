@@ -0,0 +1,126 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+func TestErrorRing(t *testing.T) {
+	r := &errorRing{}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		r.add(3, ScrapeError{Metric: name})
+	}
+
+	names := []string{}
+	for _, err := range r.list() {
+		names = append(names, err.Metric)
+	}
+	if expected := []string{"e", "d", "c"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected the 3 most recent errors %v but got %v", expected, names)
+	}
+}
+
+func TestLastErrors(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Metrics: []config.MetricDef{
+			{
+				Name:       "my_metric",
+				Address:    300001,
+				DataType:   config.ModbusUInt16,
+				MetricType: config.MetricTypeGauge,
+				OnError:    config.OnErrorFail,
+			},
+		},
+	}
+
+	c := newFakeClient()
+	c.fail = func(r fakeRequest) error {
+		return &modbus.ModbusError{FunctionCode: r.function, ExceptionCode: modbus.ExceptionCodeIllegalDataAddress}
+	}
+
+	now := time.Unix(1000, 0)
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.now = func() time.Time { return now }
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	if _, err := e.Scrape("localhost:502", 1, "my_module"); err == nil {
+		t.Fatal("expected scrape to fail")
+	}
+
+	errs := e.LastErrors("my_module")
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error but got %v", errs)
+	}
+	expected := ScrapeError{
+		Module:    "my_module",
+		Target:    "localhost:502",
+		SubTarget: 1,
+		Metric:    "my_metric",
+		Address:   300001,
+		Class:     "exception",
+		Error:     errs[0].Error,
+		Timestamp: now,
+	}
+	if !reflect.DeepEqual(errs[0], expected) {
+		t.Fatalf("expected %+v but got %+v", expected, errs[0])
+	}
+
+	if errs := e.LastErrors("other_module"); len(errs) != 0 {
+		t.Fatalf("expected no errors of another module but got %v", errs)
+	}
+}
+
+func TestLastErrorsBadQuality(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Metrics: []config.MetricDef{
+			{
+				Name:       "flow_rate",
+				Address:    300001,
+				DataType:   config.ModbusUInt16,
+				MetricType: config.MetricTypeGauge,
+				Quality:    &config.Quality{Address: 300010},
+			},
+		},
+	}
+
+	c := newFakeClient()
+	c.holdingRegisters[1] = 42
+	c.holdingRegisters[10] = 0
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	if _, err := e.Scrape("localhost:502", 1, "my_module"); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := e.LastErrors("my_module")
+	if len(errs) != 1 || errs[0].Metric != "flow_rate" || errs[0].Class != "bad_quality" {
+		t.Fatalf("expected the bad quality of flow_rate to be recorded but got %+v", errs)
+	}
+}
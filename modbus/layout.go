@@ -0,0 +1,84 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+// scrapeLayouts reads each of the given layouts with a single request,
+// returning one metric per field.
+func scrapeLayouts(layouts []config.Layout, c modbus.Client) ([]metric, error) {
+	metrics := []metric{}
+
+	for _, l := range layouts {
+		modFunction, modAddress, err := splitAddress(l.Address)
+		if err != nil {
+			return []metric{}, err
+		}
+
+		f := registerReadFunc(c, modFunction)
+		if f == nil {
+			return []metric{}, fmt.Errorf("layout address '%v' is not a holding or input register address", l.Address)
+		}
+
+		data, err := f(uint16(modAddress), uint16(l.Size()))
+		if err != nil {
+			return []metric{}, fmt.Errorf("layout address '%v': %v", l.Address, err)
+		}
+
+		fields, err := parseLayout(l, data)
+		if err != nil {
+			return []metric{}, fmt.Errorf("layout address '%v': %v", l.Address, err)
+		}
+
+		metrics = append(metrics, fields...)
+	}
+
+	return metrics, nil
+}
+
+// parseLayout slices the given register data of a layout into its fields.
+func parseLayout(l config.Layout, data []byte) ([]metric, error) {
+	return parseFields(l.Fields, data)
+}
+
+// parseFields slices the given register data into the given fields stored back
+// to back.
+func parseFields(fields []config.MetricDef, data []byte) ([]metric, error) {
+	metrics := make([]metric, 0, len(fields))
+
+	offset := 0
+	for _, field := range fields {
+		size := 2 * field.RegisterCount()
+		if offset+size > len(data) {
+			return []metric{}, fmt.Errorf("field '%v': %v", field.Name, &InsufficientRegistersError{
+				fmt.Sprintf("expected %v bytes at offset %v, got %v bytes in total", size, offset, len(data)),
+			})
+		}
+
+		m, err := parseMetric(field, data[offset:offset+size])
+		if err != nil {
+			return []metric{}, fmt.Errorf("field '%v': %v", field.Name, err)
+		}
+		offset += size
+
+		metrics = append(metrics, m)
+	}
+
+	return metrics, nil
+}
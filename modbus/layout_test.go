@@ -0,0 +1,75 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+func TestScrapeLayouts(t *testing.T) {
+	layout := config.Layout{
+		Address: 300010,
+		Fields: []config.MetricDef{
+			{Name: "status", DataType: config.ModbusInt16, MetricType: config.MetricTypeGauge},
+			{Name: "temperature", DataType: config.ModbusFloat32, MetricType: config.MetricTypeGauge},
+			{Name: "starts_total", DataType: config.ModbusUInt16, MetricType: config.MetricTypeCounter},
+		},
+	}
+
+	c := newFakeClient()
+	c.holdingRegisters[10] = uint16(0xFFFE) // -2
+	temperature := math.Float32bits(21.5)
+	c.holdingRegisters[11] = uint16(temperature >> 16)
+	c.holdingRegisters[12] = uint16(temperature)
+	c.holdingRegisters[13] = 42
+
+	metrics, err := scrapeLayouts([]config.Layout{layout}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []metric{
+		{Name: "status", Value: -2, MetricType: config.MetricTypeGauge},
+		{Name: "temperature", Value: 21.5, MetricType: config.MetricTypeGauge},
+		{Name: "starts_total", Value: 42, MetricType: config.MetricTypeCounter},
+	}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Fatalf("expected %v but got %v", expected, metrics)
+	}
+
+	// The whole layout is read with a single request.
+	expectedRequests := []fakeRequest{{modbus.FuncCodeReadHoldingRegisters, 10, 4}}
+	if r := c.recorded(); !reflect.DeepEqual(r, expectedRequests) {
+		t.Fatalf("expected requests %v but got %v", expectedRequests, r)
+	}
+}
+
+func TestParseLayoutInsufficientData(t *testing.T) {
+	layout := config.Layout{
+		Address: 300010,
+		Fields: []config.MetricDef{
+			{Name: "status", DataType: config.ModbusInt16, MetricType: config.MetricTypeGauge},
+			{Name: "temperature", DataType: config.ModbusFloat32, MetricType: config.MetricTypeGauge},
+		},
+	}
+
+	if _, err := parseLayout(layout, make([]byte, 4)); err == nil {
+		t.Fatal("expected error but got nil")
+	}
+}
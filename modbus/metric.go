@@ -14,7 +14,11 @@
 package modbus
 
 import (
+	"time"
+
+	"github.com/Knetic/govaluate"
 	"github.com/RichiH/modbus_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type metric struct {
@@ -23,4 +27,91 @@ type metric struct {
 	Labels     map[string]string
 	Value      float64
 	MetricType config.MetricType
+
+	// Timestamp of the sample, if provided by the device.
+	Timestamp time.Time
+
+	// Accumulate the increases of the value across scrapes, see
+	// config.MetricDef.Accumulate.
+	Accumulate bool
+	// CountChanges counts the changes of the value between scrapes, see
+	// config.MetricDef.CountChanges.
+	CountChanges bool
+	// TrackExtremes exports the minimum and maximum of the values read, see
+	// config.MetricDef.TrackExtremes.
+	TrackExtremes bool
+	// EventBufferSize is the size of the circular event buffer whose write
+	// pointer the value is, exported as the count of events written, see
+	// config.EventPointer.
+	EventBufferSize int
+
+	// Export the last exported value unless the value changed by more than
+	// the epsilon, see config.MetricDef.ChangeEpsilon.
+	ChangeEpsilon *float64
+
+	// Expression computing the exported value from the value read and the
+	// one read on the previous scrape, see config.MetricDef.Expression.
+	Expression *govaluate.EvaluableExpression
+
+	// Export the metric only if the condition holds, see
+	// config.MetricDef.Condition.
+	Condition *config.Condition
+
+	// PrecisionLoss is set if the integer value read exceeds the precision of
+	// float64.
+	PrecisionLoss bool
+}
+
+// timestampedCollector is a prometheus.Collector exposing the samples of a
+// metric family with their timestamps.
+type timestampedCollector struct {
+	desc       *prometheus.Desc
+	valueType  prometheus.ValueType
+	labelNames []string
+	// samples by label signature, a later sample replacing an earlier one
+	// with the same labels.
+	samples map[string]prometheus.Metric
+}
+
+func newTimestampedCollector(name, help string, metricType config.MetricType, labelNames []string) *timestampedCollector {
+	valueType := prometheus.GaugeValue
+	if metricType == config.MetricTypeCounter {
+		valueType = prometheus.CounterValue
+	}
+
+	return &timestampedCollector{
+		desc:       prometheus.NewDesc(name, help, labelNames, nil),
+		valueType:  valueType,
+		labelNames: labelNames,
+		samples:    map[string]prometheus.Metric{},
+	}
+}
+
+// add adds the given metric as a sample with its timestamp.
+func (c *timestampedCollector) add(m metric) error {
+	labelValues := make([]string, 0, len(c.labelNames))
+	for _, n := range c.labelNames {
+		labelValues = append(labelValues, m.Labels[n])
+	}
+
+	sample, err := prometheus.NewConstMetric(c.desc, c.valueType, m.Value, labelValues...)
+	if err != nil {
+		return err
+	}
+
+	c.samples[labelsSignature(m.Labels)] = prometheus.NewMetricWithTimestamp(m.Timestamp, sample)
+
+	return nil
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *timestampedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *timestampedCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, sample := range c.samples {
+		ch <- sample
+	}
 }
@@ -15,254 +15,1507 @@ package modbus
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
+	"math/bits"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/Knetic/govaluate"
 	"github.com/RichiH/modbus_exporter/config"
 	"github.com/goburrow/modbus"
 )
 
 // Exporter represents a Prometheus exporter converting modbus information
 // retrieved from remote targets via TCP as Prometheus style metrics.
+//
+// The Exporter itself is a prometheus.Collector exposing metrics about the
+// scrapes it performed, to be registered with the exporter's own registry.
 type Exporter struct {
-	Config config.Config
+	// Config is the configuration of the exporter, replaced by ReloadConfig.
+	// Read it via GetConfig once the exporter is in use.
+	Config   config.Config
+	configMu sync.RWMutex
+
+	// MaxConnectionsPerHost limits the number of concurrent connections to
+	// the targets of a host, regardless of port and sub-target. Further
+	// scrapes wait for a connection to be released. 0 means unlimited.
+	MaxConnectionsPerHost int
+
+	// ScrapeWorkers is the number of workers running scrapes, bounding the
+	// number of concurrent scrapes. Further scrapes wait in a queue of
+	// ScrapeQueueSize scrapes, scrapes finding it full are handled as per
+	// ScrapeQueueOverflow. 0 runs every scrape directly.
+	ScrapeWorkers       int
+	ScrapeQueueSize     int
+	ScrapeQueueOverflow ScrapeQueueOverflow
+
+	// LastErrorsSize is the number of the most recent failed reads of
+	// metrics kept per module, see LastErrors. 0 keeps none.
+	LastErrorsSize int
+
+	// Logger logs noteworthy events of scrapes, e.g. truncated scrapes.
+	Logger log.Logger
+
+	// now returns the current time, overridden in tests.
+	now func() time.Time
+
+	// connect establishes a new connection to a target, overridden in tests.
+	connect func(module *config.Module, target string, subTarget byte) (*connection, error)
+
+	// newTicker returns the channel ticking polls of a target every given
+	// interval and a function stopping it, overridden in tests.
+	newTicker func(d time.Duration) (<-chan time.Time, func())
+
+	lastErrorsMu sync.Mutex
+	// lastErrors holds the most recent failed reads of metrics by module.
+	lastErrors map[string]*errorRing
+
+	polledMu sync.Mutex
+	// polled holds the metrics of the last successful poll of polled targets.
+	polled map[connectionKey]prometheus.Gatherer
+
+	connectionsMu sync.Mutex
+	// connections holds idle connections of modules reusing them.
+	connections map[connectionKey]*connection
+	// hostSlots holds a semaphore per host limiting concurrent connections.
+	hostSlots map[string]chan struct{}
+	// dropped holds the targets of modules reusing connections whose last
+	// connection was closed after a failed scrape.
+	dropped map[connectionKey]bool
+
+	breakersMu sync.Mutex
+	// breakers holds the circuit breakers of targets of modules configuring
+	// one.
+	breakers map[connectionKey]*breaker
+
+	targetsMu sync.Mutex
+	// targets holds the targets scraped so far.
+	targets map[connectionKey]bool
+
+	seriesMu sync.Mutex
+	// series holds the last successfully read series of targets of modules
+	// configuring a series TTL.
+	series map[connectionKey]map[string]*retainedSeries
+	// accumulators holds the state of accumulated series of targets.
+	accumulators map[connectionKey]map[string]*accumulator
+	// eventCounters holds the state of the event pointers of targets.
+	eventCounters map[connectionKey]map[string]*eventCounter
+	// lastValues holds the last values of series of targets whose changes
+	// are counted.
+	lastValues map[connectionKey]map[string]float64
+	// extremes holds the minima and maxima of series of targets whose
+	// extremes are tracked.
+	extremes map[connectionKey]map[string]*extremes
+	// prevValues holds the values read on the previous scrape of series
+	// of targets whose expressions reference them.
+	prevValues map[connectionKey]map[string]float64
+	// exported holds the last exported values of series of targets exported
+	// on change only.
+	exported map[connectionKey]map[string]float64
+
+	startScrapeWorkers sync.Once
+	// scrapeTasks queues the scrapes waiting for a scrape worker.
+	scrapeTasks chan func()
+
+	scrapeCacheMu sync.Mutex
+	// scrapeCache holds the in-flight and recent scrapes of targets of
+	// modules caching scrape results.
+	scrapeCache map[scrapeCacheKey]*cachedResult
+
+	exceptionsMu sync.Mutex
+	// exceptions holds the metrics of targets whose reads failed with a
+	// Modbus exception before, exposed in the last exception code gauge.
+	exceptions map[exceptionKey]bool
+
+	lastScrapeSuccess       *prometheus.GaugeVec
+	breakerState            *prometheus.GaugeVec
+	droppedSeries           *prometheus.CounterVec
+	scrapeTruncated         *prometheus.GaugeVec
+	metricsParsed           *prometheus.GaugeVec
+	metricsFailed           *prometheus.GaugeVec
+	requestDuration         *prometheus.HistogramVec
+	transactionIDMismatches *prometheus.CounterVec
+	malformedResponses      *prometheus.CounterVec
+	registersRead           *prometheus.CounterVec
+	precisionLoss           *prometheus.CounterVec
+	lastExceptionCode       *prometheus.GaugeVec
+	valueChanges            *prometheus.CounterVec
+	reconnects              *prometheus.CounterVec
+	connectionBytes         *prometheus.CounterVec
+	scrapeWorkers           prometheus.Gauge
+	scrapeWorkersBusy       prometheus.Gauge
+	scrapeQueueDepth        prometheus.Gauge
+	scrapesRejected         prometheus.Counter
+	lastReloadSuccess       prometheus.Gauge
+	lastReloadTimestamp     prometheus.Gauge
+	moduleInfo              *prometheus.Desc
+	configuredTargets       *prometheus.Desc
+	recommendedMinInterval  *prometheus.Desc
 }
 
 // NewExporter returns a new modbus exporter.
 func NewExporter(config config.Config) *Exporter {
-	return &Exporter{config}
+	e := &Exporter{
+		Config:         config,
+		Logger:         log.NewNopLogger(),
+		now:            time.Now,
+		connections:    map[connectionKey]*connection{},
+		hostSlots:      map[string]chan struct{}{},
+		dropped:        map[connectionKey]bool{},
+		breakers:       map[connectionKey]*breaker{},
+		targets:        map[connectionKey]bool{},
+		series:         map[connectionKey]map[string]*retainedSeries{},
+		accumulators:   map[connectionKey]map[string]*accumulator{},
+		eventCounters:  map[connectionKey]map[string]*eventCounter{},
+		lastValues:     map[connectionKey]map[string]float64{},
+		extremes:       map[connectionKey]map[string]*extremes{},
+		exported:       map[connectionKey]map[string]float64{},
+		prevValues:     map[connectionKey]map[string]float64{},
+		exceptions:     map[exceptionKey]bool{},
+		scrapeCache:    map[scrapeCacheKey]*cachedResult{},
+		polled:         map[connectionKey]prometheus.Gatherer{},
+		lastErrors:     map[string]*errorRing{},
+		LastErrorsSize: defaultLastErrorsSize,
+		newTicker:      newTicker,
+		scrapeWorkers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "modbus_exporter_scrape_workers",
+			Help: "Number of workers running scrapes, 0 if scrapes are run directly.",
+		}),
+		scrapeWorkersBusy: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "modbus_exporter_scrape_workers_busy",
+			Help: "Number of workers currently running a scrape.",
+		}),
+		scrapeQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "modbus_exporter_scrape_queue_depth",
+			Help: "Number of scrapes waiting for a worker.",
+		}),
+		scrapesRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "modbus_exporter_scrapes_rejected_total",
+			Help: "Number of scrapes rejected as all workers were busy and the scrape queue was full.",
+		}),
+		lastReloadSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "modbus_exporter_last_reload_success",
+			Help: "Whether the last reload of the configuration succeeded (1) or not (0).",
+		}),
+		lastReloadTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "modbus_exporter_last_reload_timestamp_seconds",
+			Help: "Unix timestamp of the last successful load of the configuration.",
+		}),
+		lastScrapeSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "modbus_last_scrape_success_timestamp_seconds",
+			Help: "Unix timestamp of the last fully successful scrape of a target.",
+		}, []string{"module", "target", "sub_target"}),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "modbus_circuit_breaker_state",
+			Help: "State of the circuit breaker of a target (0 = closed, 1 = open, 2 = half-open).",
+		}, []string{"module", "target", "sub_target"}),
+		droppedSeries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "modbus_dropped_series_total",
+			Help: "Number of series dropped for exceeding the maximum number of series per metric.",
+		}, []string{"module", "target", "sub_target"}),
+		scrapeTruncated: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "modbus_scrape_truncated",
+			Help: "Whether the last scrape of a target exceeded the maximum number of metrics per scrape and was truncated (1) or not (0).",
+		}, []string{"module", "target", "sub_target"}),
+		metricsParsed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "modbus_metrics_parsed",
+			Help: "Number of metrics of a module, including those of selector cases, read and parsed successfully by the last scrape of a target. Layouts, file records and FIFO queues are not counted.",
+		}, []string{"module", "target", "sub_target"}),
+		metricsFailed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "modbus_metrics_failed",
+			Help: "Number of metrics of a module, including those of selector cases, whose read or parsing failed or whose value was of bad quality in the last scrape of a target, whether dropped, exported as NaN or failing the scrape. Layouts, file records and FIFO queues are not counted.",
+		}, []string{"module", "target", "sub_target"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "modbus_request_duration_seconds",
+			Help:    "Duration of the Modbus requests sent to a target by function code.",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"module", "target", "function_code"}),
+		transactionIDMismatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "modbus_transaction_id_mismatches_total",
+			Help: "Number of Modbus TCP responses whose transaction ID did not match the request's.",
+		}, []string{"module", "target"}),
+		malformedResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "modbus_malformed_response_total",
+			Help: "Number of responses to read requests whose size did not match the requested quantity or their byte count.",
+		}, []string{"module", "target"}),
+		registersRead: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "modbus_registers_read_total",
+			Help: "Number of holding and input registers read from a target, counting the registers of coalesced reads rather than of the metrics read.",
+		}, []string{"module", "target"}),
+		precisionLoss: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "modbus_precision_loss_total",
+			Help: "Number of 64 bit integer values read whose magnitude exceeded 2^53, beyond which they cannot be exported exactly as float64.",
+		}, []string{"module", "target", "metric"}),
+		valueChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "modbus_value_changes_total",
+			Help: "Number of changes of the value of a metric counting its changes between scrapes.",
+		}, []string{"module", "target", "metric"}),
+		lastExceptionCode: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "modbus_last_exception_code",
+			Help: "Modbus exception code of the last read of a metric, 0 if it succeeded. Only exposed for metrics whose reads failed with an exception before.",
+		}, []string{"module", "target", "metric"}),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "modbus_connection_reconnects_total",
+			Help: "Number of connections re-established to a target of a module reusing connections after the previous one was closed due to a failed scrape.",
+		}, []string{"module", "target"}),
+		connectionBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "modbus_connection_bytes_total",
+			Help: "Number of bytes of Modbus frames written to and read from a target by direction, if enabled by the module.",
+		}, []string{"module", "target", "direction"}),
+		moduleInfo: prometheus.NewDesc(
+			"modbus_exporter_module_info",
+			"Modules of the loaded configuration, with the value 1.",
+			[]string{"module"}, nil,
+		),
+		recommendedMinInterval: prometheus.NewDesc(
+			"modbus_recommended_min_interval_seconds",
+			"Minimum interval to scrape targets of modules pacing reads to a scan cycle at, i.e. the time the planned reads of the metrics and layouts of a scrape take up, not counting further requests. Scraping more frequently yields no fresh data.",
+			[]string{"module"}, nil,
+		),
+		configuredTargets: prometheus.NewDesc(
+			"modbus_exporter_configured_targets",
+			"Number of distinct targets, i.e. combinations of module, target and sub-target, scraped via the modules of the loaded configuration. Targets are configured in Prometheus, thus only known once scraped.",
+			nil, nil,
+		),
+	}
+	e.connect = e.connectTCP
+
+	// The configuration given was loaded successfully.
+	e.lastReloadSuccess.Set(1)
+	e.lastReloadTimestamp.Set(float64(e.now().UnixNano()) / 1e9)
+
+	return e
+}
+
+// Describe implements the prometheus.Collector interface.
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	e.lastScrapeSuccess.Describe(ch)
+	e.breakerState.Describe(ch)
+	e.droppedSeries.Describe(ch)
+	e.scrapeTruncated.Describe(ch)
+	e.metricsParsed.Describe(ch)
+	e.metricsFailed.Describe(ch)
+	e.requestDuration.Describe(ch)
+	e.transactionIDMismatches.Describe(ch)
+	e.malformedResponses.Describe(ch)
+	e.registersRead.Describe(ch)
+	e.precisionLoss.Describe(ch)
+	e.lastExceptionCode.Describe(ch)
+	e.valueChanges.Describe(ch)
+	e.reconnects.Describe(ch)
+	e.connectionBytes.Describe(ch)
+	e.scrapeWorkers.Describe(ch)
+	e.scrapeWorkersBusy.Describe(ch)
+	e.scrapeQueueDepth.Describe(ch)
+	e.scrapesRejected.Describe(ch)
+	e.lastReloadSuccess.Describe(ch)
+	e.lastReloadTimestamp.Describe(ch)
+	ch <- e.moduleInfo
+	ch <- e.configuredTargets
+	ch <- e.recommendedMinInterval
+}
+
+// Collect implements the prometheus.Collector interface.
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.lastScrapeSuccess.Collect(ch)
+	e.breakerState.Collect(ch)
+	e.droppedSeries.Collect(ch)
+	e.scrapeTruncated.Collect(ch)
+	e.metricsParsed.Collect(ch)
+	e.metricsFailed.Collect(ch)
+	e.requestDuration.Collect(ch)
+	e.transactionIDMismatches.Collect(ch)
+	e.malformedResponses.Collect(ch)
+	e.registersRead.Collect(ch)
+	e.precisionLoss.Collect(ch)
+	e.lastExceptionCode.Collect(ch)
+	e.valueChanges.Collect(ch)
+	e.reconnects.Collect(ch)
+	e.connectionBytes.Collect(ch)
+	e.scrapeWorkers.Collect(ch)
+	e.scrapeWorkersBusy.Collect(ch)
+	e.scrapeQueueDepth.Collect(ch)
+	e.scrapesRejected.Collect(ch)
+	e.lastReloadSuccess.Collect(ch)
+	e.lastReloadTimestamp.Collect(ch)
+
+	c := e.GetConfig()
+	for _, m := range c.Modules {
+		ch <- prometheus.MustNewConstMetric(e.moduleInfo, prometheus.GaugeValue, 1, m.Name)
+
+		if interval, ok := e.recommendedInterval(m.Name); ok {
+			ch <- prometheus.MustNewConstMetric(e.recommendedMinInterval, prometheus.GaugeValue, interval.Seconds(), m.Name)
+		}
+	}
+
+	e.targetsMu.Lock()
+	targets := 0
+	for key := range e.targets {
+		if c.HasModule(key.module) {
+			targets++
+		}
+	}
+	e.targetsMu.Unlock()
+	ch <- prometheus.MustNewConstMetric(e.configuredTargets, prometheus.GaugeValue, float64(targets))
 }
 
-// GetConfig loads the config file
+// GetConfig returns the current configuration of the exporter.
 func (e *Exporter) GetConfig() *config.Config {
-	return &e.Config
+	e.configMu.RLock()
+	defer e.configMu.RUnlock()
+
+	c := e.Config
+	return &c
 }
 
 // Scrape scrapes the given target via TCP based on the configuration of the
 // specified module returning a Prometheus gatherer with the resulting metrics.
 func (e *Exporter) Scrape(targetAddress string, subTarget byte, moduleName string) (prometheus.Gatherer, error) {
-	reg := prometheus.NewRegistry()
+	key := scrapeCacheKey{moduleName, targetAddress, strconv.Itoa(int(subTarget))}
+	return e.cachedScrape(key, func() (prometheus.Gatherer, error) {
+		return e.runScrape(func() (prometheus.Gatherer, error) {
+			reg := prometheus.NewRegistry()
+			if err := e.scrape(reg, targetAddress, subTarget, moduleName); err != nil {
+				return nil, err
+			}
+
+			return reg, nil
+		})
+	})
+}
 
-	module := e.Config.GetModule(moduleName)
+// scrape scrapes the given target via the given module, registering the
+// metrics with the given registerer.
+func (e *Exporter) scrape(reg prometheus.Registerer, targetAddress string, subTarget byte, moduleName string) error {
+	module := e.GetConfig().GetModule(moduleName)
 	if module == nil {
-		return nil, fmt.Errorf("failed to find '%v' in config", moduleName)
+		return fmt.Errorf("failed to find '%v' in config", moduleName)
+	}
+
+	key := connectionKey{module.Name, targetAddress, subTarget}
+
+	e.targetsMu.Lock()
+	e.targets[key] = true
+	e.targetsMu.Unlock()
+
+	if err := e.allowScrape(module, key); err != nil {
+		return err
+	}
+
+	metrics, err := e.scrapeTarget(module, targetAddress, subTarget)
+	e.recordScrape(module, key, err)
+	if err == nil {
+		e.countPrecisionLoss(module.Name, targetAddress, metrics)
+		metrics = e.evaluateExpressions(key, metrics)
+		e.countChanges(key, metrics)
+		metrics = e.accumulate(key, metrics)
+		metrics = e.countEvents(key, metrics)
+		metrics = e.trackExtremes(key, metrics)
+		metrics = e.exportOnChange(key, metrics)
+	}
+	metrics = e.retainSeries(module, key, metrics, err)
+	if err != nil {
+		return err
+	}
+	metrics = relabel(module.RelabelConfigs, metrics)
+
+	truncated := 0.0
+	if module.MaxMetricsPerScrape > 0 && len(metrics) > module.MaxMetricsPerScrape {
+		level.Warn(e.Logger).Log("msg", "truncating scrape exceeding the maximum number of metrics per scrape",
+			"module", moduleName, "target", targetAddress, "sub_target", subTarget,
+			"metrics", len(metrics), "max", module.MaxMetricsPerScrape)
+		metrics = metrics[:module.MaxMetricsPerScrape]
+		truncated = 1
+	}
+	e.scrapeTruncated.WithLabelValues(moduleName, targetAddress, strconv.Itoa(int(subTarget))).Set(truncated)
+
+	dropped, err := registerMetrics(reg, moduleName, metrics, module.MaxSeriesPerMetric)
+	if dropped > 0 {
+		e.droppedSeries.WithLabelValues(moduleName, targetAddress, strconv.Itoa(int(subTarget))).Add(float64(dropped))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to register metrics for module %v: %v", moduleName, err.Error())
+	}
+
+	e.lastScrapeSuccess.WithLabelValues(moduleName, targetAddress, strconv.Itoa(int(subTarget))).
+		Set(float64(e.now().UnixNano()) / 1e9)
+
+	return nil
+}
+
+// scrapeTarget retrieves the metrics of the given module from the given target.
+func (e *Exporter) scrapeTarget(module *config.Module, targetAddress string, subTarget byte) ([]metric, error) {
+	release := e.acquireHostSlot(targetAddress)
+	defer release()
+
+	conn, err := e.acquireConnection(module, targetAddress, subTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, failed := 0, 0
+	metrics, err := scrapeModule(module, conn, func(name string, address config.RegisterAddr, err error) {
+		if err != nil {
+			failed++
+			e.recordError(module.Name, targetAddress, subTarget, name, address, err)
+		} else {
+			parsed++
+		}
+		e.observeException(module.Name, targetAddress, name, err)
+	})
+	e.releaseConnection(module, targetAddress, subTarget, conn, err)
+
+	e.metricsParsed.WithLabelValues(module.Name, targetAddress, strconv.Itoa(int(subTarget))).Set(float64(parsed))
+	e.metricsFailed.WithLabelValues(module.Name, targetAddress, strconv.Itoa(int(subTarget))).Set(float64(failed))
+
+	return metrics, err
+}
+
+// scrapeModule retrieves the metrics of the given module via the given
+// connection, performing the module's pre-scrape writes first if they were not
+// yet performed on the connection. The outcome of the read of each metric is
+// passed to the given observer.
+func scrapeModule(module *config.Module, conn *connection, observe readObserver) ([]metric, error) {
+	if !conn.prepared {
+		if err := writeRegisters(module.PreScrapeWrites, conn.client); err != nil {
+			return nil, fmt.Errorf("failed to perform pre-scrape writes for module '%v': %v", module.Name, err.Error())
+		}
+		conn.prepared = true
+	}
+
+	client, err := newTimeoutClient(conn.client, module.Metrics, conn.setTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan read timeouts for module '%v': %v", module.Name, err.Error())
+	}
+	if module.CoalesceReads {
+		c, err := newCoalescingClient(client, module.Metrics, module.CoalesceMaxGap, module.MaxRegistersPerRead, module.BlockReadFallback)
+		if err != nil {
+			return nil, fmt.Errorf("failed to plan coalesced reads for module '%v': %v", module.Name, err.Error())
+		}
+		client = c
+	}
+
+	metrics, err := scrapeObservedMetrics(module.Metrics, client, observe)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrape metrics for module '%v': %v", module.Name, err.Error())
+	}
+
+	if len(module.Layouts) > 0 {
+		fields, err := scrapeLayouts(module.Layouts, conn.client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scrape layouts for module '%v': %v", module.Name, err.Error())
+		}
+		metrics = append(metrics, fields...)
+	}
+
+	if len(module.Selectors) > 0 {
+		selected, err := scrapeSelectors(module.Selectors, conn.client, observe)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scrape selectors for module '%v': %v", module.Name, err.Error())
+		}
+		metrics = append(metrics, selected...)
 	}
 
-	// TODO: We should probably be reusing these, right?
-	handler := modbus.NewTCPClientHandler(targetAddress)
-	if module.Timeout != 0 {
-		handler.Timeout = time.Duration(module.Timeout) * time.Millisecond
+	if len(module.Diagnostics) > 0 {
+		diagnostics, err := scrapeDiagnostics(module.Diagnostics, func(subFunction uint16) (uint16, error) {
+			value, err := readDiagnostic(conn.handler, subFunction)
+			return value, conn.countMalformed(err)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scrape diagnostics for module '%v': %v", module.Name, err.Error())
+		}
+		metrics = append(metrics, diagnostics...)
+	}
+
+	if len(module.FIFOQueues) > 0 {
+		queues, err := scrapeFIFOQueues(module.FIFOQueues, func(address uint16) ([]uint16, error) {
+			values, err := readFIFOQueue(conn.handler, address)
+			return values, conn.countMalformed(err)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scrape fifo queues for module '%v': %v", module.Name, err.Error())
+		}
+		metrics = append(metrics, queues...)
+	}
+
+	if len(module.FileRecords) > 0 {
+		records, err := scrapeFileRecords(module.FileRecords, func(records []config.FileRecord) ([][]byte, error) {
+			values, err := readFileRecords(conn.handler, records)
+			return values, conn.countMalformed(err)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scrape file records for module '%v': %v", module.Name, err.Error())
+		}
+		metrics = append(metrics, records...)
+	}
+
+	if len(module.ConfigHashes) > 0 {
+		hashes, err := scrapeConfigHashes(module.ConfigHashes, conn.client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scrape config hashes for module '%v': %v", module.Name, err.Error())
+		}
+		metrics = append(metrics, hashes...)
 	}
-	handler.SlaveId = subTarget
-	if err := handler.Connect(); err != nil {
-		return nil, fmt.Errorf("unable to connect with target %s via module %s",
-			targetAddress, module.Name)
+
+	if len(module.EventPointers) > 0 {
+		pointers, err := scrapeEventPointers(module.EventPointers, conn.client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scrape event pointers for module '%v': %v", module.Name, err.Error())
+		}
+		metrics = append(metrics, pointers...)
 	}
 
-	if module.Workarounds.SleepAfterConnect > 0 {
-		time.Sleep(module.Workarounds.SleepAfterConnect)
+	return metrics, nil
+}
+
+// writeRegisters writes the given values to the holding registers of the
+// device in the given order.
+func writeRegisters(writes []config.RegisterWrite, c modbus.Client) error {
+	for _, w := range writes {
+		_, modAddress, err := splitAddress(w.Address)
+		if err != nil {
+			return err
+		}
+
+		if len(w.Values) == 1 {
+			_, err = c.WriteSingleRegister(uint16(modAddress), w.Values[0])
+		} else {
+			values := make([]byte, 2*len(w.Values))
+			for i, v := range w.Values {
+				binary.BigEndian.PutUint16(values[2*i:], v)
+			}
+			_, err = c.WriteMultipleRegisters(uint16(modAddress), uint16(len(w.Values)), values)
+		}
+		if err != nil {
+			return fmt.Errorf("address '%v': %v", w.Address, err)
+		}
 	}
 
-	// TODO: Should we reuse this?
-	c := modbus.NewClient(handler)
+	return nil
+}
+
+// registerMetrics registers the given metrics with the given registerer. If
+// maxSeries is positive, label combinations beyond the first maxSeries of a
+// metric family are dropped, returning the number of dropped series. It never
+// touches the default registerer, so that concurrent scrapes each registering
+// with their own registry do not interfere.
+func registerMetrics(reg prometheus.Registerer, moduleName string, metrics []metric, maxSeries int) (int, error) {
+	registeredGauges := map[string]*prometheus.GaugeVec{}
+	registeredCounters := map[string]*prometheus.CounterVec{}
+	registeredTimestamped := map[string]*timestampedCollector{}
+	series := map[string]map[string]bool{}
+	labelNames := map[string]string{}
+	dropped := 0
+
+	for _, m := range metrics {
+		// The labels may be shared with the metric definition or retained
+		// series, thus are not modified in place.
+		m.Labels = copyLabels(m.Labels)
+		m.Labels["module"] = moduleName
+
+		if maxSeries > 0 {
+			signature := labelsSignature(m.Labels)
+			if _, ok := series[m.Name]; !ok {
+				series[m.Name] = map[string]bool{}
+			}
+			if !series[m.Name][signature] {
+				if len(series[m.Name]) >= maxSeries {
+					dropped++
+					continue
+				}
+				series[m.Name][signature] = true
+			}
+		}
+
+		// Series of a metric have to share their label names, which
+		// relabeling may break, e.g. by a replace matching only some series,
+		// after the label names were validated on loading the configuration.
+		names := keys(m.Labels)
+		sort.Strings(names)
+		if previous, ok := labelNames[m.Name]; !ok {
+			labelNames[m.Name] = strings.Join(names, ",")
+		} else if joined := strings.Join(names, ","); previous != joined {
+			return dropped, fmt.Errorf("metric '%v' has series with different label names [%v] and [%v], e.g. after relabeling", m.Name, previous, joined)
+		}
+
+		// The metric vectors do not support timestamps, thus metrics with a
+		// device provided timestamp are exposed as constant metrics.
+		if !m.Timestamp.IsZero() {
+			collector, ok := registeredTimestamped[m.Name]
+
+			if !ok {
+				collector = newTimestampedCollector(m.Name, m.Help, m.MetricType, keys(m.Labels))
+
+				if err := reg.Register(collector); err != nil {
+					return dropped, fmt.Errorf("failed to register metric %v: %v", m.Name, err.Error())
+				}
+
+				registeredTimestamped[m.Name] = collector
+			}
+
+			if err := collector.add(m); err != nil {
+				return dropped, fmt.Errorf("metric '%v', labels '%v': %v", m.Name, m.Labels, err)
+			}
+
+			continue
+		}
+
+		switch m.MetricType {
+		case config.MetricTypeGauge:
+			// Make sure not to register the same metric twice.
+			collector, ok := registeredGauges[m.Name]
+
+			if !ok {
+				collector = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+					Name: m.Name,
+					Help: m.Help,
+				}, keys(m.Labels))
+
+				if err := reg.Register(collector); err != nil {
+					return dropped, fmt.Errorf("failed to register metric %v: %v", m.Name, err.Error())
+				}
+
+				registeredGauges[m.Name] = collector
+			}
+
+			collector.With(m.Labels).Set(m.Value)
+		case config.MetricTypeCounter:
+			// Make sure not to register the same metric twice.
+			collector, ok := registeredCounters[m.Name]
+
+			if !ok {
+				collector = prometheus.NewCounterVec(prometheus.CounterOpts{
+					Name: m.Name,
+					Help: m.Help,
+				}, keys(m.Labels))
+
+				if err := reg.Register(collector); err != nil {
+					return dropped, fmt.Errorf("failed to register metric %v: %v", m.Name, err.Error())
+				}
+
+				registeredCounters[m.Name] = collector
+			}
+
+			// Prometheus client library panics among other things
+			// if the counter value is negative. The below construct
+			// recovers from such panic and properly returns the error
+			// with meta data attached.
+			var err error
+
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						err = r.(error)
+					}
+				}()
+
+				collector.With(m.Labels).Add(m.Value)
+			}()
+
+			if err != nil {
+				return dropped, fmt.Errorf(
+					"metric '%v', type '%v', value '%v', labels '%v': %v",
+					m.Name, m.MetricType, m.Value, m.Labels, err,
+				)
+			}
+		}
+
+	}
+
+	return dropped, nil
+}
+
+// labelsSignature returns a string uniquely identifying the given label set.
+func labelsSignature(labels map[string]string) string {
+	names := keys(labels)
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, n := range names {
+		fmt.Fprintf(&b, "%q=%q,", n, labels[n])
+	}
+
+	return b.String()
+}
+
+func keys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+func scrapeMetrics(definitions []config.MetricDef, c modbus.Client) ([]metric, error) {
+	return scrapeObservedMetrics(definitions, c, func(string, config.RegisterAddr, error) {})
+}
+
+// readObserver is called with the name, the address and the outcome of the
+// read of each metric.
+type readObserver func(name string, address config.RegisterAddr, err error)
+
+// scrapeObservedMetrics scrapes the given metrics like scrapeMetrics, passing
+// the outcome of the read of each metric to the given observer.
+func scrapeObservedMetrics(definitions []config.MetricDef, c modbus.Client, observe readObserver) ([]metric, error) {
+	metrics := []metric{}
+
+	if len(definitions) == 0 {
+		return []metric{}, nil
+	}
+
+	scaleFactors, err := scrapeScaleFactors(definitions, c)
+	if err != nil {
+		return []metric{}, err
+	}
+
+	signs, err := scrapeRegisters(definitions, c, "sign register", func(d config.MetricDef) *config.RegisterAddr {
+		return d.SignRegister
+	})
+	if err != nil {
+		return []metric{}, err
+	}
+
+	offsets, err := scrapeRegisters(definitions, c, "offset register", func(d config.MetricDef) *config.RegisterAddr {
+		return d.OffsetRegister
+	})
+	if err != nil {
+		return []metric{}, err
+	}
+
+	factors, err := scrapeRegisterValues(definitions, c, "factor register", func(d config.MetricDef) *config.RegisterValue {
+		return d.FactorRegister
+	})
+	if err != nil {
+		return []metric{}, err
+	}
+
+	biases, err := scrapeRegisterValues(definitions, c, "bias register", func(d config.MetricDef) *config.RegisterValue {
+		return d.BiasRegister
+	})
+	if err != nil {
+		return []metric{}, err
+	}
+
+	qualities, err := scrapeRegisters(definitions, c, "quality register", func(d config.MetricDef) *config.RegisterAddr {
+		if d.Quality == nil {
+			return nil
+		}
+		return &d.Quality.Address
+	})
+	if err != nil {
+		return []metric{}, err
+	}
+
+	timestamps := map[config.TimestampSource]time.Time{}
+
+	for _, definition := range definitions {
+		var f modbusFunc
+
+		address := definition.Address
+		if len(definition.Addresses) > 0 {
+			address = definition.Addresses[0]
+		}
+		modFunction, modAddress, err := splitAddress(address)
+		if err != nil {
+			return []metric{}, err
+		}
+
+		switch modFunction {
+		case 1:
+			f = c.ReadCoils
+		case 2:
+			f = c.ReadDiscreteInputs
+		case 3:
+			f = c.ReadHoldingRegisters
+		case 4:
+			f = c.ReadInputRegisters
+		default:
+			return []metric{}, fmt.Errorf(
+				"metric: '%v', address '%v': metric address should be within the range of 10 - 465535."+
+					"'1xxxxx' for read coil / digital output, '2xxxxx' for read discrete inputs / digital input,"+
+					"'3xxxxx' read holding registers / analog output, '4xxxxx' read input registers / analog input",
+				definition.Name, address,
+			)
+		}
+
+		if definition.FactorRegister != nil {
+			factor := factors[*definition.FactorRegister]
+			definition.Factor = &factor
+		}
+		if definition.BiasRegister != nil {
+			bias := biases[*definition.BiasRegister]
+			definition.Bias = &bias
+		}
+
+		// The configured multiplier, before negating the factor below.
+		scale := 1.0
+		if definition.Factor != nil {
+			scale = *definition.Factor
+		}
+		if definition.Mul != nil {
+			scale *= *definition.Mul
+		}
+		if definition.Div != nil {
+			scale /= *definition.Div
+		}
+
+		// Negating only flips the factor, so the offset folded into the bias
+		// is subtracted from the signed value.
+		if definition.OffsetRegister != nil {
+			definition = subtractOffset(definition, int16(offsets[*definition.OffsetRegister]))
+		}
+		if definition.SignRegister != nil && signs[*definition.SignRegister] != 0 {
+			definition = negate(definition)
+		}
+
+		var m metric
+		var derived []metric
+		if definition.Quality != nil {
+			good := definition.Quality.Good(qualities[definition.Quality.Address])
+			metrics = append(metrics, qualityMetric(definition.Name, good))
+			if !good {
+				err = errBadQuality
+				observe(definition.Name, address, err)
+			}
+		}
+		if err == nil && definition.ScaleFactor != nil && scaleFactors[*definition.ScaleFactor] == scaleFactorNotImplemented {
+			err = errScaleFactorNotImplemented
+			observe(definition.Name, address, err)
+		}
+		if err == nil {
+			m, derived, err = scrapeMetric(definition, f, modAddress)
+			// Errors are reported against the address read last.
+			for i := 0; i < len(definition.FallbackAddresses) && isModbusException(err); i++ {
+				address = definition.FallbackAddresses[i]
+				_, fallbackAddress, splitErr := splitAddress(address)
+				if splitErr != nil {
+					return []metric{}, splitErr
+				}
+				m, derived, err = scrapeMetric(definition, f, fallbackAddress)
+			}
+			observe(definition.Name, address, err)
+		}
+		if err == nil && definition.NaNMeansMissing {
+			missing := math.IsNaN(m.Value)
+			metrics = append(metrics, presentMetric(definition, !missing))
+			if missing {
+				continue
+			}
+		}
+		if err != nil {
+			// Reads of a single metric failing after a failed coalesced read,
+			// returning suppressed zeros or a fraction with a zero
+			// denominator, values of bad quality or with an unimplemented
+			// scale factor as well as reads exceeding the metric's own
+			// timeout are handled as per the metric's policy, other errors
+			// fail the scrape.
+			var fallbackErr *fallbackReadError
+			tolerated := errors.As(err, &fallbackErr) || errors.Is(err, errAllZero) || errors.Is(err, errZeroDenominator) || errors.Is(err, errBadQuality) ||
+				errors.Is(err, errScaleFactorNotImplemented) ||
+				(definition.ReadTimeout > 0 && isTimeout(err))
+			if !tolerated || definition.OnError == config.OnErrorFail {
+				return []metric{}, fmt.Errorf("metric '%v', address '%v': %v", definition.Name, address, err)
+			}
+			if definition.OnError != config.OnErrorNaN {
+				continue
+			}
+			m = metric{Name: definition.Name, Help: definition.Help, Labels: definition.Labels, Value: math.NaN(), MetricType: definition.MetricType}
+		}
+		m.Condition = definition.Condition
+
+		if definition.ScaleFactor != nil {
+			scale *= math.Pow10(int(scaleFactors[*definition.ScaleFactor]))
+			m.Value *= math.Pow10(int(scaleFactors[*definition.ScaleFactor]))
+		}
+		if definition.Precision != nil {
+			m.Value = roundValue(definition.RoundingMode, *definition.Precision, m.Value)
+		}
+		if definition.ExportScaleApplied {
+			derived = append(derived, scaleAppliedMetric(definition, scale))
+		}
+
+		if definition.Timestamp != nil {
+			ts, ok := timestamps[*definition.Timestamp]
+			if !ok {
+				ts, err = scrapeTimestamp(*definition.Timestamp, c)
+				if err != nil {
+					return []metric{}, fmt.Errorf("metric '%v', timestamp address '%v': %v",
+						definition.Name, definition.Timestamp.Address, err)
+				}
+				timestamps[*definition.Timestamp] = ts
+			}
+			m.Timestamp = ts
+			for i := range derived {
+				derived[i].Timestamp = ts
+			}
+		}
+
+		if definition.BitArray != nil {
+			metrics = append(metrics, expandBitArray(*definition.BitArray, definition.DataType, m)...)
+		} else {
+			metrics = append(metrics, m)
+		}
+		metrics = append(metrics, derived...)
+	}
+
+	return applyConditions(metrics), nil
+}
+
+// presentMetric returns the gauge telling whether the given metric treating
+// NaN as missing holds a value.
+func presentMetric(definition config.MetricDef, present bool) metric {
+	v := 0.0
+	if present {
+		v = 1
+	}
+
+	return metric{
+		Name:       definition.Name + "_present",
+		Help:       fmt.Sprintf("Whether %v holds a value, 0 if the device reported it missing as NaN.", definition.Name),
+		Labels:     copyLabels(definition.Labels),
+		Value:      v,
+		MetricType: config.MetricTypeGauge,
+	}
+}
+
+// rawMetric returns the gauge holding the value of the given metric decoded
+// from the given register data without applying any scaling.
+func rawMetric(definition config.MetricDef, data []byte) (metric, error) {
+	d := definition
+	d.Factor, d.Bias = nil, nil
+	d.Mul, d.Div, d.Offset = nil, nil, nil
+	d.Coefficients, d.Range, d.PercentDenominator = nil, nil, nil
+	d.SourceUnit, d.Unit = "", ""
+
+	v, _, err := decodeModbusData(d, data)
+	if err != nil {
+		return metric{}, fmt.Errorf("raw value: %v", err)
+	}
+
+	return metric{
+		Name:       definition.Name + "_raw",
+		Help:       fmt.Sprintf("Value of %v as read, before scaling.", definition.Name),
+		Labels:     copyLabels(definition.Labels),
+		Value:      v,
+		MetricType: config.MetricTypeGauge,
+	}, nil
+}
+
+// scaleAppliedMetric returns the gauge holding the multiplier applied to the
+// given metric.
+func scaleAppliedMetric(definition config.MetricDef, scale float64) metric {
+	return metric{
+		Name:       definition.Name + "_scale_applied",
+		Help:       fmt.Sprintf("Multiplier applied to the value of %v.", definition.Name),
+		Labels:     copyLabels(definition.Labels),
+		Value:      scale,
+		MetricType: config.MetricTypeGauge,
+	}
+}
+
+// qualityMetric returns the quality gauge of the given metric.
+func qualityMetric(name string, good bool) metric {
+	v := 0.0
+	if good {
+		v = 1
+	}
+
+	return metric{
+		Name:       "modbus_value_quality",
+		Help:       "Quality of the value of a metric as per its quality flag, 1 if good and 0 if bad.",
+		Labels:     map[string]string{"metric": name},
+		Value:      v,
+		MetricType: config.MetricTypeGauge,
+	}
+}
+
+// scrapeScaleFactors reads each scale factor register referenced by the given
+// definitions once, returning the int16 scale factors by address.
+func scrapeScaleFactors(definitions []config.MetricDef, c modbus.Client) (map[config.RegisterAddr]int16, error) {
+	registers, err := scrapeRegisters(definitions, c, "scale factor", func(d config.MetricDef) *config.RegisterAddr {
+		return d.ScaleFactor
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	scaleFactors := make(map[config.RegisterAddr]int16, len(registers))
+	for address, v := range registers {
+		scaleFactors[address] = int16(v)
+	}
+
+	return scaleFactors, nil
+}
+
+// scrapeRegisters reads each single register referenced by the given
+// definitions via the given function once, e.g. their scale factor registers.
+func scrapeRegisters(definitions []config.MetricDef, c modbus.Client, kind string, register func(config.MetricDef) *config.RegisterAddr) (map[config.RegisterAddr]uint16, error) {
+	registers := map[config.RegisterAddr]uint16{}
+
+	for _, definition := range definitions {
+		if register(definition) == nil {
+			continue
+		}
+		address := *register(definition)
+		if _, ok := registers[address]; ok {
+			continue
+		}
+
+		modFunction, modAddress, err := splitAddress(address)
+		if err != nil {
+			return nil, err
+		}
+
+		f := registerReadFunc(c, modFunction)
+		if f == nil {
+			return nil, fmt.Errorf("%v address '%v' is not a holding or input register address", kind, address)
+		}
+
+		data, err := f(uint16(modAddress), 1)
+		if err != nil {
+			return nil, fmt.Errorf("%v address '%v': %v", kind, address, err)
+		}
+		if len(data) < 2 {
+			return nil, fmt.Errorf("%v address '%v': %v", kind, address, &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(data))})
+		}
+
+		registers[address] = binary.BigEndian.Uint16(data)
+	}
+
+	return registers, nil
+}
+
+// scrapeRegisterValues reads each register value referenced by the given
+// definitions via the given function once, e.g. their factor registers.
+func scrapeRegisterValues(definitions []config.MetricDef, c modbus.Client, kind string, value func(config.MetricDef) *config.RegisterValue) (map[config.RegisterValue]float64, error) {
+	values := map[config.RegisterValue]float64{}
+
+	for _, definition := range definitions {
+		if value(definition) == nil {
+			continue
+		}
+		source := *value(definition)
+		if _, ok := values[source]; ok {
+			continue
+		}
+
+		v, err := scrapeRegisterValue(source, c)
+		if err != nil {
+			return nil, fmt.Errorf("%v address '%v': %v", kind, source.Address, err)
+		}
+
+		values[source] = v
+	}
+
+	return values, nil
+}
+
+// scrapeRegisterValue reads the given register value.
+func scrapeRegisterValue(source config.RegisterValue, c modbus.Client) (float64, error) {
+	modFunction, modAddress, err := splitAddress(source.Address)
+	if err != nil {
+		return 0, err
+	}
+
+	f := registerReadFunc(c, modFunction)
+	if f == nil {
+		return 0, fmt.Errorf("not a holding or input register address")
+	}
+
+	definition := config.MetricDef{DataType: source.DataType, Endianness: source.Endianness}
+	if definition.DataType == "" {
+		definition.DataType = config.ModbusInt16
+	}
+
+	data, err := f(uint16(modAddress), uint16(definition.DataType.RegisterCount()))
+	if err != nil {
+		return 0, err
+	}
+
+	return parseModbusData(definition, data)
+}
+
+// subtractOffset returns the given definition subtracting the given offset
+// from the decoded value before applying factor and bias.
+func subtractOffset(definition config.MetricDef, offset int16) config.MetricDef {
+	// Factor and bias map v to v*factor - bias, so (v-offset)*factor - bias
+	// is v*factor - (bias + offset*factor).
+	bias := float64(offset)
+	if definition.Factor != nil {
+		bias *= *definition.Factor
+	}
+	if definition.Bias != nil {
+		bias += *definition.Bias
+	}
+	definition.Bias = &bias
+
+	return definition
+}
+
+// negate returns the given definition negating the decoded value before
+// applying factor and bias, for values stored as sign and magnitude.
+func negate(definition config.MetricDef) config.MetricDef {
+	factor := -1.0
+	if definition.Factor != nil {
+		factor = -*definition.Factor
+	}
+	definition.Factor = &factor
+
+	return definition
+}
+
+// scrapeTimestamp reads the given timestamp registers.
+func scrapeTimestamp(source config.TimestampSource, c modbus.Client) (time.Time, error) {
+	modFunction, modAddress, err := splitAddress(source.Address)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	f := registerReadFunc(c, modFunction)
+	if f == nil {
+		return time.Time{}, fmt.Errorf("not a holding or input register address")
+	}
+
+	definition := config.MetricDef{DataType: source.DataType, Endianness: source.Endianness}
+	if definition.DataType == "" {
+		definition.DataType = config.ModbusUInt32
+	}
+
+	data, err := f(uint16(modAddress), uint16(definition.DataType.RegisterCount()))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	v, err := parseModbusData(definition, data)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if source.Unit == "ms" {
+		return time.UnixMilli(int64(v)), nil
+	}
+
+	return time.Unix(int64(v), 0), nil
+}
+
+// registerReadFunc returns the read function of the given client for the
+// holding (3) or input (4) registers function code, or nil for any other.
+func registerReadFunc(c modbus.Client, modFunction uint64) modbusFunc {
+	switch modFunction {
+	case 3:
+		return c.ReadHoldingRegisters
+	case 4:
+		return c.ReadInputRegisters
+	default:
+		return nil
+	}
+}
+
+// splitAddress splits the given address from the config file into the modbus
+// function code (its first digit) and the register address (the remaining
+// digits).
+func splitAddress(address config.RegisterAddr) (uint64, uint64, error) {
+	// Here we are parcing Modbus Address from config file
+	// for function code and register address
+	modFunction, err := strconv.ParseUint(fmt.Sprint(address)[0:1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("modbus function code parcing failed: %v", modFunction)
+	}
+
+	// And here we are parcing Modbus Address from config file
+	// for register address
+	modAddress, err := strconv.ParseUint(fmt.Sprint(address)[1:], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("modbus register address parcing failed  %v", modAddress)
+	}
+
+	if modAddress > 65535 {
+		return 0, 0, fmt.Errorf("modbus register address is out of range: %v", address)
+	}
+
+	return modFunction, modAddress, nil
+}
+
+// exceptionKey identifies the metric of a target in the last exception code
+// gauge.
+type exceptionKey struct {
+	module string
+	target string
+	metric string
+}
+
+// observeException sets the last exception code of the given metric to the
+// code of the given error if it is a Modbus exception, or to 0 on success if
+// the metric's reads failed with an exception before. Other errors leave it
+// unchanged.
+func (e *Exporter) observeException(module, target, name string, err error) {
+	key := exceptionKey{module, target, name}
+
+	var modbusErr *modbus.ModbusError
+	if errors.As(err, &modbusErr) {
+		e.exceptionsMu.Lock()
+		e.exceptions[key] = true
+		e.exceptionsMu.Unlock()
+
+		e.lastExceptionCode.WithLabelValues(module, target, name).Set(float64(modbusErr.ExceptionCode))
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	e.exceptionsMu.Lock()
+	excepted := e.exceptions[key]
+	e.exceptionsMu.Unlock()
+
+	if excepted {
+		e.lastExceptionCode.WithLabelValues(module, target, name).Set(0)
+	}
+}
+
+// isModbusException returns whether the given error is a Modbus exception
+// response of the target.
+func isModbusException(err error) bool {
+	var modbusErr *modbus.ModbusError
+	return errors.As(err, &modbusErr)
+}
+
+// modbus read function type
+type modbusFunc func(address, quantity uint16) ([]byte, error)
+
+// scrapeMetric returns the list of values from a target
+func scrapeMetric(definition config.MetricDef, f modbusFunc, modAddress uint64) (metric, []metric, error) {
+	// For now we are not caching any results, thus we can request the
+	// minimum necessary amount of registers per request dependint in the dataType.
+	// For future reference, the maximum for digital in/output is 2000 registers,
+	// the maximum for analog in/output is 125.
+	div := uint16(definition.RegisterCount())
+
+	// TODO: We could cache the results to not repeat overlapping ones.
+
+	var modBytes []byte
+	var err error
+	if len(definition.Addresses) > 0 {
+		modBytes, err = readAddresses(definition.Addresses, f)
+	} else if definition.PadBefore > 0 || definition.PadAfter > 0 {
+		modBytes, err = readPadded(definition, f, modAddress)
+	} else {
+		modBytes, err = f(uint16(modAddress), div)
+	}
+	if err != nil {
+		return metric{}, nil, err
+	}
+
+	if definition.SuppressZero && allZero(modBytes) {
+		return metric{}, nil, errAllZero
+	}
 
-	// Close tcp connection.
-	defer handler.Close()
+	m, err := parseMetric(definition, modBytes)
+	if err != nil {
+		return metric{}, nil, err
+	}
 
-	metrics, err := scrapeMetrics(module.Metrics, c)
+	derived, err := parseDerived(definition.Derived, modBytes)
 	if err != nil {
-		return nil, fmt.Errorf("failed to scrape metrics for module '%v': %v", moduleName, err.Error())
+		return metric{}, nil, err
 	}
 
-	if err := registerMetrics(reg, moduleName, metrics); err != nil {
-		return nil, fmt.Errorf("failed to register metrics for module %v: %v", moduleName, err.Error())
+	if definition.ExportRaw {
+		raw, err := rawMetric(definition, modBytes)
+		if err != nil {
+			return metric{}, nil, err
+		}
+		derived = append(derived, raw)
 	}
 
-	return reg, nil
+	return m, derived, nil
 }
 
-func registerMetrics(reg prometheus.Registerer, moduleName string, metrics []metric) error {
-	registeredGauges := map[string]*prometheus.GaugeVec{}
-	registeredCounters := map[string]*prometheus.CounterVec{}
+// parseDerived parses the leading registers of the given register data into
+// the given derived metrics.
+func parseDerived(definitions []config.MetricDef, data []byte) ([]metric, error) {
+	if len(definitions) == 0 {
+		return nil, nil
+	}
 
-	for _, m := range metrics {
-		if m.Labels == nil {
-			m.Labels = map[string]string{}
+	metrics := make([]metric, 0, len(definitions))
+	for _, definition := range definitions {
+		size := 2 * definition.RegisterCount()
+		if size > len(data) {
+			return nil, fmt.Errorf("derived metric '%v': %v", definition.Name, &InsufficientRegistersError{
+				fmt.Sprintf("expected %v bytes, got %v", size, len(data)),
+			})
 		}
-		m.Labels["module"] = moduleName
-
-		switch m.MetricType {
-		case config.MetricTypeGauge:
-			// Make sure not to register the same metric twice.
-			collector, ok := registeredGauges[m.Name]
 
-			if !ok {
-				collector = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-					Name: m.Name,
-					Help: m.Help,
-				}, keys(m.Labels))
-
-				if err := reg.Register(collector); err != nil {
-					return fmt.Errorf("failed to register metric %v: %v", m.Name, err.Error())
-				}
-
-				registeredGauges[m.Name] = collector
-			}
+		m, err := parseMetric(definition, data[:size])
+		if err != nil {
+			return nil, fmt.Errorf("derived metric '%v': %v", definition.Name, err)
+		}
+		metrics = append(metrics, m)
+	}
 
-			collector.With(m.Labels).Set(m.Value)
-		case config.MetricTypeCounter:
-			// Make sure not to register the same metric twice.
-			collector, ok := registeredCounters[m.Name]
+	return metrics, nil
+}
 
-			if !ok {
-				collector = prometheus.NewCounterVec(prometheus.CounterOpts{
-					Name: m.Name,
-					Help: m.Help,
-				}, keys(m.Labels))
+// readAddresses reads the given registers one by one, concatenating them in
+// the given order.
+func readAddresses(addresses []config.RegisterAddr, f modbusFunc) ([]byte, error) {
+	data := make([]byte, 0, 2*len(addresses))
 
-				if err := reg.Register(collector); err != nil {
-					return fmt.Errorf("failed to register metric %v: %v", m.Name, err.Error())
-				}
+	for _, address := range addresses {
+		_, modAddress, err := splitAddress(address)
+		if err != nil {
+			return nil, err
+		}
 
-				registeredCounters[m.Name] = collector
-			}
+		register, err := f(uint16(modAddress), 1)
+		if err != nil {
+			return nil, fmt.Errorf("address '%v': %v", address, err)
+		}
+		if len(register) != 2 {
+			return nil, fmt.Errorf("address '%v': %v", address, &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(register))})
+		}
 
-			// Prometheus client library panics among other things
-			// if the counter value is negative. The below construct
-			// recovers from such panic and properly returns the error
-			// with meta data attached.
-			var err error
+		data = append(data, register...)
+	}
 
-			func() {
-				defer func() {
-					if r := recover(); r != nil {
-						err = r.(error)
-					}
-				}()
+	return data, nil
+}
 
-				collector.With(m.Labels).Add(m.Value)
-			}()
+// readPadded reads the registers of the given metric along with its padding
+// registers, returning the registers of the metric only.
+func readPadded(definition config.MetricDef, f modbusFunc, modAddress uint64) ([]byte, error) {
+	count := definition.RegisterCount()
 
-			if err != nil {
-				return fmt.Errorf(
-					"metric '%v', type '%v', value '%v', labels '%v': %v",
-					m.Name, m.MetricType, m.Value, m.Labels, err,
-				)
-			}
-		}
+	data, err := f(uint16(modAddress)-uint16(definition.PadBefore), uint16(definition.PadBefore+count+definition.PadAfter))
+	if err != nil {
+		return nil, err
+	}
 
+	start := 2 * definition.PadBefore
+	if len(data) < start+2*count {
+		return nil, &InsufficientRegistersError{fmt.Sprintf("expected %v bytes including padding, got %v", start+2*(count+definition.PadAfter), len(data))}
 	}
 
-	return nil
+	return data[start : start+2*count], nil
 }
 
-func keys(m map[string]string) []string {
-	keys := []string{}
-	for k := range m {
-		keys = append(keys, k)
-	}
+// errAllZero is returned by scrapeMetric for metrics suppressing reads
+// returning only zero bytes.
+var errAllZero = errors.New("read returned only zero bytes")
 
-	return keys
-}
+// errZeroDenominator is returned by parseModbusData for fractions with a
+// denominator of zero.
+var errZeroDenominator = errors.New("denominator of fraction is zero")
 
-func scrapeMetrics(definitions []config.MetricDef, c modbus.Client) ([]metric, error) {
-	metrics := []metric{}
+// errBadQuality is returned for values whose quality flag denotes a bad
+// quality, see config.Quality.
+var errBadQuality = errors.New("quality flag denotes bad quality")
 
-	if len(definitions) == 0 {
-		return []metric{}, nil
-	}
+// scaleFactorNotImplemented is the value of SunSpec scale factor registers the
+// device does not implement.
+const scaleFactorNotImplemented = math.MinInt16
 
-	for _, definition := range definitions {
-		var f modbusFunc
+// errScaleFactorNotImplemented is returned for values whose scale factor
+// register holds scaleFactorNotImplemented.
+var errScaleFactorNotImplemented = errors.New("scale factor is not implemented")
 
-		// Here we are parcing Modbus Address from config file
-		// for function code and register address
-		modFunction, err := strconv.ParseUint(fmt.Sprint(definition.Address)[0:1], 10, 64)
-		if err != nil {
-			return []metric{}, fmt.Errorf("modbus function code parcing failed: %v", modFunction)
+// allZero returns whether all of the given bytes are zero.
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
 		}
+	}
 
-		// And here we are parcing Modbus Address from config file
-		// for register address
-		modAddress, err := strconv.ParseUint(fmt.Sprint(definition.Address)[1:], 10, 64)
+	return true
+}
+
+// parseMetric parses the given register data into a metric of the given
+// definition. Strings are exported as the value label of a metric with the
+// value 1.
+func parseMetric(definition config.MetricDef, data []byte) (metric, error) {
+	if definition.DataType.IsLabel() {
+		s, err := decodeLabelValue(definition, data)
 		if err != nil {
-			return []metric{}, fmt.Errorf("modbus register address parcing failed  %v", modAddress)
+			return metric{}, err
 		}
 
-		if modAddress > 65535 {
-			return []metric{}, fmt.Errorf("modbus register address is out of range: %v", definition.Address)
+		valueLabel := definition.ValueLabel
+		if valueLabel == "" {
+			valueLabel = "value"
 		}
+		labels := copyLabels(definition.Labels)
+		labels[valueLabel] = s
 
-		switch modFunction {
-		case 1:
-			f = c.ReadCoils
-		case 2:
-			f = c.ReadDiscreteInputs
-		case 3:
-			f = c.ReadHoldingRegisters
-		case 4:
-			f = c.ReadInputRegisters
-		default:
-			return []metric{}, fmt.Errorf(
-				"metric: '%v', address '%v': metric address should be within the range of 10 - 465535."+
-					"'1xxxxx' for read coil / digital output, '2xxxxx' for read discrete inputs / digital input,"+
-					"'3xxxxx' read holding registers / analog output, '4xxxxx' read input registers / analog input",
-				definition.Name, definition.Address,
-			)
-		}
+		return metric{Name: definition.Name, Help: definition.Help, Labels: labels, Value: 1, MetricType: definition.MetricType}, nil
+	}
 
-		m, err := scrapeMetric(definition, f, modAddress)
-		if err != nil {
-			return []metric{}, fmt.Errorf("metric '%v', address '%v': %v", definition.Name, definition.Address, err)
+	v, exact, err := decodeModbusData(definition, data)
+	if err != nil {
+		return metric{}, err
+	}
+
+	labels := definition.Labels
+	if len(definition.LabelExpressions) > 0 {
+		labels = copyLabels(definition.Labels)
+		for label := range definition.LabelExpressions {
+			e, err := definition.LabelExpression(label)
+			if err != nil {
+				return metric{}, fmt.Errorf("label '%v': %v", label, err)
+			}
+			labels[label], err = evaluateLabelExpression(e, v)
+			if err != nil {
+				return metric{}, fmt.Errorf("label '%v': %v", label, err)
+			}
 		}
+	}
 
-		metrics = append(metrics, m)
+	expression, err := definition.ValueExpression()
+	if err != nil {
+		return metric{}, fmt.Errorf("expression: %v", err)
 	}
 
-	return metrics, nil
+	return metric{Name: definition.Name, Help: definition.Help, Labels: labels, Value: v, MetricType: definition.MetricType, Expression: expression, Accumulate: definition.Accumulate, CountChanges: definition.CountChanges, TrackExtremes: definition.TrackExtremes, ChangeEpsilon: definition.ChangeEpsilon, PrecisionLoss: !exact}, nil
 }
 
-// modbus read function type
-type modbusFunc func(address, quantity uint16) ([]byte, error)
-
-// scrapeMetric returns the list of values from a target
-func scrapeMetric(definition config.MetricDef, f modbusFunc, modAddress uint64) (metric, error) {
-	// For now we are not caching any results, thus we can request the
-	// minimum necessary amount of registers per request dependint in the dataType.
-	// For future reference, the maximum for digital in/output is 2000 registers,
-	// the maximum for analog in/output is 125.
-	var div uint16
-	switch definition.DataType {
-	case config.ModbusFloat16,
-		config.ModbusInt16,
-		config.ModbusBool,
-		config.ModbusUInt16:
-		div = uint16(1)
-	case config.ModbusFloat32,
-		config.ModbusInt32,
-		config.ModbusUInt32:
-		div = uint16(2)
-	default:
-		div = uint16(4)
-	}
-
-	// TODO: We could cache the results to not repeat overlapping ones.
+// evaluateLabelExpression evaluates the given expression over the given value
+// into a label value.
+func evaluateLabelExpression(e *govaluate.EvaluableExpression, value float64) (label string, err error) {
+	// Expressions failing unexpectedly fail the read of the metric rather than
+	// the exporter.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("expression '%v' failed: %v", e, r)
+		}
+	}()
 
-	modBytes, err := f(uint16(modAddress), div)
+	result, err := e.Evaluate(map[string]interface{}{"value": value})
 	if err != nil {
-		return metric{}, err
+		return "", err
 	}
 
-	v, err := parseModbusData(definition, modBytes)
-	if err != nil {
-		return metric{}, err
+	switch r := result.(type) {
+	case string:
+		return r, nil
+	case float64:
+		return strconv.FormatFloat(r, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(r), nil
+	default:
+		return "", fmt.Errorf("expression '%v' resulted in %T instead of a string", e, result)
 	}
-
-	return metric{definition.Name, definition.Help, definition.Labels, v, definition.MetricType}, nil
 }
 
 // InsufficientRegistersError is returned in Parse() whenever not enough
@@ -281,129 +1534,318 @@ func (e *InsufficientRegistersError) Error() string {
 //
 // TODO: Handle Endianness.
 func parseModbusData(d config.MetricDef, rawData []byte) (float64, error) {
+	v, _, err := decodeModbusData(d, rawData)
+	return v, err
+}
+
+// countPrecisionLoss counts the given metrics read from the given target
+// whose values were decoded with a loss of precision.
+func (e *Exporter) countPrecisionLoss(module, target string, metrics []metric) {
+	for _, m := range metrics {
+		if m.PrecisionLoss {
+			e.precisionLoss.WithLabelValues(module, target, m.Name).Inc()
+		}
+	}
+}
+
+// maxExactInteger is the largest magnitude up to which all integers are
+// exactly representable as float64.
+const maxExactInteger = 1 << 53
+
+// decodeModbusData parses the given byte slice like parseModbusData, also
+// returning whether the value was decoded without loss of precision, i.e.
+// whether an integer value is within float64's 53 bits of precision.
+func decodeModbusData(d config.MetricDef, rawData []byte) (float64, bool, error) {
+	// The number of set bits does not depend on the order of the bytes.
+	if d.Popcount {
+		if size := 2 * d.RegisterCount(); len(rawData) != size {
+			return float64(0), false, &InsufficientRegistersError{fmt.Sprintf("expected %v bytes, got %v", size, len(rawData))}
+		}
+
+		count := 0
+		for _, b := range rawData {
+			count += bits.OnesCount8(b)
+		}
+		return float64(count), true, nil
+	}
+
+	// Bytes in the configured byte and word order or in an explicit order
+	// are rearranged into big endian order.
+	var reordered [8]byte
+	if byteOrder, wordOrder, ok := d.Orders(); ok && len(rawData) <= len(reordered) {
+		rawData = arrangeBigEndian(reordered[:len(rawData)], rawData, byteOrder, wordOrder)
+		d.Endianness = config.EndiannessBigEndian
+	} else if d.ByteOrder != "" && len(rawData) == len(d.ByteOrder) {
+		for i := range d.ByteOrder {
+			reordered[i] = rawData[d.ByteOrder[i]-'0']
+		}
+		rawData = reordered[:len(rawData)]
+		d.Endianness = config.EndiannessBigEndian
+	}
+
 	switch d.DataType {
 	case config.ModbusBool:
 		{
 			if d.BitOffset == nil {
-				return float64(0), fmt.Errorf("expected bit position on boolean data type")
+				return float64(0), false, fmt.Errorf("expected bit position on boolean data type")
 			}
 
 			// Convert byte to uint16
 			data := uint16(rawData[0])
 
 			if data&(uint16(1)<<uint16(*d.BitOffset)) > 0 {
-				return float64(1), nil
+				return float64(1), true, nil
 			}
-			return float64(0), nil
+			return float64(0), true, nil
 		}
 	case config.ModbusFloat16:
 		{
 			if len(rawData) != 2 {
-				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(rawData))}
+				return float64(0), false, &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(rawData))}
 			}
-			panic("implement")
+			data := uint16WithEndianness(d.Endianness, rawData)
+			return applyTransformations(d, float16ToFloat64(data)), true, nil
 		}
 	case config.ModbusInt16:
 		{
 			if len(rawData) != 2 {
-				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(rawData))}
-			}
-			rawDataWithEndianness, err := convertEndianness16b(d.Endianness, rawData)
-			if err != nil {
-				return float64(0), err
+				return float64(0), false, &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(rawData))}
 			}
-			data := binary.BigEndian.Uint16(rawDataWithEndianness)
-			return scaleValue(d.Factor, d.Bias, float64(int16(data))), nil
+			data := uint16WithEndianness(d.Endianness, rawData)
+			v, _ := decodeInteger(d, uint64(data), 16, true)
+			return applyTransformations(d, v), true, nil
 		}
 	case config.ModbusUInt16:
 		{
 			if len(rawData) != 2 {
-				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(rawData))}
+				return float64(0), false, &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(rawData))}
 			}
-			rawDataWithEndianness, err := convertEndianness16b(d.Endianness, rawData)
-			if err != nil {
-				return float64(0), err
-			}
-			data := binary.BigEndian.Uint16(rawDataWithEndianness)
-			return scaleValue(d.Factor, d.Bias, float64(data)), nil
+			data := uint16WithEndianness(d.Endianness, rawData)
+			v, _ := decodeInteger(d, uint64(data), 16, false)
+			return applyTransformations(d, v), true, nil
 		}
 	case config.ModbusInt32:
 		{
 			if len(rawData) != 4 {
-				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 4 bytes, got %v", len(rawData))}
-			}
-			rawDataWithEndianness, err := convertEndianness32b(d.Endianness, rawData)
-			if err != nil {
-				return float64(0), err
+				return float64(0), false, &InsufficientRegistersError{fmt.Sprintf("expected 4 bytes, got %v", len(rawData))}
 			}
-			data := binary.BigEndian.Uint32(rawDataWithEndianness)
-			return scaleValue(d.Factor, d.Bias, float64(int32(data))), nil
+			data := uint32WithEndianness(d.Endianness, rawData)
+			v, _ := decodeInteger(d, uint64(data), 32, true)
+			return applyTransformations(d, v), true, nil
 		}
 	case config.ModbusUInt32:
 		{
 			if len(rawData) != 4 {
-				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 4 bytes, got %v", len(rawData))}
+				return float64(0), false, &InsufficientRegistersError{fmt.Sprintf("expected 4 bytes, got %v", len(rawData))}
 			}
-			rawDataWithEndianness, err := convertEndianness32b(d.Endianness, rawData)
-			if err != nil {
-				return float64(0), err
-			}
-			data := binary.BigEndian.Uint32(rawDataWithEndianness)
-			return scaleValue(d.Factor, d.Bias, float64(data)), nil
+			data := uint32WithEndianness(d.Endianness, rawData)
+			v, _ := decodeInteger(d, uint64(data), 32, false)
+			return applyTransformations(d, v), true, nil
 		}
 	case config.ModbusFloat32:
 		{
 			if len(rawData) != 4 {
-				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 4 bytes, got %v", len(rawData))}
-			}
-			rawDataWithEndianness, err := convertEndianness32b(d.Endianness, rawData)
-			if err != nil {
-				return float64(0), err
+				return float64(0), false, &InsufficientRegistersError{fmt.Sprintf("expected 4 bytes, got %v", len(rawData))}
 			}
-			data := binary.BigEndian.Uint32(rawDataWithEndianness)
-			return scaleValue(d.Factor, d.Bias, float64(math.Float32frombits(data))), nil
+			data := uint32WithEndianness(d.Endianness, rawData)
+			return applyTransformations(d, float64(math.Float32frombits(data))), true, nil
 		}
 	case config.ModbusInt64:
 		{
 			if len(rawData) != 8 {
-				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 8 bytes, got %v", len(rawData))}
+				return float64(0), false, &InsufficientRegistersError{fmt.Sprintf("expected 8 bytes, got %v", len(rawData))}
 			}
-			rawDataWithEndianness, err := convertEndianness64b(d.Endianness, rawData)
-			if err != nil {
-				return float64(0), err
-			}
-			data := binary.BigEndian.Uint64(rawDataWithEndianness)
-			return scaleValue(d.Factor, d.Bias, float64(int64(data))), nil
+			data := uint64WithEndianness(d.Endianness, rawData)
+			v, exact := decodeInteger(d, data, 64, true)
+			return applyTransformations(d, v), exact, nil
 		}
 	case config.ModbusUInt64:
 		{
 			if len(rawData) != 8 {
-				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 8 bytes, got %v", len(rawData))}
+				return float64(0), false, &InsufficientRegistersError{fmt.Sprintf("expected 8 bytes, got %v", len(rawData))}
 			}
-			rawDataWithEndianness, err := convertEndianness64b(d.Endianness, rawData)
-			if err != nil {
-				return float64(0), err
+			data := uint64WithEndianness(d.Endianness, rawData)
+			v, exact := decodeInteger(d, data, 64, false)
+			return applyTransformations(d, v), exact, nil
+		}
+	case config.ModbusFraction:
+		{
+			if len(rawData) != 4 {
+				return float64(0), false, &InsufficientRegistersError{fmt.Sprintf("expected 4 bytes, got %v", len(rawData))}
 			}
-			data := binary.BigEndian.Uint64(rawDataWithEndianness)
-			return scaleValue(d.Factor, d.Bias, float64(data)), nil
+			// The endianness applies to each of the two registers.
+			numerator := int16(uint16WithEndianness(d.Endianness, rawData[:2]))
+			denominator := int16(uint16WithEndianness(d.Endianness, rawData[2:]))
+			if denominator == 0 {
+				return float64(0), false, errZeroDenominator
+			}
+			return applyTransformations(d, float64(numerator)/float64(denominator)), true, nil
 		}
 	case config.ModbusFloat64:
 		{
 			if len(rawData) != 8 {
-				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 8 bytes, got %v", len(rawData))}
-			}
-			rawDataWithEndianness, err := convertEndianness64b(d.Endianness, rawData)
-			if err != nil {
-				return float64(0), err
+				return float64(0), false, &InsufficientRegistersError{fmt.Sprintf("expected 8 bytes, got %v", len(rawData))}
 			}
-			data := binary.BigEndian.Uint64(rawDataWithEndianness)
-			return scaleValue(d.Factor, d.Bias, math.Float64frombits(data)), nil
+			data := uint64WithEndianness(d.Endianness, rawData)
+			return applyTransformations(d, math.Float64frombits(data)), true, nil
 		}
 	default:
 		{
-			return 0, fmt.Errorf("unknown modbus data type")
+			return 0, false, fmt.Errorf("unknown modbus data type")
+		}
+	}
+}
+
+// float16ToFloat64 converts the given IEEE 754 half-precision floating point
+// number, i.e. 1 sign bit, 5 exponent bits and 10 mantissa bits, into a
+// float64.
+func float16ToFloat64(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1.0
+	}
+	exponent := int(h>>10) & 0x1F
+	mantissa := float64(h & 0x3FF)
+
+	switch exponent {
+	case 0:
+		// Zero and subnormal numbers.
+		return sign * math.Ldexp(mantissa, -24)
+	case 0x1F:
+		if mantissa != 0 {
+			return math.NaN()
+		}
+		return math.Inf(int(sign))
+	default:
+		return sign * math.Ldexp(1024+mantissa, exponent-25)
+	}
+}
+
+// decodeInteger interprets the given raw value of the given size in bits as a
+// signed (two's complement) or unsigned integer, after applying the configured
+// mask, if any. If a bit width is configured, only the bit field of that width
+// starting at the bit offset is interpreted, sign-extending it for signed data
+// types. It also returns whether the integer
+// is represented exactly by the returned float64.
+func decodeInteger(d config.MetricDef, raw uint64, size int, signed bool) (float64, bool) {
+	if d.Mask != nil {
+		raw &= *d.Mask
+	}
+
+	offset, width := 0, size
+	if d.BitWidth != nil {
+		width = *d.BitWidth
+		if d.BitOffset != nil {
+			offset = *d.BitOffset
+		}
+	}
+
+	v := raw >> uint(offset)
+	if signed {
+		shift := uint(64 - width)
+		i := int64(v<<shift) >> shift
+		return float64(i), i >= -maxExactInteger && i <= maxExactInteger
+	}
+
+	if width < 64 {
+		v &= 1<<uint(width) - 1
+	}
+
+	if d.ZeroOffset != nil {
+		i := int64(v - *d.ZeroOffset)
+		return float64(i), i >= -maxExactInteger && i <= maxExactInteger
+	}
+
+	return float64(v), v <= maxExactInteger
+}
+
+// applyTransformations applies the transformations configured on the given
+// metric definition to the decoded register value.
+func applyTransformations(d config.MetricDef, v float64) float64 {
+	if d.PercentDenominator != nil {
+		v = toPercent(*d.PercentDenominator, v)
+	} else if d.Range != nil {
+		v = mapRange(*d.Range, v)
+	} else {
+		v = scaleValue(d.Factor, d.Bias, v)
+		v = scaleVendor(d.Mul, d.Div, d.Offset, v)
+		if len(d.Coefficients) > 0 {
+			v = evaluatePolynomial(d.Coefficients, v)
 		}
 	}
+
+	if d.SourceUnit != "" {
+		v = convertDuration(d.SourceUnit, d.Unit, v)
+	}
+
+	return v
+}
+
+// roundValue rounds the given value to the given number of decimal places in
+// the given mode, defaulting to nearest. The value is first scaled to the
+// precision and cut to 15 significant digits, i.e. the precision of float64,
+// so values such as 2.345, which float64 holds as 2.34499..., round as written.
+func roundValue(mode config.RoundingMode, precision int, v float64) float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+
+	pow := math.Pow10(precision)
+	scaled, err := strconv.ParseFloat(strconv.FormatFloat(v*pow, 'g', 15, 64), 64)
+	if err != nil {
+		return v
+	}
+
+	switch mode {
+	case config.RoundingFloor:
+		scaled = math.Floor(scaled)
+	case config.RoundingCeil:
+		scaled = math.Ceil(scaled)
+	case config.RoundingTruncate:
+		scaled = math.Trunc(scaled)
+	case config.RoundingBankers:
+		scaled = math.RoundToEven(scaled)
+	default:
+		scaled = math.Round(scaled)
+	}
+
+	return scaled / pow
+}
+
+// convertDuration converts the given duration from the source unit into the
+// given unit, defaulting to seconds.
+func convertDuration(from, to config.DurationUnit, v float64) float64 {
+	if to == "" {
+		to = config.DurationUnitSeconds
+	}
+
+	return v * from.Seconds() / to.Seconds()
+}
+
+// evaluatePolynomial evaluates the polynomial with the given coefficients,
+// starting with the constant term, in the given value.
+func evaluatePolynomial(coefficients []float64, v float64) float64 {
+	result := 0.0
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = result*v + coefficients[i]
+	}
+
+	return result
+}
+
+// toPercent divides the given raw value by the given denominator, clamping the
+// percentage to [0, 100].
+func toPercent(denominator, v float64) float64 {
+	return math.Min(math.Max(v/denominator, 0), 100)
+}
+
+// mapRange linearly maps the given raw value from the raw range to the
+// engineering range. Values outside of the raw range are clamped to it.
+func mapRange(r config.RangeMapping, v float64) float64 {
+	v = math.Max(v, math.Min(r.RawMin, r.RawMax))
+	v = math.Min(v, math.Max(r.RawMin, r.RawMax))
+
+	return r.EngMin + (v-r.RawMin)*(r.EngMax-r.EngMin)/(r.RawMax-r.RawMin)
 }
 
 // Scales value by factor and subtracts the bias
@@ -425,23 +1867,29 @@ func scaleValue(f *float64, bias *float64, d float64) float64 {
 	return result
 }
 
+// scaleVendor maps the given value to v * mul / div + offset, skipping the
+// operations not given.
+func scaleVendor(mul, div, offset *float64, v float64) float64 {
+	if mul != nil {
+		v *= *mul
+	}
+	if div != nil {
+		v /= *div
+	}
+	if offset != nil {
+		v += *offset
+	}
+
+	return v
+}
+
 // Converts an array of 16 bits from an endianness to the default big Endian
 func convertEndianness16b(rawEndianness config.EndiannessType, rawData []byte) ([]byte, error) {
 	if len(rawData) != 2 {
 		return []byte{uint8(0), uint8(0)}, fmt.Errorf("expected 2 bytes, got %v", len(rawData))
 	}
-	var data []byte
-	switch rawEndianness {
-	case config.EndiannessLittleEndian:
-		data = []byte{
-			rawData[1],
-			rawData[0]}
-	// default: BigEndian
-	default:
-		data = []byte{
-			rawData[0],
-			rawData[1]}
-	}
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, uint16WithEndianness(rawEndianness, rawData))
 	return data, nil
 }
 
@@ -451,34 +1899,8 @@ func convertEndianness32b(rawEndianness config.EndiannessType, rawData []byte) (
 		return []byte{uint8(0), uint8(0), uint8(0), uint8(0)},
 			fmt.Errorf("expected 4 bytes, got %v", len(rawData))
 	}
-	var data []byte
-	switch rawEndianness {
-	case config.EndiannessLittleEndian:
-		data = []byte{
-			rawData[3],
-			rawData[2],
-			rawData[1],
-			rawData[0]}
-	case config.EndiannessMixedEndian:
-		data = []byte{
-			rawData[1],
-			rawData[0],
-			rawData[3],
-			rawData[2]}
-	case config.EndiannessYolo:
-		data = []byte{
-			rawData[2],
-			rawData[3],
-			rawData[0],
-			rawData[1]}
-	// default: BigEndian
-	default:
-		data = []byte{
-			rawData[0],
-			rawData[1],
-			rawData[2],
-			rawData[3]}
-	}
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32WithEndianness(rawEndianness, rawData))
 	return data, nil
 }
 
@@ -488,49 +1910,53 @@ func convertEndianness64b(rawEndianness config.EndiannessType, rawData []byte) (
 		return []byte{uint8(0), uint8(0), uint8(0), uint8(0), uint8(0), uint8(0), uint8(0), uint8(0)},
 			fmt.Errorf("expected 8 bytes, got %v", len(rawData))
 	}
-	var data []byte
-	switch rawEndianness {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64WithEndianness(rawEndianness, rawData))
+	return data, nil
+}
+
+// uint16WithEndianness decodes 2 bytes in the given endianness without
+// allocating, decoding a block of registers only slicing the block. Mixed and
+// yolo endianness do not apply to a single register.
+func uint16WithEndianness(endianness config.EndiannessType, b []byte) uint16 {
+	if endianness == config.EndiannessLittleEndian {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+// uint32WithEndianness decodes 4 bytes in the given endianness without
+// allocating.
+func uint32WithEndianness(endianness config.EndiannessType, b []byte) uint32 {
+	switch endianness {
+	case config.EndiannessLittleEndian:
+		return binary.LittleEndian.Uint32(b)
+	case config.EndiannessMixedEndian:
+		// 2 1 4 3
+		return uint32(b[1])<<24 | uint32(b[0])<<16 | uint32(b[3])<<8 | uint32(b[2])
+	case config.EndiannessYolo:
+		// 3 4 1 2
+		return uint32(b[2])<<24 | uint32(b[3])<<16 | uint32(b[0])<<8 | uint32(b[1])
+	default:
+		return binary.BigEndian.Uint32(b)
+	}
+}
+
+// uint64WithEndianness decodes 8 bytes in the given endianness without
+// allocating.
+func uint64WithEndianness(endianness config.EndiannessType, b []byte) uint64 {
+	switch endianness {
 	case config.EndiannessLittleEndian:
-		data = []byte{
-			rawData[7],
-			rawData[6],
-			rawData[5],
-			rawData[4],
-			rawData[3],
-			rawData[2],
-			rawData[1],
-			rawData[0]}
+		return binary.LittleEndian.Uint64(b)
 	case config.EndiannessMixedEndian:
-		data = []byte{
-			rawData[1],
-			rawData[0],
-			rawData[3],
-			rawData[2],
-			rawData[5],
-			rawData[4],
-			rawData[7],
-			rawData[6]}
+		// 2 1 4 3 6 5 8 7
+		return uint64(b[1])<<56 | uint64(b[0])<<48 | uint64(b[3])<<40 | uint64(b[2])<<32 |
+			uint64(b[5])<<24 | uint64(b[4])<<16 | uint64(b[7])<<8 | uint64(b[6])
 	case config.EndiannessYolo:
-		data = []byte{
-			rawData[6],
-			rawData[7],
-			rawData[4],
-			rawData[5],
-			rawData[2],
-			rawData[3],
-			rawData[0],
-			rawData[1]}
-	// default: BigEndian
+		// 7 8 5 6 3 4 1 2
+		return uint64(b[6])<<56 | uint64(b[7])<<48 | uint64(b[4])<<40 | uint64(b[5])<<32 |
+			uint64(b[2])<<24 | uint64(b[3])<<16 | uint64(b[0])<<8 | uint64(b[1])
 	default:
-		data = []byte{
-			rawData[0],
-			rawData[1],
-			rawData[2],
-			rawData[3],
-			rawData[4],
-			rawData[5],
-			rawData[6],
-			rawData[7]}
+		return binary.BigEndian.Uint64(b)
 	}
-	return data, nil
 }
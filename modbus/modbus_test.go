@@ -14,12 +14,26 @@
 package modbus
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/RichiH/modbus_exporter/config"
+	"github.com/go-kit/log"
+	"github.com/goburrow/modbus"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tbrandon/mbserver"
 )
 
 func TestRegisterMetrics(t *testing.T) {
@@ -28,7 +42,7 @@ func TestRegisterMetrics(t *testing.T) {
 		moduleName := "my_module"
 		metrics := []metric{}
 
-		if err := registerMetrics(reg, moduleName, metrics); err != nil {
+		if _, err := registerMetrics(reg, moduleName, metrics, 0); err != nil {
 			t.Fatal(err)
 		}
 	})
@@ -59,7 +73,7 @@ func TestRegisterMetrics(t *testing.T) {
 			},
 		}
 
-		if err := registerMetrics(reg, moduleName, metrics); err != nil {
+		if _, err := registerMetrics(reg, moduleName, metrics, 0); err != nil {
 			t.Fatal(err)
 		}
 
@@ -522,10 +536,10 @@ func TestParseModbusDataFloat32(t *testing.T) {
 // reregistering which would cause an exception.
 func TestRegisterMetricTwoMetricsSameName(t *testing.T) {
 	reg := prometheus.NewRegistry()
-	a := metric{"my_metric", "", map[string]string{}, 1, config.MetricTypeCounter}
-	b := metric{"my_metric", "", map[string]string{}, 1, config.MetricTypeCounter}
+	a := metric{Name: "my_metric", Labels: map[string]string{}, Value: 1, MetricType: config.MetricTypeCounter}
+	b := metric{Name: "my_metric", Labels: map[string]string{}, Value: 1, MetricType: config.MetricTypeCounter}
 
-	err := registerMetrics(reg, "my_module", []metric{a, b})
+	_, err := registerMetrics(reg, "my_module", []metric{a, b}, 0)
 	if err != nil {
 		t.Fatalf("expected no error but got: %v", err)
 	}
@@ -535,14 +549,277 @@ func TestRegisterMetricTwoMetricsSameName(t *testing.T) {
 // recovers from a prometheus client library panic on negative counter changes.
 func TestRegisterMetricsRecoverNegativeCounter(t *testing.T) {
 	reg := prometheus.NewRegistry()
-	a := metric{"my_metric", "", map[string]string{"key1": "value1", "key2": "value2"}, -1, config.MetricTypeCounter}
+	a := metric{Name: "my_metric", Labels: map[string]string{"key1": "value1", "key2": "value2"}, Value: -1, MetricType: config.MetricTypeCounter}
 
-	err := registerMetrics(reg, "my_module", []metric{a})
+	_, err := registerMetrics(reg, "my_module", []metric{a}, 0)
 	if err == nil {
 		t.Fatal("expected an error but got nil")
 	}
 }
 
+// TestRegisterMetricsMaxSeries makes sure label combinations beyond the limit
+// are dropped per metric family.
+func TestRegisterMetricsMaxSeries(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics := []metric{
+		{Name: "my_metric", Labels: map[string]string{"key": "a"}, Value: 1, MetricType: config.MetricTypeGauge},
+		{Name: "my_metric", Labels: map[string]string{"key": "b"}, Value: 2, MetricType: config.MetricTypeGauge},
+		// Already registered label combination, not counting against the limit.
+		{Name: "my_metric", Labels: map[string]string{"key": "a"}, Value: 3, MetricType: config.MetricTypeGauge},
+		{Name: "my_metric", Labels: map[string]string{"key": "c"}, Value: 4, MetricType: config.MetricTypeGauge},
+		{Name: "my_metric", Labels: map[string]string{"key": "d"}, Value: 5, MetricType: config.MetricTypeGauge},
+		{Name: "other_metric", Labels: map[string]string{"key": "a"}, Value: 6, MetricType: config.MetricTypeGauge},
+	}
+
+	dropped, err := registerMetrics(reg, "my_module", metrics, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 2 {
+		t.Fatalf("expected 2 dropped series but got %v", dropped)
+	}
+
+	if c := testutil.CollectAndCount(reg, "my_metric"); c != 2 {
+		t.Fatalf("expected 2 my_metric series but got %v", c)
+	}
+	if c := testutil.CollectAndCount(reg, "other_metric"); c != 1 {
+		t.Fatalf("expected 1 other_metric series but got %v", c)
+	}
+}
+
+func TestScrapeConcurrentTargets(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Metrics: []config.MetricDef{
+			{
+				Name:       "my_metric",
+				Labels:     map[string]string{"phase": "1"},
+				Address:    300001,
+				DataType:   config.ModbusUInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+			{
+				Name:       "my_metric",
+				Labels:     map[string]string{"phase": "2"},
+				Address:    300002,
+				DataType:   config.ModbusUInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+		},
+	}
+
+	// Each target reads its own index.
+	const targets = 50
+	clients := map[string]*fakeClient{}
+	for i := 0; i < targets; i++ {
+		c := newFakeClient()
+		c.holdingRegisters[1] = uint16(i)
+		c.holdingRegisters[2] = uint16(i)
+		clients[fmt.Sprintf("10.0.0.%v:502", i)] = c
+	}
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: clients[target], close: func() error { return nil }}, nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, targets*4)
+	for round := 0; round < 4; round++ {
+		for i := 0; i < targets; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				reg, err := e.Scrape(fmt.Sprintf("10.0.0.%v:502", i), 1, "my_module")
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				families, err := reg.Gather()
+				if err != nil {
+					errs <- err
+					return
+				}
+				for _, f := range families {
+					if len(f.GetMetric()) != 2 {
+						errs <- fmt.Errorf("target %v: expected 2 series but got %v", i, f.GetMetric())
+						return
+					}
+					for _, m := range f.GetMetric() {
+						if v := m.GetGauge().GetValue(); v != float64(i) {
+							errs <- fmt.Errorf("target %v: expected %v but got %v", i, i, v)
+							return
+						}
+					}
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestScrapeDroppedSeries(t *testing.T) {
+	module := config.Module{
+		Name:               "my_module",
+		Protocol:           config.ModbusProtocolTCPIP,
+		MaxSeriesPerMetric: 1,
+		Metrics: []config.MetricDef{
+			{
+				Name:       "my_metric",
+				Labels:     map[string]string{"phase": "1"},
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+			{
+				Name:       "my_metric",
+				Labels:     map[string]string{"phase": "2"},
+				Address:    300002,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+		},
+	}
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: newFakeClient(), close: func() error { return nil }}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		reg, err := e.Scrape("localhost:502", 1, "my_module")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := testutil.GatherAndCount(reg, "my_metric")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != 1 {
+			t.Fatalf("expected 1 my_metric series but got %v", c)
+		}
+	}
+
+	if v := testutil.ToFloat64(e.droppedSeries.WithLabelValues("my_module", "localhost:502", "1")); v != 2 {
+		t.Fatalf("expected 2 dropped series but got %v", v)
+	}
+}
+
+func TestScrapeTruncated(t *testing.T) {
+	module := config.Module{
+		Name:                "my_module",
+		Protocol:            config.ModbusProtocolTCPIP,
+		MaxMetricsPerScrape: 2,
+	}
+	for _, address := range []config.RegisterAddr{300001, 300002, 300003} {
+		module.Metrics = append(module.Metrics, config.MetricDef{
+			Name:       fmt.Sprintf("my_metric_%v", address),
+			Address:    address,
+			DataType:   config.ModbusInt16,
+			MetricType: config.MetricTypeGauge,
+		})
+	}
+
+	var logs bytes.Buffer
+	e := NewExporter(config.Config{Modules: []config.Module{module, {Name: "other_module", Metrics: module.Metrics[:2]}}})
+	e.Logger = log.NewLogfmtLogger(&logs)
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: newFakeClient(), close: func() error { return nil }}, nil
+	}
+
+	for _, test := range []struct {
+		module    string
+		metrics   int
+		truncated float64
+	}{
+		{"my_module", 2, 1},
+		{"other_module", 2, 0},
+	} {
+		reg, err := e.Scrape("localhost:502", 1, test.module)
+		if err != nil {
+			t.Fatal(err)
+		}
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(families) != test.metrics {
+			t.Fatalf("%v: expected %v metrics but got %v", test.module, test.metrics, len(families))
+		}
+		if v := testutil.ToFloat64(e.scrapeTruncated.WithLabelValues(test.module, "localhost:502", "1")); v != test.truncated {
+			t.Fatalf("%v: expected truncated to be %v but got %v", test.module, test.truncated, v)
+		}
+	}
+
+	if !strings.Contains(logs.String(), "level=warn") || !strings.Contains(logs.String(), "module=my_module") {
+		t.Fatalf("expected a warning about the truncated scrape but got %q", logs.String())
+	}
+}
+
+func TestMetricsParsedAndFailed(t *testing.T) {
+	module := config.Module{Name: "my_module", Protocol: config.ModbusProtocolTCPIP}
+	for _, address := range []config.RegisterAddr{300001, 300002, 300003} {
+		module.Metrics = append(module.Metrics, config.MetricDef{
+			Name:         fmt.Sprintf("my_metric_%v", address),
+			Address:      address,
+			DataType:     config.ModbusInt16,
+			MetricType:   config.MetricTypeGauge,
+			SuppressZero: true,
+			OnError:      config.OnErrorDrop,
+		})
+	}
+
+	// The zero read of the second metric fails and is dropped.
+	c := newFakeClient()
+	c.holdingRegisters[1] = 1
+	c.holdingRegisters[3] = 3
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	if _, err := e.Scrape("localhost:502", 1, "my_module"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := testutil.ToFloat64(e.metricsParsed.WithLabelValues("my_module", "localhost:502", "1")); v != 2 {
+		t.Errorf("expected 2 metrics parsed but got %v", v)
+	}
+	if v := testutil.ToFloat64(e.metricsFailed.WithLabelValues("my_module", "localhost:502", "1")); v != 1 {
+		t.Errorf("expected 1 metric failed but got %v", v)
+	}
+
+	// The gauges reflect the last scrape only.
+	c.holdingRegisters[2] = 2
+	if _, err := e.Scrape("localhost:502", 1, "my_module"); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(e.metricsFailed.WithLabelValues("my_module", "localhost:502", "1")); v != 0 {
+		t.Errorf("expected no metric failed but got %v", v)
+	}
+
+	// Values of bad quality count as failed.
+	module.Metrics[0].Quality = &config.Quality{Address: 300010}
+	e = NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+	if _, err := e.Scrape("localhost:502", 1, "my_module"); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(e.metricsFailed.WithLabelValues("my_module", "localhost:502", "1")); v != 1 {
+		t.Errorf("expected the metric of bad quality to fail but got %v", v)
+	}
+}
 
 func TestScaleValue(t *testing.T) {
 	tests := []struct {
@@ -594,4 +871,1922 @@ func TestScaleValue(t *testing.T) {
 
 func floatPtr(f float64) *float64 {
 	return &f
-}
\ No newline at end of file
+}
+
+// startFakeServer starts an in-process modbus TCP server on a free local port
+// and returns it along with its address.
+func startFakeServer(t *testing.T) (*mbserver.Server, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	serv := mbserver.NewServer()
+	if err := serv.ListenTCP(address); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(serv.Close)
+
+	return serv, address
+}
+
+func TestLastScrapeSuccessTimestamp(t *testing.T) {
+	serv, address := startFakeServer(t)
+	serv.HoldingRegisters[1] = 42
+
+	e := NewExporter(config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "my_module",
+				Protocol: config.ModbusProtocolTCPIP,
+				Metrics: []config.MetricDef{
+					{
+						Name:       "my_metric",
+						Address:    300001,
+						DataType:   config.ModbusInt16,
+						MetricType: config.MetricTypeGauge,
+					},
+				},
+			},
+		},
+	})
+	now := time.Unix(1000, 0)
+	e.now = func() time.Time { return now }
+	timestamp := e.lastScrapeSuccess.WithLabelValues("my_module", address, "1")
+
+	if _, err := e.Scrape(address, 1, "my_module"); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(timestamp); v != 1000 {
+		t.Fatalf("expected timestamp 1000 but got %v", v)
+	}
+
+	now = time.Unix(2000, 0)
+	if _, err := e.Scrape(address, 1, "my_module"); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(timestamp); v != 2000 {
+		t.Fatalf("expected timestamp to advance to 2000 but got %v", v)
+	}
+
+	serv.Close()
+	now = time.Unix(3000, 0)
+	if _, err := e.Scrape(address, 1, "my_module"); err == nil {
+		t.Fatal("expected scrape to fail")
+	}
+	if v := testutil.ToFloat64(timestamp); v != 2000 {
+		t.Fatalf("expected timestamp to stay at 2000 but got %v", v)
+	}
+}
+
+func TestApplyTransformationsRange(t *testing.T) {
+	def := config.MetricDef{
+		DataType: config.ModbusUInt16,
+		Range: &config.RangeMapping{
+			RawMin: 0,
+			RawMax: 27648,
+			EngMin: 0,
+			EngMax: 100,
+		},
+	}
+
+	for _, test := range []struct {
+		name     string
+		raw      float64
+		expected float64
+	}{
+		{"lower bound", 0, 0},
+		{"midpoint", 13824, 50},
+		{"upper bound", 27648, 100},
+		{"above range is clamped", 30000, 100},
+		{"below range is clamped", -100, 0},
+	} {
+		if v := applyTransformations(def, test.raw); v != test.expected {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, v)
+		}
+	}
+
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, 13824)
+	v, err := parseModbusData(def, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 50 {
+		t.Fatalf("expected 50 but got %v", v)
+	}
+}
+
+func TestApplyTransformationsMulDivOffset(t *testing.T) {
+	mul, div, offset := 1.0, 10.0, -5.0
+
+	for _, test := range []struct {
+		name       string
+		definition config.MetricDef
+		raw        float64
+		expected   float64
+	}{
+		{
+			name:       "mul, div and offset",
+			definition: config.MetricDef{Mul: &mul, Div: &div, Offset: &offset},
+			raw:        250,
+			expected:   20,
+		},
+		{
+			name:       "div only",
+			definition: config.MetricDef{Div: &div},
+			raw:        250,
+			expected:   25,
+		},
+		{
+			name:       "offset only",
+			definition: config.MetricDef{Offset: &offset},
+			raw:        250,
+			expected:   245,
+		},
+	} {
+		if v := applyTransformations(test.definition, test.raw); v != test.expected {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, v)
+		}
+	}
+
+	// A sign register negates the raw value before the vendor scaling.
+	def := negate(config.MetricDef{DataType: config.ModbusUInt16, Mul: &mul, Div: &div, Offset: &offset})
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, 250)
+	v, err := parseModbusData(def, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != -30 {
+		t.Fatalf("expected -30 but got %v", v)
+	}
+}
+
+func TestApplyTransformationsUnit(t *testing.T) {
+	factor := 0.1
+	for _, test := range []struct {
+		name       string
+		definition config.MetricDef
+		raw        float64
+		expected   float64
+	}{
+		{
+			name:       "minutes to seconds",
+			definition: config.MetricDef{SourceUnit: config.DurationUnitMinutes, Unit: config.DurationUnitSeconds},
+			raw:        5,
+			expected:   300,
+		},
+		{
+			name:       "hours to default seconds",
+			definition: config.MetricDef{SourceUnit: config.DurationUnitHours},
+			raw:        2,
+			expected:   7200,
+		},
+		{
+			name:       "milliseconds to seconds",
+			definition: config.MetricDef{SourceUnit: config.DurationUnitMilliseconds, Unit: config.DurationUnitSeconds},
+			raw:        1500,
+			expected:   1.5,
+		},
+		{
+			name:       "seconds to hours",
+			definition: config.MetricDef{SourceUnit: config.DurationUnitSeconds, Unit: config.DurationUnitHours},
+			raw:        5400,
+			expected:   1.5,
+		},
+		{
+			name:       "scaled tenths of minutes to seconds",
+			definition: config.MetricDef{Factor: &factor, SourceUnit: config.DurationUnitMinutes, Unit: config.DurationUnitSeconds},
+			raw:        25,
+			expected:   150,
+		},
+	} {
+		if v := applyTransformations(test.definition, test.raw); v != test.expected {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, v)
+		}
+	}
+}
+
+func TestParseModbusDataBitWidth(t *testing.T) {
+	four := 4
+	twelve := 12
+	twentyFour := 24
+
+	for _, test := range []struct {
+		name     string
+		def      config.MetricDef
+		data     []byte
+		expected float64
+	}{
+		{
+			"12 bit signed all ones",
+			config.MetricDef{DataType: config.ModbusInt16, BitWidth: &twelve},
+			[]byte{0x0F, 0xFF},
+			-1,
+		},
+		{
+			"12 bit signed maximum",
+			config.MetricDef{DataType: config.ModbusInt16, BitWidth: &twelve},
+			[]byte{0x07, 0xFF},
+			2047,
+		},
+		{
+			"12 bit signed minimum ignoring upper bits",
+			config.MetricDef{DataType: config.ModbusInt16, BitWidth: &twelve},
+			[]byte{0xF8, 0x00},
+			-2048,
+		},
+		{
+			"12 bit unsigned",
+			config.MetricDef{DataType: config.ModbusUInt16, BitWidth: &twelve},
+			[]byte{0xFF, 0xFF},
+			4095,
+		},
+		{
+			"12 bit signed at offset",
+			config.MetricDef{DataType: config.ModbusInt16, BitOffset: &four, BitWidth: &twelve},
+			[]byte{0xFF, 0xEA},
+			-2,
+		},
+		{
+			"24 bit signed",
+			config.MetricDef{DataType: config.ModbusInt32, BitWidth: &twentyFour},
+			[]byte{0x00, 0xFF, 0xFF, 0xFE},
+			-2,
+		},
+	} {
+		v, err := parseModbusData(test.def, test.data)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if v != test.expected {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, v)
+		}
+	}
+}
+
+func TestParseModbusDataZeroOffset(t *testing.T) {
+	midpoint := uint64(0x8000)
+	midpoint32 := uint64(0x80000000)
+	factor := 0.5
+	bias := 1.0
+
+	for _, test := range []struct {
+		name     string
+		def      config.MetricDef
+		data     []byte
+		expected float64
+	}{
+		{"midpoint", config.MetricDef{DataType: config.ModbusUInt16, ZeroOffset: &midpoint}, []byte{0x80, 0x00}, 0},
+		{"above midpoint", config.MetricDef{DataType: config.ModbusUInt16, ZeroOffset: &midpoint}, []byte{0x80, 0x01}, 1},
+		{"below midpoint", config.MetricDef{DataType: config.ModbusUInt16, ZeroOffset: &midpoint}, []byte{0x7F, 0xFF}, -1},
+		{"minimum", config.MetricDef{DataType: config.ModbusUInt16, ZeroOffset: &midpoint}, []byte{0x00, 0x00}, -32768},
+		{"maximum", config.MetricDef{DataType: config.ModbusUInt16, ZeroOffset: &midpoint}, []byte{0xFF, 0xFF}, 32767},
+		{"32 bit", config.MetricDef{DataType: config.ModbusUInt32, ZeroOffset: &midpoint32}, []byte{0x7F, 0xFF, 0xFF, 0xFE}, -2},
+		{
+			"with factor and bias",
+			config.MetricDef{DataType: config.ModbusUInt16, ZeroOffset: &midpoint, Factor: &factor, Bias: &bias},
+			[]byte{0x80, 0x0A},
+			4,
+		},
+	} {
+		v, err := parseModbusData(test.def, test.data)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if v != test.expected {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, v)
+		}
+	}
+}
+
+func TestParseModbusDataMask(t *testing.T) {
+	mask := uint64(0x0FFF)
+	mask32 := uint64(0x00FFFFFF)
+	fieldMask := uint64(0x0F0F)
+	offset, width := 4, 8
+	factor := 0.1
+
+	for _, test := range []struct {
+		name     string
+		def      config.MetricDef
+		data     []byte
+		expected float64
+	}{
+		{"reserved bits cleared", config.MetricDef{DataType: config.ModbusUInt16, Mask: &mask}, []byte{0xF1, 0x23}, 0x0123},
+		// Masking clears the sign bit before sign interpretation.
+		{"signed", config.MetricDef{DataType: config.ModbusInt16, Mask: &mask}, []byte{0xF1, 0x23}, 0x0123},
+		{"32 bit", config.MetricDef{DataType: config.ModbusUInt32, Mask: &mask32}, []byte{0xAB, 0x00, 0x00, 0x10}, 16},
+		// The bit field is extracted from the masked value.
+		{
+			"before bit field",
+			config.MetricDef{DataType: config.ModbusUInt16, Mask: &fieldMask, BitOffset: &offset, BitWidth: &width},
+			[]byte{0xF1, 0x23},
+			0x10,
+		},
+		{
+			"before scaling",
+			config.MetricDef{DataType: config.ModbusUInt16, Mask: &mask, Factor: &factor},
+			[]byte{0xF0, 0x64},
+			10,
+		},
+	} {
+		v, err := parseModbusData(test.def, test.data)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if v != test.expected {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, v)
+		}
+	}
+}
+
+func TestParseModbusDataByteOrder(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		def      config.MetricDef
+		data     []byte
+		expected float64
+	}{
+		{"uint32 2301", config.MetricDef{DataType: config.ModbusUInt32, ByteOrder: "2301"}, []byte{0x00, 0x02, 0x00, 0x01}, 0x00010002},
+		{"float32 2301", config.MetricDef{DataType: config.ModbusFloat32, ByteOrder: "2301"}, []byte{0x00, 0x00, 0x41, 0x20}, 10},
+		{"int32 3012", config.MetricDef{DataType: config.ModbusInt32, ByteOrder: "3012"}, []byte{0xFF, 0xFF, 0xFE, 0xFF}, -2},
+		{"uint16 10", config.MetricDef{DataType: config.ModbusUInt16, ByteOrder: "10"}, []byte{0x34, 0x12}, 0x1234},
+	} {
+		v, err := parseModbusData(test.def, test.data)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if v != test.expected {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, v)
+		}
+	}
+}
+
+func TestParseModbusDataWordOrder(t *testing.T) {
+	for _, test := range []struct {
+		byteOrder  string
+		wordOrder  config.Order
+		endianness config.EndiannessType
+		data       []byte
+	}{
+		{"big", config.OrderBig, config.EndiannessBigEndian, []byte{0x01, 0x02, 0x03, 0x04}},
+		{"little", config.OrderBig, config.EndiannessMixedEndian, []byte{0x02, 0x01, 0x04, 0x03}},
+		{"big", config.OrderLittle, config.EndiannessYolo, []byte{0x03, 0x04, 0x01, 0x02}},
+		{"little", config.OrderLittle, config.EndiannessLittleEndian, []byte{0x04, 0x03, 0x02, 0x01}},
+	} {
+		name := fmt.Sprintf("byte order %v, word order %v", test.byteOrder, test.wordOrder)
+
+		v, err := parseModbusData(config.MetricDef{DataType: config.ModbusUInt32, ByteOrder: test.byteOrder, WordOrder: test.wordOrder}, test.data)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if v != 0x01020304 {
+			t.Errorf("%v: expected %v but got %v", name, 0x01020304, v)
+		}
+
+		// The named endianness types are aliases of the combinations.
+		alias, err := parseModbusData(config.MetricDef{DataType: config.ModbusUInt32, Endianness: test.endianness}, test.data)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if alias != v {
+			t.Errorf("%v: expected endianness %v to decode %v but got %v", name, test.endianness, v, alias)
+		}
+	}
+
+	// A word order alone defaults the byte order to big, covering all words
+	// of 64 bit values.
+	v, err := parseModbusData(config.MetricDef{DataType: config.ModbusUInt64, WordOrder: config.OrderLittle},
+		[]byte{0x07, 0x08, 0x05, 0x06, 0x03, 0x04, 0x01, 0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 0x0102030405060708 {
+		t.Errorf("expected %v but got %v", 0x0102030405060708, v)
+	}
+}
+
+func TestParseModbusDataCoefficients(t *testing.T) {
+	factor := 2.0
+	bias := 2.0
+
+	for _, test := range []struct {
+		name     string
+		def      config.MetricDef
+		data     []byte
+		expected float64
+	}{
+		{"polynomial", config.MetricDef{DataType: config.ModbusUInt16, Coefficients: []float64{1, 2, 3}}, []byte{0x00, 0x02}, 17},
+		{"constant", config.MetricDef{DataType: config.ModbusUInt16, Coefficients: []float64{5}}, []byte{0x00, 0x02}, 5},
+		{"negative value", config.MetricDef{DataType: config.ModbusInt16, Coefficients: []float64{0, 0, 0, 1}}, []byte{0xFF, 0xFE}, -8},
+		// Factor and bias are applied first, yielding x = 2.
+		{"after factor", config.MetricDef{DataType: config.ModbusUInt16, Factor: &factor, Coefficients: []float64{1, 2, 3}}, []byte{0x00, 0x01}, 17},
+		{"after bias", config.MetricDef{DataType: config.ModbusUInt16, Bias: &bias, Coefficients: []float64{1, 2, 3}}, []byte{0x00, 0x04}, 17},
+	} {
+		v, err := parseModbusData(test.def, test.data)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if v != test.expected {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, v)
+		}
+	}
+}
+
+func TestParseModbusDataPopcount(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		def      config.MetricDef
+		data     []byte
+		expected float64
+	}{
+		{"uint16", config.MetricDef{DataType: config.ModbusUInt16, Popcount: true}, []byte{0x00, 0b1011}, 3},
+		{"little endian", config.MetricDef{DataType: config.ModbusUInt16, Endianness: config.EndiannessLittleEndian, Popcount: true}, []byte{0b1011, 0x00}, 3},
+		{"uint32", config.MetricDef{DataType: config.ModbusUInt32, Popcount: true}, []byte{0x80, 0x00, 0x01, 0xFF}, 10},
+		{"uint64 all set", config.MetricDef{DataType: config.ModbusUInt64, Popcount: true}, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, 64},
+		{"none set", config.MetricDef{DataType: config.ModbusUInt16, Popcount: true}, []byte{0x00, 0x00}, 0},
+	} {
+		v, err := parseModbusData(test.def, test.data)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if v != test.expected {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, v)
+		}
+	}
+
+	_, err := parseModbusData(config.MetricDef{DataType: config.ModbusUInt32, Popcount: true}, []byte{0x00, 0b1011})
+	var insufficientErr *InsufficientRegistersError
+	if !errors.As(err, &insufficientErr) {
+		t.Fatalf("expected insufficient registers error but got %v", err)
+	}
+}
+
+func TestParseModbusDataPercent(t *testing.T) {
+	hundred := 100.0
+	thousand := 1000.0
+
+	for _, test := range []struct {
+		name     string
+		def      config.MetricDef
+		data     []byte
+		expected float64
+	}{
+		{"hundredths", config.MetricDef{DataType: config.ModbusUInt16, PercentDenominator: &hundred}, []byte{0x13, 0x88}, 50},
+		{"tenths of percent", config.MetricDef{DataType: config.ModbusUInt16, PercentDenominator: &thousand}, []byte{0x01, 0xF4}, 0.5},
+		{"clamped above", config.MetricDef{DataType: config.ModbusUInt16, PercentDenominator: &hundred}, []byte{0x2E, 0xE0}, 100},
+		{"clamped below", config.MetricDef{DataType: config.ModbusInt16, PercentDenominator: &hundred}, []byte{0xFF, 0x9C}, 0},
+	} {
+		v, err := parseModbusData(test.def, test.data)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if v != test.expected {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, v)
+		}
+	}
+}
+
+func TestScrapeMetricsFallbackAddresses(t *testing.T) {
+	definitions := []config.MetricDef{
+		{
+			Name:              "firmware_dependent",
+			Address:           300001,
+			FallbackAddresses: []config.RegisterAddr{300010, 300020},
+			DataType:          config.ModbusUInt16,
+			MetricType:        config.MetricTypeGauge,
+		},
+	}
+
+	for _, test := range []struct {
+		name             string
+		failing          map[uint16]error
+		expected         float64
+		expectedRequests []fakeRequest
+		expectedErr      bool
+		// expectedAddress is the address the read is reported against.
+		expectedAddress config.RegisterAddr
+	}{
+		{
+			name:             "first address",
+			expected:         1,
+			expectedRequests: []fakeRequest{{modbus.FuncCodeReadHoldingRegisters, 1, 1}},
+			expectedAddress:  300001,
+		},
+		{
+			name: "second address",
+			failing: map[uint16]error{
+				1: &modbus.ModbusError{FunctionCode: 0x83, ExceptionCode: modbus.ExceptionCodeIllegalDataAddress},
+			},
+			expected: 10,
+			expectedRequests: []fakeRequest{
+				{modbus.FuncCodeReadHoldingRegisters, 1, 1},
+				{modbus.FuncCodeReadHoldingRegisters, 10, 1},
+			},
+			expectedAddress: 300010,
+		},
+		{
+			name: "all addresses failing",
+			failing: map[uint16]error{
+				1:  &modbus.ModbusError{FunctionCode: 0x83, ExceptionCode: modbus.ExceptionCodeIllegalDataAddress},
+				10: &modbus.ModbusError{FunctionCode: 0x83, ExceptionCode: modbus.ExceptionCodeIllegalDataAddress},
+				20: &modbus.ModbusError{FunctionCode: 0x83, ExceptionCode: modbus.ExceptionCodeIllegalDataAddress},
+			},
+			expectedRequests: []fakeRequest{
+				{modbus.FuncCodeReadHoldingRegisters, 1, 1},
+				{modbus.FuncCodeReadHoldingRegisters, 10, 1},
+				{modbus.FuncCodeReadHoldingRegisters, 20, 1},
+			},
+			expectedErr:     true,
+			expectedAddress: 300020,
+		},
+		{
+			name: "no fallback on other errors",
+			failing: map[uint16]error{
+				1: fmt.Errorf("i/o timeout"),
+			},
+			expectedRequests: []fakeRequest{{modbus.FuncCodeReadHoldingRegisters, 1, 1}},
+			expectedErr:      true,
+			expectedAddress:  300001,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newFakeClient()
+			c.holdingRegisters[1] = 1
+			c.holdingRegisters[10] = 10
+			c.holdingRegisters[20] = 20
+			c.fail = func(r fakeRequest) error {
+				return test.failing[r.address]
+			}
+
+			var observed config.RegisterAddr
+			metrics, err := scrapeObservedMetrics(definitions, c, func(name string, address config.RegisterAddr, err error) {
+				observed = address
+			})
+			if test.expectedErr {
+				if err == nil {
+					t.Fatal("expected scrape to fail")
+				}
+				if expected := fmt.Sprintf("address '%v'", test.expectedAddress); !strings.Contains(err.Error(), expected) {
+					t.Fatalf("expected error to contain %q but got %v", expected, err)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(metrics) != 1 || metrics[0].Value != test.expected {
+					t.Fatalf("expected value %v but got %v", test.expected, metrics)
+				}
+			}
+
+			if r := c.recorded(); !reflect.DeepEqual(r, test.expectedRequests) {
+				t.Fatalf("expected requests %v but got %v", test.expectedRequests, r)
+			}
+			if observed != test.expectedAddress {
+				t.Fatalf("expected read of address %v to be observed but got %v", test.expectedAddress, observed)
+			}
+		})
+	}
+}
+
+func TestScrapeMetricsDerived(t *testing.T) {
+	zero, seven, eight := 0, 7, 8
+	definitions := []config.MetricDef{
+		{
+			Name:       "level_percent",
+			Address:    300001,
+			DataType:   config.ModbusUInt16,
+			MetricType: config.MetricTypeGauge,
+			BitOffset:  &zero,
+			BitWidth:   &eight,
+			Derived: []config.MetricDef{
+				{
+					Name:       "level_alarm",
+					DataType:   config.ModbusBool,
+					MetricType: config.MetricTypeGauge,
+					BitOffset:  &seven,
+				},
+				{
+					Name:       "level_state",
+					DataType:   config.ModbusUInt16,
+					MetricType: config.MetricTypeGauge,
+					BitOffset:  &eight,
+					BitWidth:   &eight,
+				},
+			},
+		},
+	}
+
+	c := newFakeClient()
+	// Status bits in the high byte, the reading in the low byte.
+	c.holdingRegisters[1] = 0x8132
+
+	metrics, err := scrapeMetrics(definitions, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]float64{"level_percent": 50, "level_alarm": 1, "level_state": 0x81}
+	if len(metrics) != len(expected) {
+		t.Fatalf("expected %v metrics but got %v", len(expected), metrics)
+	}
+	for _, m := range metrics {
+		if v, ok := expected[m.Name]; !ok || m.Value != v {
+			t.Errorf("expected %v to be %v but got %v", m.Name, v, m.Value)
+		}
+	}
+
+	// The register is read once for all metrics.
+	expectedRequests := []fakeRequest{{modbus.FuncCodeReadHoldingRegisters, 1, 1}}
+	if r := c.recorded(); fmt.Sprint(r) != fmt.Sprint(expectedRequests) {
+		t.Fatalf("expected requests %v but got %v", expectedRequests, r)
+	}
+}
+
+func TestScrapeMetricsSignRegister(t *testing.T) {
+	for _, test := range []struct {
+		sign     uint16
+		expected float64
+	}{
+		{sign: 0, expected: 100},
+		{sign: 1, expected: -100},
+	} {
+		t.Run(fmt.Sprint(test.sign), func(t *testing.T) {
+			sign := config.RegisterAddr(300011)
+			factor := 0.5
+			definitions := []config.MetricDef{
+				{
+					Name:         "power_watts",
+					Address:      300010,
+					DataType:     config.ModbusUInt16,
+					MetricType:   config.MetricTypeGauge,
+					SignRegister: &sign,
+				},
+				{
+					Name:         "half_power_watts",
+					Address:      300010,
+					DataType:     config.ModbusUInt16,
+					MetricType:   config.MetricTypeGauge,
+					Factor:       &factor,
+					SignRegister: &sign,
+				},
+			}
+
+			c := newFakeClient()
+			c.holdingRegisters[10] = 100
+			c.holdingRegisters[11] = test.sign
+
+			metrics, err := scrapeMetrics(definitions, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if v := metrics[0].Value; v != test.expected {
+				t.Fatalf("expected %v but got %v", test.expected, v)
+			}
+			if v := metrics[1].Value; v != test.expected/2 {
+				t.Fatalf("expected %v with factor but got %v", test.expected/2, v)
+			}
+		})
+	}
+}
+
+func TestScrapeMetricsOffsetRegister(t *testing.T) {
+	tare := config.RegisterAddr(300011)
+	sign := config.RegisterAddr(300012)
+	factor := 0.1
+	definitions := []config.MetricDef{
+		{
+			Name:           "load_kilograms",
+			Address:        300010,
+			DataType:       config.ModbusUInt16,
+			MetricType:     config.MetricTypeGauge,
+			Factor:         &factor,
+			OffsetRegister: &tare,
+		},
+		{
+			Name:           "signed_load_kilograms",
+			Address:        300010,
+			DataType:       config.ModbusUInt16,
+			MetricType:     config.MetricTypeGauge,
+			Factor:         &factor,
+			OffsetRegister: &tare,
+			SignRegister:   &sign,
+		},
+	}
+
+	c := newFakeClient()
+	c.holdingRegisters[10] = 1000
+	c.holdingRegisters[11] = 200
+	c.holdingRegisters[12] = 1
+
+	metrics, err := scrapeMetrics(definitions, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := metrics[0].Value; math.Abs(v-80) > 1e-9 {
+		t.Fatalf("expected 80 but got %v", v)
+	}
+	// The offset is subtracted from the negated value.
+	if v := metrics[1].Value; math.Abs(v+120) > 1e-9 {
+		t.Fatalf("expected -120 with sign but got %v", v)
+	}
+
+	// The offset register is read before the metrics.
+	expected := []fakeRequest{
+		{modbus.FuncCodeReadHoldingRegisters, 12, 1},
+		{modbus.FuncCodeReadHoldingRegisters, 11, 1},
+		{modbus.FuncCodeReadHoldingRegisters, 10, 1},
+		{modbus.FuncCodeReadHoldingRegisters, 10, 1},
+	}
+	if !reflect.DeepEqual(c.recorded(), expected) {
+		t.Fatalf("expected requests %v but got %v", expected, c.recorded())
+	}
+}
+
+func TestScrapeMetricsFactorAndBiasRegisters(t *testing.T) {
+	definitions := []config.MetricDef{
+		{
+			Name:         "temperature_celsius",
+			Address:      300001,
+			DataType:     config.ModbusUInt16,
+			MetricType:   config.MetricTypeGauge,
+			BiasRegister: &config.RegisterValue{Address: 300010},
+		},
+		{
+			Name:           "pressure_bar",
+			Address:        300002,
+			DataType:       config.ModbusUInt16,
+			MetricType:     config.MetricTypeGauge,
+			FactorRegister: &config.RegisterValue{Address: 300011, DataType: config.ModbusFloat32},
+			BiasRegister:   &config.RegisterValue{Address: 300013},
+		},
+	}
+
+	c := newFakeClient()
+	c.holdingRegisters[1] = 250
+	c.holdingRegisters[2] = 100
+	c.holdingRegisters[10] = 5
+	// 0.5 as float32.
+	c.holdingRegisters[11] = 0x3F00
+	c.holdingRegisters[12] = 0x0000
+	// -2 stored as two's complement.
+	c.holdingRegisters[13] = 0xFFFE
+
+	metrics, err := scrapeMetrics(definitions, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The bias is subtracted from the value after applying the factor.
+	if v := metrics[0].Value; math.Abs(v-245) > 1e-9 {
+		t.Fatalf("expected 245 with bias register reading 5 but got %v", v)
+	}
+	if v := metrics[1].Value; math.Abs(v-52) > 1e-9 {
+		t.Fatalf("expected 52 with factor 0.5 and bias -2 but got %v", v)
+	}
+}
+
+func TestScrapeMetricsNaNMeansMissing(t *testing.T) {
+	definitions := []config.MetricDef{
+		{
+			Name:            "temperature_celsius",
+			Help:            "Temperature.",
+			Labels:          map[string]string{"sensor": "a"},
+			Address:         300001,
+			DataType:        config.ModbusFloat32,
+			MetricType:      config.MetricTypeGauge,
+			NaNMeansMissing: true,
+		},
+	}
+
+	present := func(v float64) metric {
+		return metric{
+			Name:       "temperature_celsius_present",
+			Help:       "Whether temperature_celsius holds a value, 0 if the device reported it missing as NaN.",
+			Labels:     map[string]string{"sensor": "a"},
+			Value:      v,
+			MetricType: config.MetricTypeGauge,
+		}
+	}
+
+	c := newFakeClient()
+
+	t.Run("missing", func(t *testing.T) {
+		c.holdingRegisters[1] = 0x7FC0
+		c.holdingRegisters[2] = 0x0000
+
+		metrics, err := scrapeMetrics(definitions, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []metric{present(0)}
+		if !reflect.DeepEqual(metrics, expected) {
+			t.Fatalf("expected %v but got %v", expected, metrics)
+		}
+	})
+
+	t.Run("present", func(t *testing.T) {
+		c.holdingRegisters[1] = 0x41AC
+		c.holdingRegisters[2] = 0x0000
+
+		metrics, err := scrapeMetrics(definitions, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []metric{
+			present(1),
+			{Name: "temperature_celsius", Help: "Temperature.", Labels: map[string]string{"sensor": "a"}, Value: 21.5, MetricType: config.MetricTypeGauge},
+		}
+		if !reflect.DeepEqual(metrics, expected) {
+			t.Fatalf("expected %v but got %v", expected, metrics)
+		}
+	})
+}
+
+func TestScrapeMetricsExportScaleApplied(t *testing.T) {
+	factor := 0.1
+	sf := config.RegisterAddr(400010)
+	definitions := []config.MetricDef{
+		{
+			Name:               "voltage_volts",
+			Labels:             map[string]string{"phase": "l1"},
+			Address:            300001,
+			DataType:           config.ModbusUInt16,
+			MetricType:         config.MetricTypeGauge,
+			Factor:             &factor,
+			ExportScaleApplied: true,
+		},
+		{
+			Name:               "ac_power_watts",
+			Address:            400001,
+			DataType:           config.ModbusUInt16,
+			MetricType:         config.MetricTypeGauge,
+			ScaleFactor:        &sf,
+			ExportScaleApplied: true,
+		},
+	}
+
+	c := newFakeClient()
+	c.holdingRegisters[1] = 2301
+	c.inputRegisters[1] = 1234
+	c.inputRegisters[10] = uint16(0xFFFE) // -2
+
+	metrics, err := scrapeMetrics(definitions, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]float64{
+		"voltage_volts":                230.1,
+		"voltage_volts_scale_applied":  0.1,
+		"ac_power_watts":               12.34,
+		"ac_power_watts_scale_applied": 0.01,
+	}
+	if len(metrics) != len(expected) {
+		t.Fatalf("expected %v metrics but got %v", len(expected), metrics)
+	}
+	for _, m := range metrics {
+		if math.Abs(m.Value-expected[m.Name]) > 1e-9 {
+			t.Errorf("expected %v to be %v but got %v", m.Name, expected[m.Name], m.Value)
+		}
+	}
+	if labels := metrics[1].Labels; !reflect.DeepEqual(labels, map[string]string{"phase": "l1"}) {
+		t.Errorf("expected scale_applied to keep the metric's labels but got %v", labels)
+	}
+}
+
+func TestScrapeMetricsExportRaw(t *testing.T) {
+	factor := 0.1
+	sf := config.RegisterAddr(400010)
+	definitions := []config.MetricDef{
+		{
+			Name:               "voltage_volts",
+			Address:            300001,
+			DataType:           config.ModbusUInt16,
+			MetricType:         config.MetricTypeGauge,
+			Factor:             &factor,
+			ExportRaw:          true,
+			ExportScaleApplied: true,
+		},
+		{
+			Name:        "ac_power_watts",
+			Address:     400001,
+			DataType:    config.ModbusInt16,
+			MetricType:  config.MetricTypeGauge,
+			ScaleFactor: &sf,
+			ExportRaw:   true,
+		},
+	}
+
+	c := newFakeClient()
+	c.holdingRegisters[1] = 2301
+	c.inputRegisters[1] = uint16(0xFB2E)  // -1234
+	c.inputRegisters[10] = uint16(0xFFFE) // -2
+
+	metrics, err := scrapeMetrics(definitions, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The raw and scaled values and the scale applied are consistent.
+	expected := map[string]float64{
+		"voltage_volts":               230.1,
+		"voltage_volts_raw":           2301,
+		"voltage_volts_scale_applied": 0.1,
+		"ac_power_watts":              -12.34,
+		"ac_power_watts_raw":          -1234,
+	}
+	if len(metrics) != len(expected) {
+		t.Fatalf("expected %v metrics but got %v", len(expected), metrics)
+	}
+	for _, m := range metrics {
+		if math.Abs(m.Value-expected[m.Name]) > 1e-9 {
+			t.Errorf("expected %v to be %v but got %v", m.Name, expected[m.Name], m.Value)
+		}
+	}
+}
+
+func TestScrapeMetricsPrecision(t *testing.T) {
+	factor := 0.001
+	precision := 2
+
+	for _, test := range []struct {
+		mode     config.RoundingMode
+		raw      uint16
+		expected float64
+	}{
+		{"", 2345, 2.35},
+		{config.RoundingNearest, 2345, 2.35},
+		{config.RoundingFloor, 2345, 2.34},
+		{config.RoundingCeil, 2345, 2.35},
+		{config.RoundingTruncate, 2345, 2.34},
+		{config.RoundingBankers, 2345, 2.34},
+		{config.RoundingBankers, 2355, 2.36},
+		{config.RoundingFloor, 0xF6D7, -2.35}, // -2345
+		{config.RoundingTruncate, 0xF6D7, -2.34},
+	} {
+		definitions := []config.MetricDef{
+			{
+				Name:         "pressure_bar",
+				Address:      300001,
+				DataType:     config.ModbusInt16,
+				MetricType:   config.MetricTypeGauge,
+				Factor:       &factor,
+				Precision:    &precision,
+				RoundingMode: test.mode,
+			},
+		}
+
+		c := newFakeClient()
+		c.holdingRegisters[1] = test.raw
+
+		metrics, err := scrapeMetrics(definitions, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != 1 || metrics[0].Value != test.expected {
+			t.Errorf("%q: expected %v to round to %v but got %v", test.mode, test.raw, test.expected, metrics)
+		}
+	}
+}
+
+func TestScrapeMetricsQuality(t *testing.T) {
+	bit := 15
+	definitions := []config.MetricDef{
+		{
+			Name:       "flow_rate",
+			Address:    300010,
+			DataType:   config.ModbusUInt16,
+			MetricType: config.MetricTypeGauge,
+			OnError:    config.OnErrorNaN,
+			Quality:    &config.Quality{Address: 300011, Bit: &bit},
+		},
+		{
+			Name:       "level",
+			Address:    300012,
+			DataType:   config.ModbusUInt16,
+			MetricType: config.MetricTypeGauge,
+			OnError:    config.OnErrorDrop,
+			Quality:    &config.Quality{Address: 300013, Inverted: true},
+		},
+	}
+
+	quality := func(name string, v float64) metric {
+		return metric{
+			Name:       "modbus_value_quality",
+			Help:       "Quality of the value of a metric as per its quality flag, 1 if good and 0 if bad.",
+			Labels:     map[string]string{"metric": name},
+			Value:      v,
+			MetricType: config.MetricTypeGauge,
+		}
+	}
+
+	c := newFakeClient()
+	c.holdingRegisters[10] = 42
+	c.holdingRegisters[12] = 7
+
+	t.Run("good", func(t *testing.T) {
+		c.holdingRegisters[11] = 0x8000
+		c.holdingRegisters[13] = 0
+
+		metrics, err := scrapeMetrics(definitions, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []metric{
+			quality("flow_rate", 1),
+			{Name: "flow_rate", Value: 42, MetricType: config.MetricTypeGauge},
+			quality("level", 1),
+			{Name: "level", Value: 7, MetricType: config.MetricTypeGauge},
+		}
+		if !reflect.DeepEqual(metrics, expected) {
+			t.Fatalf("expected %v but got %v", expected, metrics)
+		}
+	})
+
+	t.Run("bad", func(t *testing.T) {
+		c.holdingRegisters[11] = 0x7FFF
+		c.holdingRegisters[13] = 1
+		c.requests = nil
+
+		metrics, err := scrapeMetrics(definitions, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The value of bad quality is exported as NaN, respectively dropped.
+		if len(metrics) != 3 {
+			t.Fatalf("expected 3 metrics but got %v", metrics)
+		}
+		for i, expected := range []metric{quality("flow_rate", 0), quality("level", 0)} {
+			if m := metrics[2*i]; !reflect.DeepEqual(m, expected) {
+				t.Fatalf("expected %v but got %v", expected, m)
+			}
+		}
+		if m := metrics[1]; m.Name != "flow_rate" || !math.IsNaN(m.Value) {
+			t.Fatalf("expected flow_rate of NaN but got %v", m)
+		}
+
+		// Values of bad quality are not read.
+		expectedRequests := []fakeRequest{
+			{modbus.FuncCodeReadHoldingRegisters, 11, 1},
+			{modbus.FuncCodeReadHoldingRegisters, 13, 1},
+		}
+		if r := c.recorded(); !reflect.DeepEqual(r, expectedRequests) {
+			t.Fatalf("expected requests %v but got %v", expectedRequests, r)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		failing := []config.MetricDef{definitions[0]}
+		failing[0].OnError = config.OnErrorFail
+
+		if _, err := scrapeMetrics(failing, c); err == nil {
+			t.Fatal("expected scrape of bad quality value to fail")
+		}
+	})
+}
+
+func TestScrapeMetricsScaleFactor(t *testing.T) {
+	sf := config.RegisterAddr(400010)
+	definitions := []config.MetricDef{
+		{
+			Name:        "ac_power_watts",
+			Address:     400001,
+			DataType:    config.ModbusUInt16,
+			MetricType:  config.MetricTypeGauge,
+			ScaleFactor: &sf,
+		},
+		{
+			Name:        "ac_power_limit_watts",
+			Address:     400002,
+			DataType:    config.ModbusUInt16,
+			MetricType:  config.MetricTypeGauge,
+			ScaleFactor: &sf,
+		},
+	}
+
+	c := newFakeClient()
+	c.inputRegisters[1] = 1234
+	c.inputRegisters[2] = 5000
+	c.inputRegisters[10] = uint16(0xFFFF) // -1
+
+	metrics, err := scrapeMetrics(definitions, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []float64{123.4, 500} {
+		if math.Abs(metrics[i].Value-expected) > 1e-9 {
+			t.Errorf("expected %v to be %v but got %v", metrics[i].Name, expected, metrics[i].Value)
+		}
+	}
+
+	// The scale factor register is read once, before the metrics.
+	expectedRequests := []fakeRequest{
+		{modbus.FuncCodeReadInputRegisters, 10, 1},
+		{modbus.FuncCodeReadInputRegisters, 1, 1},
+		{modbus.FuncCodeReadInputRegisters, 2, 1},
+	}
+	if r := c.recorded(); fmt.Sprint(r) != fmt.Sprint(expectedRequests) {
+		t.Fatalf("expected requests %v but got %v", expectedRequests, r)
+	}
+}
+
+func TestScrapeMetricsScaleFactorNotImplemented(t *testing.T) {
+	sf := config.RegisterAddr(400010)
+	definitions := []config.MetricDef{
+		{
+			Name:        "ac_power_watts",
+			Address:     400001,
+			DataType:    config.ModbusUInt16,
+			MetricType:  config.MetricTypeGauge,
+			ScaleFactor: &sf,
+			OnError:     config.OnErrorDrop,
+		},
+		{
+			Name:        "ac_power_limit_watts",
+			Address:     400002,
+			DataType:    config.ModbusUInt16,
+			MetricType:  config.MetricTypeGauge,
+			ScaleFactor: &sf,
+			OnError:     config.OnErrorNaN,
+		},
+	}
+
+	c := newFakeClient()
+	c.inputRegisters[1] = 1234
+	c.inputRegisters[2] = 5000
+	c.inputRegisters[10] = 0x8000
+
+	metrics, err := scrapeMetrics(definitions, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 || metrics[0].Name != "ac_power_limit_watts" || !math.IsNaN(metrics[0].Value) {
+		t.Fatalf("expected only ac_power_limit_watts to be exported as NaN but got %v", metrics)
+	}
+
+	definitions[0].OnError = config.OnErrorFail
+	if _, err := scrapeMetrics(definitions, c); err == nil {
+		t.Fatal("expected scrape to fail")
+	}
+}
+
+func TestScrapeMetricsTimestamp(t *testing.T) {
+	definitions := []config.MetricDef{
+		{
+			Name:       "temperature_celsius",
+			Address:    400001,
+			DataType:   config.ModbusInt16,
+			MetricType: config.MetricTypeGauge,
+			Timestamp: &config.TimestampSource{
+				Address:  400010,
+				DataType: config.ModbusUInt32,
+				Unit:     "s",
+			},
+		},
+		{
+			Name:       "humidity_percent",
+			Address:    400002,
+			DataType:   config.ModbusInt16,
+			MetricType: config.MetricTypeGauge,
+		},
+	}
+
+	c := newFakeClient()
+	c.inputRegisters[1] = 21
+	c.inputRegisters[2] = 40
+	// 1600000000 = 0x5F5E1000
+	c.inputRegisters[10] = 0x5F5E
+	c.inputRegisters[11] = 0x1000
+
+	metrics, err := scrapeMetrics(definitions, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ts := metrics[0].Timestamp; !ts.Equal(time.Unix(1600000000, 0)) {
+		t.Fatalf("expected timestamp %v but got %v", time.Unix(1600000000, 0), ts)
+	}
+	if ts := metrics[1].Timestamp; !ts.IsZero() {
+		t.Fatalf("expected no timestamp but got %v", ts)
+	}
+
+	reg := prometheus.NewRegistry()
+	if _, err := registerMetrics(reg, "my_module", metrics, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	metricFamilies, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamps := map[string]int64{}
+	for _, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			timestamps[mf.GetName()] = m.GetTimestampMs()
+		}
+	}
+	if ts := timestamps["temperature_celsius"]; ts != 1600000000000 {
+		t.Fatalf("expected exposed timestamp 1600000000000 but got %v", ts)
+	}
+	if ts := timestamps["humidity_percent"]; ts != 0 {
+		t.Fatalf("expected no exposed timestamp but got %v", ts)
+	}
+}
+
+func TestParseModbusDataFloat16(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		data       []byte
+		endianness config.EndiannessType
+		expected   float64
+	}{
+		{"one", []byte{0x3C, 0x00}, config.EndiannessBigEndian, 1},
+		{"minus two", []byte{0xC0, 0x00}, config.EndiannessBigEndian, -2},
+		{"fraction", []byte{0x35, 0x55}, config.EndiannessBigEndian, 0.333251953125},
+		{"largest normal", []byte{0x7B, 0xFF}, config.EndiannessBigEndian, 65504},
+		{"smallest subnormal", []byte{0x00, 0x01}, config.EndiannessBigEndian, math.Ldexp(1, -24)},
+		{"largest subnormal", []byte{0x03, 0xFF}, config.EndiannessBigEndian, math.Ldexp(1023, -24)},
+		{"negative zero", []byte{0x80, 0x00}, config.EndiannessBigEndian, math.Copysign(0, -1)},
+		{"infinity", []byte{0x7C, 0x00}, config.EndiannessBigEndian, math.Inf(1)},
+		{"negative infinity", []byte{0xFC, 0x00}, config.EndiannessBigEndian, math.Inf(-1)},
+		{"little endian", []byte{0x00, 0x3C}, config.EndiannessLittleEndian, 1},
+	} {
+		def := config.MetricDef{DataType: config.ModbusFloat16, Endianness: test.endianness}
+		v, err := parseModbusData(def, test.data)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if v != test.expected || math.Signbit(v) != math.Signbit(test.expected) {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, v)
+		}
+	}
+
+	v, err := parseModbusData(config.MetricDef{DataType: config.ModbusFloat16}, []byte{0x7E, 0x00})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsNaN(v) {
+		t.Fatalf("expected NaN but got %v", v)
+	}
+}
+
+func TestScrapeMetricsSuppressZero(t *testing.T) {
+	c := newFakeClient()
+	c.holdingRegisters[1] = 0
+	c.holdingRegisters[2] = 0
+	c.holdingRegisters[3] = 5
+
+	for _, test := range []struct {
+		name        string
+		definition  config.MetricDef
+		expected    []float64
+		expectedErr bool
+	}{
+		{
+			name:       "legitimate zero without suppressZero",
+			definition: config.MetricDef{DataType: config.ModbusInt32},
+			expected:   []float64{0},
+		},
+		{
+			name:       "non-zero with suppressZero",
+			definition: config.MetricDef{Address: 300002, DataType: config.ModbusInt32, SuppressZero: true},
+			expected:   []float64{5},
+		},
+		{
+			name:       "dropped zero",
+			definition: config.MetricDef{DataType: config.ModbusInt32, SuppressZero: true, OnError: config.OnErrorDrop},
+			expected:   []float64{},
+		},
+		{
+			name:       "dropped zero by default",
+			definition: config.MetricDef{DataType: config.ModbusInt32, SuppressZero: true},
+			expected:   []float64{},
+		},
+		{
+			name:       "zero as NaN",
+			definition: config.MetricDef{DataType: config.ModbusInt32, SuppressZero: true, OnError: config.OnErrorNaN},
+			expected:   []float64{math.NaN()},
+		},
+		{
+			name:        "zero failing the scrape",
+			definition:  config.MetricDef{DataType: config.ModbusInt32, SuppressZero: true, OnError: config.OnErrorFail},
+			expectedErr: true,
+		},
+	} {
+		definition := test.definition
+		definition.Name = "my_metric"
+		definition.MetricType = config.MetricTypeGauge
+		if definition.Address == 0 {
+			definition.Address = 300001
+		}
+
+		metrics, err := scrapeMetrics([]config.MetricDef{definition}, c)
+		if test.expectedErr {
+			if err == nil {
+				t.Errorf("%v: expected error but got nil", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		values := []float64{}
+		for _, m := range metrics {
+			values = append(values, m.Value)
+		}
+		if fmt.Sprint(values) != fmt.Sprint(test.expected) {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, values)
+		}
+	}
+}
+
+func TestScrapeMetricsFraction(t *testing.T) {
+	c := newFakeClient()
+	c.holdingRegisters[1] = 10
+	c.holdingRegisters[2] = 4
+	c.holdingRegisters[3] = 0
+	c.holdingRegisters[10] = uint16(0xFFF6) // -10
+
+	for _, test := range []struct {
+		name        string
+		definition  config.MetricDef
+		expected    []float64
+		expectedErr bool
+	}{
+		{
+			name:       "quotient",
+			definition: config.MetricDef{Address: 300001},
+			expected:   []float64{2.5},
+		},
+		{
+			name:       "signed numerator apart",
+			definition: config.MetricDef{Addresses: []config.RegisterAddr{300010, 300002}},
+			expected:   []float64{-2.5},
+		},
+		{
+			name:       "zero denominator dropped",
+			definition: config.MetricDef{Address: 300002, OnError: config.OnErrorDrop},
+			expected:   []float64{},
+		},
+		{
+			name:       "zero denominator as NaN",
+			definition: config.MetricDef{Address: 300002, OnError: config.OnErrorNaN},
+			expected:   []float64{math.NaN()},
+		},
+		{
+			name:        "zero denominator failing the scrape",
+			definition:  config.MetricDef{Address: 300002, OnError: config.OnErrorFail},
+			expectedErr: true,
+		},
+	} {
+		definition := test.definition
+		definition.Name = "my_ratio"
+		definition.DataType = config.ModbusFraction
+		definition.MetricType = config.MetricTypeGauge
+
+		metrics, err := scrapeMetrics([]config.MetricDef{definition}, c)
+		if test.expectedErr {
+			if err == nil {
+				t.Errorf("%v: expected error but got nil", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		values := []float64{}
+		for _, m := range metrics {
+			values = append(values, m.Value)
+		}
+		if fmt.Sprint(values) != fmt.Sprint(test.expected) {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, values)
+		}
+	}
+}
+
+func TestParseMetricLabelExpressions(t *testing.T) {
+	definition := config.MetricDef{
+		Name:             "my_metric",
+		DataType:         config.ModbusUInt16,
+		MetricType:       config.MetricTypeGauge,
+		Labels:           map[string]string{"unit": "percent"},
+		LabelExpressions: map[string]string{"level": "value < 10 ? 'low' : (value < 90 ? 'mid' : 'high')"},
+	}
+
+	for _, test := range []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte{0x00, 0x05}, "low"},
+		{[]byte{0x00, 0x32}, "mid"},
+		{[]byte{0x00, 0x5F}, "high"},
+	} {
+		m, err := parseMetric(definition, test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Labels["level"] != test.expected {
+			t.Errorf("expected value %v to be labeled %v but got %v", m.Value, test.expected, m.Labels["level"])
+		}
+		if m.Labels["unit"] != "percent" {
+			t.Errorf("expected configured label to be kept but got %v", m.Labels)
+		}
+	}
+
+	if _, ok := definition.Labels["level"]; ok {
+		t.Fatal("expected configured labels not to be modified")
+	}
+}
+
+// loadLabelExpressionDefinition returns the definition of a metric with a
+// label expression as loaded from a configuration file, i.e. with its label
+// expression compiled.
+func loadLabelExpressionDefinition(tb testing.TB) config.MetricDef {
+	file := filepath.Join(tb.TempDir(), "modbus.yml")
+	err := os.WriteFile(file, []byte(`modules:
+  - name: "my_module"
+    protocol: "tcp/ip"
+    metrics:
+      - name: "my_metric"
+        address: 300001
+        dataType: uint16
+        metricType: gauge
+        labelExpressions:
+          level: "value < 10 ? 'low' : (value < 90 ? 'mid' : 'high')"
+`), 0o644)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	c, err := config.LoadConfig([]string{file})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return c.Modules[0].Metrics[0]
+}
+
+func TestParseMetricCompiledLabelExpressions(t *testing.T) {
+	compiled := loadLabelExpressionDefinition(t)
+	uncompiled := config.MetricDef{
+		Name:             compiled.Name,
+		DataType:         compiled.DataType,
+		MetricType:       compiled.MetricType,
+		LabelExpressions: compiled.LabelExpressions,
+	}
+
+	for _, data := range [][]byte{{0x00, 0x05}, {0x00, 0x32}, {0x00, 0x5F}} {
+		expected, err := parseMetric(uncompiled, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := parseMetric(compiled, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, expected) {
+			t.Errorf("expected compiled label expression to result in %v but got %v", expected, m)
+		}
+	}
+}
+
+func BenchmarkParseMetricLabelExpressions(b *testing.B) {
+	compiled := loadLabelExpressionDefinition(b)
+	data := []byte{0x00, 0x32}
+
+	for _, bench := range []struct {
+		name       string
+		definition config.MetricDef
+	}{
+		{"compiled", compiled},
+		// Definitions not loaded from a configuration file compile their
+		// label expressions on every parse.
+		{"uncompiled", config.MetricDef{
+			Name:             compiled.Name,
+			DataType:         compiled.DataType,
+			MetricType:       compiled.MetricType,
+			LabelExpressions: compiled.LabelExpressions,
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := parseMetric(bench.definition, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestScrapeMetricsPadding(t *testing.T) {
+	definitions := []config.MetricDef{
+		{
+			Name:       "padded",
+			Address:    300010,
+			DataType:   config.ModbusUInt32,
+			MetricType: config.MetricTypeGauge,
+			PadBefore:  2,
+			PadAfter:   1,
+		},
+	}
+
+	c := newFakeClient()
+	c.holdingRegisters[8] = 0xDEAD
+	c.holdingRegisters[9] = 0xBEEF
+	c.holdingRegisters[10] = 0x0001
+	c.holdingRegisters[11] = 0x0002
+	c.holdingRegisters[12] = 0xFFFF
+
+	metrics, err := scrapeMetrics(definitions, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := metrics[0].Value; v != 0x00010002 {
+		t.Fatalf("expected %v but got %v", 0x00010002, v)
+	}
+
+	expectedRequests := []fakeRequest{{modbus.FuncCodeReadHoldingRegisters, 8, 5}}
+	if r := c.recorded(); !reflect.DeepEqual(r, expectedRequests) {
+		t.Fatalf("expected requests %v but got %v", expectedRequests, r)
+	}
+
+	// Coalesced reads include the padding registers.
+	c = newFakeClient()
+	c.holdingRegisters[10] = 0x0001
+	c.holdingRegisters[11] = 0x0002
+	coalescing, err := newCoalescingClient(c, definitions, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err = scrapeMetrics(definitions, coalescing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := metrics[0].Value; v != 0x00010002 {
+		t.Fatalf("expected %v for coalesced read but got %v", 0x00010002, v)
+	}
+	if r := c.recorded(); !reflect.DeepEqual(r, expectedRequests) {
+		t.Fatalf("expected coalesced requests %v but got %v", expectedRequests, r)
+	}
+}
+
+func TestScrapePrecisionLoss(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Metrics: []config.MetricDef{
+			{Name: "exact_total", Address: 300001, DataType: config.ModbusUInt64, MetricType: config.MetricTypeCounter},
+			{Name: "energy_total", Address: 300005, DataType: config.ModbusUInt64, MetricType: config.MetricTypeCounter},
+			{Name: "balance", Address: 300009, DataType: config.ModbusInt64, MetricType: config.MetricTypeGauge},
+		},
+	}
+
+	c := newFakeClient()
+	// 2^53 is exact.
+	c.holdingRegisters[1] = 0x0020
+	// 2^53 + 1 is not.
+	c.holdingRegisters[5] = 0x0020
+	c.holdingRegisters[8] = 0x0001
+	// -(2^53 + 1) is not either.
+	c.holdingRegisters[9] = 0xFFDF
+	c.holdingRegisters[10] = 0xFFFF
+	c.holdingRegisters[11] = 0xFFFF
+	c.holdingRegisters[12] = 0xFFFF
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := e.Scrape("127.0.0.1:502", 1, "my_module"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := `
+# HELP modbus_precision_loss_total Number of 64 bit integer values read whose magnitude exceeded 2^53, beyond which they cannot be exported exactly as float64.
+# TYPE modbus_precision_loss_total counter
+modbus_precision_loss_total{metric="balance",module="my_module",target="127.0.0.1:502"} 2
+modbus_precision_loss_total{metric="energy_total",module="my_module",target="127.0.0.1:502"} 2
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "modbus_precision_loss_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrapeLastExceptionCode(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Metrics: []config.MetricDef{
+			{Name: "voltage", Address: 300001, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge},
+			{Name: "current", Address: 300002, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge},
+		},
+	}
+
+	c := newFakeClient()
+	c.fail = func(r fakeRequest) error {
+		if r.address == 1 {
+			return &modbus.ModbusError{FunctionCode: 0x83, ExceptionCode: modbus.ExceptionCodeIllegalDataAddress}
+		}
+		return nil
+	}
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	if _, err := e.Scrape("127.0.0.1:502", 1, "my_module"); err == nil {
+		t.Fatal("expected scrape to fail")
+	}
+
+	expected := `
+# HELP modbus_last_exception_code Modbus exception code of the last read of a metric, 0 if it succeeded. Only exposed for metrics whose reads failed with an exception before.
+# TYPE modbus_last_exception_code gauge
+modbus_last_exception_code{metric="voltage",module="my_module",target="127.0.0.1:502"} %v
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(fmt.Sprintf(expected, 2)), "modbus_last_exception_code"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.fail = nil
+	if _, err := e.Scrape("127.0.0.1:502", 1, "my_module"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := testutil.CollectAndCompare(e, strings.NewReader(fmt.Sprintf(expected, 0)), "modbus_last_exception_code"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrapeHelpTemplate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "modbus.yml")
+	err := os.WriteFile(file, []byte(`modules:
+  - name: "my_module"
+    protocol: "tcp/ip"
+    helpTemplate: "{name} read from register {address} as {dataType}"
+    metrics:
+      - name: "voltage"
+        address: 300001
+        dataType: uint16
+        metricType: gauge
+      - name: "current"
+        help: "Current in ampere."
+        address: 300002
+        dataType: int16
+        metricType: gauge
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := config.LoadConfig([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewExporter(c)
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: newFakeClient(), close: func() error { return nil }}, nil
+	}
+
+	reg, err := e.Scrape("127.0.0.1:502", 1, "my_module")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP current Current in ampere.
+# TYPE current gauge
+current{module="my_module"} 0
+# HELP voltage voltage read from register 300001 as uint16
+# TYPE voltage gauge
+voltage{module="my_module"} 0
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModuleInfo(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "modbus.yml")
+	err := os.WriteFile(file, []byte(`modules:
+  - name: "first"
+    protocol: "tcp/ip"
+    metrics:
+      - name: "my_metric"
+        address: 300001
+        dataType: int16
+        metricType: gauge
+  - name: "second"
+    protocol: "tcp/ip"
+    metrics:
+      - name: "my_metric"
+        address: 300001
+        dataType: int16
+        metricType: gauge
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := config.LoadConfig([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewExporter(c)
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: newFakeClient(), close: func() error { return nil }}, nil
+	}
+
+	expected := `
+# HELP modbus_exporter_module_info Modules of the loaded configuration, with the value 1.
+# TYPE modbus_exporter_module_info gauge
+modbus_exporter_module_info{module="first"} 1
+modbus_exporter_module_info{module="second"} 1
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "modbus_exporter_module_info"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, scrape := range []struct {
+		target string
+		module string
+	}{
+		{"localhost:502", "first"},
+		{"localhost:502", "first"},
+		{"localhost:502", "second"},
+		{"localhost:503", "first"},
+		// Unknown modules are not counted.
+		{"localhost:504", "unknown"},
+	} {
+		e.Scrape(scrape.target, 1, scrape.module)
+	}
+
+	expected = `
+# HELP modbus_exporter_configured_targets Number of distinct targets, i.e. combinations of module, target and sub-target, scraped via the modules of the loaded configuration. Targets are configured in Prometheus, thus only known once scraped.
+# TYPE modbus_exporter_configured_targets gauge
+modbus_exporter_configured_targets 3
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "modbus_exporter_configured_targets"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeRequest is a request received by fakeClient.
+type fakeRequest struct {
+	function byte
+	address  uint16
+	quantity uint16
+}
+
+// fakeClient implements modbus.Client on top of in-memory registers, recording
+// each request.
+type fakeClient struct {
+	mu       sync.Mutex
+	requests []fakeRequest
+
+	coils            map[uint16]bool
+	discreteInputs   map[uint16]bool
+	holdingRegisters map[uint16]uint16
+	inputRegisters   map[uint16]uint16
+
+	// fail optionally returns an error to respond to a request with.
+	fail func(r fakeRequest) error
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		coils:            map[uint16]bool{},
+		discreteInputs:   map[uint16]bool{},
+		holdingRegisters: map[uint16]uint16{},
+		inputRegisters:   map[uint16]uint16{},
+	}
+}
+
+// record records the given request, returning the error to respond with.
+func (c *fakeClient) record(function byte, address, quantity uint16) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := fakeRequest{function, address, quantity}
+	c.requests = append(c.requests, r)
+	if c.fail != nil {
+		return c.fail(r)
+	}
+
+	return nil
+}
+
+// recorded returns the requests received so far.
+func (c *fakeClient) recorded() []fakeRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]fakeRequest{}, c.requests...)
+}
+
+func (c *fakeClient) readBits(bits map[uint16]bool, function byte, address, quantity uint16) ([]byte, error) {
+	if err := c.record(function, address, quantity); err != nil {
+		return nil, err
+	}
+
+	results := make([]byte, (quantity+7)/8)
+	for i := uint16(0); i < quantity; i++ {
+		if bits[address+i] {
+			results[i/8] |= 1 << (i % 8)
+		}
+	}
+
+	return results, nil
+}
+
+func (c *fakeClient) readRegisters(registers map[uint16]uint16, function byte, address, quantity uint16) ([]byte, error) {
+	if err := c.record(function, address, quantity); err != nil {
+		return nil, err
+	}
+
+	results := make([]byte, 2*quantity)
+	for i := uint16(0); i < quantity; i++ {
+		binary.BigEndian.PutUint16(results[2*i:], registers[address+i])
+	}
+
+	return results, nil
+}
+
+func (c *fakeClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	return c.readBits(c.coils, modbus.FuncCodeReadCoils, address, quantity)
+}
+
+func (c *fakeClient) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+	return c.readBits(c.discreteInputs, modbus.FuncCodeReadDiscreteInputs, address, quantity)
+}
+
+func (c *fakeClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	return c.readRegisters(c.holdingRegisters, modbus.FuncCodeReadHoldingRegisters, address, quantity)
+}
+
+func (c *fakeClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	return c.readRegisters(c.inputRegisters, modbus.FuncCodeReadInputRegisters, address, quantity)
+}
+
+func (c *fakeClient) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	if err := c.record(modbus.FuncCodeWriteSingleRegister, address, 1); err != nil {
+		return nil, err
+	}
+	c.holdingRegisters[address] = value
+
+	return []byte{byte(value >> 8), byte(value)}, nil
+}
+
+func (c *fakeClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	if err := c.record(modbus.FuncCodeWriteMultipleRegisters, address, quantity); err != nil {
+		return nil, err
+	}
+	for i := uint16(0); i < quantity; i++ {
+		c.holdingRegisters[address+i] = binary.BigEndian.Uint16(value[2*i:])
+	}
+
+	return []byte{byte(quantity >> 8), byte(quantity)}, nil
+}
+
+func (c *fakeClient) WriteSingleCoil(address, value uint16) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (c *fakeClient) WriteMultipleCoils(address, quantity uint16, value []byte) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (c *fakeClient) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (c *fakeClient) MaskWriteRegister(address, andMask, orMask uint16) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (c *fakeClient) ReadFIFOQueue(address uint16) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+// InconsistentReadError is returned if three consecutive reads of the same
+// registers all disagree.
+type InconsistentReadError struct {
+	function byte
+	address  uint16
+	quantity uint16
+}
+
+// Error implements the Golang error interface.
+func (e *InconsistentReadError) Error() string {
+	return fmt.Sprintf("inconsistent reads of function code %v at address %v, quantity %v",
+		e.function, e.address, e.quantity)
+}
+
+// pacedClient is a modbus.Client starting reads at most once per scan cycle
+// and optionally verifying them by reading again.
+type pacedClient struct {
+	modbus.Client
+
+	scanCycle time.Duration
+	verify    bool
+
+	now   func() time.Time
+	sleep func(time.Duration)
+	// last is the start of the last read.
+	last time.Time
+}
+
+// paceReads returns the given client pacing and verifying reads as configured
+// by the module's workarounds, or the client itself if neither is configured.
+func (e *Exporter) paceReads(c modbus.Client, module *config.Module) modbus.Client {
+	if module.Workarounds.ScanCycle <= 0 && !module.Workarounds.VerifyReads {
+		return c
+	}
+
+	return &pacedClient{
+		Client:    c,
+		scanCycle: module.Workarounds.ScanCycle,
+		verify:    module.Workarounds.VerifyReads,
+		now:       e.now,
+		sleep:     time.Sleep,
+	}
+}
+
+// wait blocks until a scan cycle passed since the start of the last read.
+func (c *pacedClient) wait() {
+	if c.scanCycle > 0 && !c.last.IsZero() {
+		if d := c.last.Add(c.scanCycle).Sub(c.now()); d > 0 {
+			c.sleep(d)
+		}
+	}
+	c.last = c.now()
+}
+
+// read performs the given read after waiting for the scan cycle, verifying
+// it if configured.
+func (c *pacedClient) read(function byte, address, quantity uint16, read func(address, quantity uint16) ([]byte, error)) ([]byte, error) {
+	c.wait()
+	first, err := read(address, quantity)
+	if err != nil || !c.verify {
+		return first, err
+	}
+
+	c.wait()
+	second, err := read(address, quantity)
+	if err != nil || bytes.Equal(first, second) {
+		return second, err
+	}
+
+	// One of the reads might have caught the registers in the middle of an
+	// update, a third read settles which.
+	c.wait()
+	third, err := read(address, quantity)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(third, first) && !bytes.Equal(third, second) {
+		return nil, &InconsistentReadError{function: function, address: address, quantity: quantity}
+	}
+
+	return third, nil
+}
+
+func (c *pacedClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	return c.read(modbus.FuncCodeReadCoils, address, quantity, c.Client.ReadCoils)
+}
+
+func (c *pacedClient) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+	return c.read(modbus.FuncCodeReadDiscreteInputs, address, quantity, c.Client.ReadDiscreteInputs)
+}
+
+func (c *pacedClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	return c.read(modbus.FuncCodeReadHoldingRegisters, address, quantity, c.Client.ReadHoldingRegisters)
+}
+
+func (c *pacedClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	return c.read(modbus.FuncCodeReadInputRegisters, address, quantity, c.Client.ReadInputRegisters)
+}
+
+// recommendedInterval returns the minimum interval to scrape targets of the
+// given module at if it paces reads to a scan cycle: Each of the planned reads
+// of a scrape, doubled if verified, starts a scan cycle after the previous
+// one, so scrapes cannot follow each other more closely. As the plan only
+// covers metrics and layouts, this is a lower bound for modules issuing
+// further requests, see ReadPlan.
+func (e *Exporter) recommendedInterval(moduleName string) (time.Duration, bool) {
+	module := e.GetConfig().GetModule(moduleName)
+	if module == nil || module.Workarounds.ScanCycle <= 0 {
+		return 0, false
+	}
+
+	plan, err := e.ReadPlan(moduleName)
+	if err != nil {
+		return 0, false
+	}
+
+	reads := len(plan)
+	if module.Workarounds.VerifyReads {
+		reads *= 2
+	}
+	if reads < 1 {
+		reads = 1
+	}
+
+	return time.Duration(reads) * module.Workarounds.ScanCycle, true
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// sequenceClient is a modbus.Client responding to read holding registers
+// requests with the given responses in turn, repeating the last one.
+type sequenceClient struct {
+	modbus.Client
+
+	responses [][]byte
+	reads     int
+}
+
+func (c *sequenceClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	data := c.responses[len(c.responses)-1]
+	if c.reads < len(c.responses) {
+		data = c.responses[c.reads]
+	}
+	c.reads++
+
+	return data, nil
+}
+
+func TestPacedClientVerifyReads(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		responses     [][]byte
+		expected      []byte
+		expectedReads int
+		inconsistent  bool
+	}{
+		{
+			name:          "agreeing reads",
+			responses:     [][]byte{{0x00, 0x01}},
+			expected:      []byte{0x00, 0x01},
+			expectedReads: 2,
+		},
+		{
+			name:          "third read agreeing with the second",
+			responses:     [][]byte{{0x00, 0xFF}, {0x00, 0x02}, {0x00, 0x02}},
+			expected:      []byte{0x00, 0x02},
+			expectedReads: 3,
+		},
+		{
+			name:          "third read agreeing with the first",
+			responses:     [][]byte{{0x00, 0x01}, {0xFF, 0x01}, {0x00, 0x01}},
+			expected:      []byte{0x00, 0x01},
+			expectedReads: 3,
+		},
+		{
+			name:          "disagreeing reads",
+			responses:     [][]byte{{0x00, 0x01}, {0x00, 0x02}, {0x00, 0x03}},
+			expectedReads: 3,
+			inconsistent:  true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			module := &config.Module{Workarounds: config.Workarounds{VerifyReads: true}}
+			sequence := &sequenceClient{responses: test.responses}
+			c := NewExporter(config.Config{}).paceReads(sequence, module)
+
+			data, err := c.ReadHoldingRegisters(1, 1)
+
+			var inconsistentErr *InconsistentReadError
+			if test.inconsistent != errors.As(err, &inconsistentErr) {
+				t.Fatalf("expected inconsistent read %v but got error %v", test.inconsistent, err)
+			}
+			if !test.inconsistent && err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, test.expected) {
+				t.Fatalf("expected data %v but got %v", test.expected, data)
+			}
+			if sequence.reads != test.expectedReads {
+				t.Fatalf("expected %v reads but got %v", test.expectedReads, sequence.reads)
+			}
+		})
+	}
+}
+
+func TestPacedClientScanCycle(t *testing.T) {
+	now := time.Unix(1000, 0)
+	sleeps := []time.Duration{}
+
+	c := &pacedClient{
+		Client:    &sequenceClient{responses: [][]byte{{0x00, 0x01}}},
+		scanCycle: 100 * time.Millisecond,
+		now:       func() time.Time { return now },
+		sleep: func(d time.Duration) {
+			sleeps = append(sleeps, d)
+			now = now.Add(d)
+		},
+	}
+
+	// The first read starts right away, the second waits for the rest of the
+	// scan cycle, the third starts after the scan cycle passed already.
+	for _, elapsed := range []time.Duration{0, 30 * time.Millisecond, 150 * time.Millisecond} {
+		now = now.Add(elapsed)
+		if _, err := c.ReadHoldingRegisters(1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if expected := []time.Duration{70 * time.Millisecond}; !reflect.DeepEqual(sleeps, expected) {
+		t.Fatalf("expected sleeps %v but got %v", expected, sleeps)
+	}
+}
+
+func TestRecommendedMinInterval(t *testing.T) {
+	metrics := []config.MetricDef{
+		{Name: "first", Address: 300001, DataType: config.ModbusInt16, MetricType: config.MetricTypeGauge},
+		{Name: "second", Address: 300100, DataType: config.ModbusInt16, MetricType: config.MetricTypeGauge},
+	}
+
+	e := NewExporter(config.Config{Modules: []config.Module{
+		{Name: "unpaced", Metrics: metrics},
+		{Name: "paced", Metrics: metrics, Workarounds: config.Workarounds{ScanCycle: 100 * time.Millisecond}},
+		{Name: "verified", Metrics: metrics, Workarounds: config.Workarounds{ScanCycle: 100 * time.Millisecond, VerifyReads: true}},
+		{Name: "coalesced", Metrics: metrics, CoalesceReads: true, CoalesceMaxGap: 100, Workarounds: config.Workarounds{ScanCycle: 250 * time.Millisecond}},
+	}})
+
+	expected := `
+# HELP modbus_recommended_min_interval_seconds Minimum interval to scrape targets of modules pacing reads to a scan cycle at, i.e. the time the planned reads of a scrape take up. Scraping more frequently yields no fresh data.
+# TYPE modbus_recommended_min_interval_seconds gauge
+modbus_recommended_min_interval_seconds{module="coalesced"} 0.25
+modbus_recommended_min_interval_seconds{module="paced"} 0.2
+modbus_recommended_min_interval_seconds{module="verified"} 0.4
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "modbus_recommended_min_interval_seconds"); err != nil {
+		t.Fatal(err)
+	}
+}
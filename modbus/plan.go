@@ -0,0 +1,81 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+)
+
+// ReadGroup is a read request the exporter issues on a scrape.
+type ReadGroup struct {
+	FunctionCode uint64 `json:"functionCode"`
+	// Address of the first coil, discrete input or register read, without
+	// the function code prefix.
+	Address int `json:"address"`
+	Count   int `json:"count"`
+	// Metrics holds the names of the metrics, or layout fields, covered by
+	// the request.
+	Metrics []string `json:"metrics"`
+}
+
+// ReadPlan returns the read requests the exporter issues for the metrics and
+// layouts of the given module, after coalescing reads if configured. Reads
+// whose data is served from a coalesced read are not listed on their own.
+//
+// The plan only covers metrics and layouts. The auxiliary registers of metrics,
+// e.g. their scale factors, timestamps or quality registers, as well as
+// selectors, FIFO queues, event pointers, config hashes, file records and
+// diagnostics are read with additional requests not listed.
+func (e *Exporter) ReadPlan(moduleName string) ([]ReadGroup, error) {
+	module := e.GetConfig().GetModule(moduleName)
+	if module == nil {
+		return nil, fmt.Errorf("failed to find '%v' in config", moduleName)
+	}
+
+	var blocks []*readBlock
+	var err error
+	if module.CoalesceReads {
+		blocks, err = planBlocks(module.Metrics, module.CoalesceMaxGap, module.MaxRegistersPerRead)
+	} else {
+		blocks, err = planReads(module.Metrics)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, l := range module.Layouts {
+		modFunction, modAddress, err := splitAddress(l.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		b := &readBlock{function: modFunction, address: int(modAddress), quantity: l.Size()}
+		for _, f := range l.Fields {
+			b.metrics = append(b.metrics, f.Name)
+		}
+		blocks = append(blocks, b)
+	}
+
+	plan := make([]ReadGroup, 0, len(blocks))
+	for _, b := range blocks {
+		plan = append(plan, ReadGroup{
+			FunctionCode: b.function,
+			Address:      b.address,
+			Count:        b.quantity,
+			Metrics:      b.metrics,
+		})
+	}
+
+	return plan, nil
+}
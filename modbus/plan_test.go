@@ -0,0 +1,95 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+func TestReadPlan(t *testing.T) {
+	module := config.Module{
+		Name: "my_module",
+		Metrics: []config.MetricDef{
+			{Name: "a", Address: 300001, DataType: config.ModbusInt16},
+			{Name: "b", Address: 300002, DataType: config.ModbusInt32},
+			// Gap of 6 registers.
+			{Name: "c", Address: 300010, DataType: config.ModbusUInt16},
+			{Name: "d", Address: 400001, DataType: config.ModbusInt16},
+		},
+		Layouts: []config.Layout{
+			{
+				Address: 300100,
+				Fields: []config.MetricDef{
+					{Name: "e", DataType: config.ModbusInt16},
+					{Name: "f", DataType: config.ModbusFloat32},
+				},
+			},
+		},
+	}
+
+	for _, test := range []struct {
+		name     string
+		coalesce bool
+		maxGap   int
+		expected []ReadGroup
+	}{
+		{
+			name: "without coalescing",
+			expected: []ReadGroup{
+				{3, 1, 1, []string{"a"}},
+				{3, 2, 2, []string{"b"}},
+				{3, 10, 1, []string{"c"}},
+				{4, 1, 1, []string{"d"}},
+				{3, 100, 3, []string{"e", "f"}},
+			},
+		},
+		{
+			name:     "adjacent",
+			coalesce: true,
+			expected: []ReadGroup{
+				{3, 1, 3, []string{"a", "b"}},
+				{3, 10, 1, []string{"c"}},
+				{4, 1, 1, []string{"d"}},
+				{3, 100, 3, []string{"e", "f"}},
+			},
+		},
+		{
+			name:     "gapped",
+			coalesce: true,
+			maxGap:   6,
+			expected: []ReadGroup{
+				{3, 1, 10, []string{"a", "b", "c"}},
+				{4, 1, 1, []string{"d"}},
+				{3, 100, 3, []string{"e", "f"}},
+			},
+		},
+	} {
+		module := module
+		module.CoalesceReads = test.coalesce
+		module.CoalesceMaxGap = test.maxGap
+
+		e := NewExporter(config.Config{Modules: []config.Module{module}})
+		plan, err := e.ReadPlan("my_module")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(plan, test.expected) {
+			t.Errorf("%v: expected plan %v but got %v", test.name, test.expected, plan)
+		}
+	}
+}
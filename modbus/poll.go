@@ -0,0 +1,112 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newTicker returns a time.Ticker's channel and its Stop function.
+func newTicker(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
+
+// Poll reads the targets of the modules configuring polling on their interval
+// until the given context is done, starting with an immediate read. The
+// metrics of the last successful read of each target are served by Polled.
+func (e *Exporter) Poll(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	c := e.GetConfig()
+	for i := range c.Modules {
+		module := &c.Modules[i]
+		if module.Poll == nil {
+			continue
+		}
+
+		for _, t := range module.Poll.Targets {
+			wg.Add(1)
+			go func(module *config.Module, t config.PollTarget) {
+				defer wg.Done()
+				e.pollTarget(ctx, module, t)
+			}(module, t)
+		}
+	}
+
+	wg.Wait()
+}
+
+// pollTarget reads the given target every poll interval of the given module
+// until the given context is done.
+func (e *Exporter) pollTarget(ctx context.Context, module *config.Module, t config.PollTarget) {
+	tick, stop := e.newTicker(module.Poll.Interval)
+	defer stop()
+
+	for {
+		e.pollOnce(module.Name, t)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		}
+	}
+}
+
+// pollOnce reads the given target, caching its metrics labeled with the
+// target and sub-target. Targets failing to be read are removed from the
+// cache until read successfully again.
+func (e *Exporter) pollOnce(moduleName string, t config.PollTarget) {
+	key := connectionKey{moduleName, t.Target, t.SubTarget}
+
+	reg := prometheus.NewRegistry()
+	labels := prometheus.Labels{"target": t.Target, "sub_target": strconv.Itoa(int(t.SubTarget))}
+	err := e.scrape(prometheus.WrapRegistererWith(labels, reg), t.Target, t.SubTarget, moduleName)
+
+	e.polledMu.Lock()
+	defer e.polledMu.Unlock()
+
+	if err != nil {
+		level.Warn(e.Logger).Log("msg", "failed to poll target", "module", moduleName,
+			"target", t.Target, "sub_target", t.SubTarget, "err", err)
+		delete(e.polled, key)
+		return
+	}
+
+	e.polled[key] = reg
+}
+
+// Polled returns a gatherer serving the cached metrics of the polled targets
+// without contacting them.
+func (e *Exporter) Polled() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		e.polledMu.Lock()
+		gatherers := make(prometheus.Gatherers, 0, len(e.polled))
+		for _, g := range e.polled {
+			gatherers = append(gatherers, g)
+		}
+		e.polledMu.Unlock()
+
+		return gatherers.Gather()
+	})
+}
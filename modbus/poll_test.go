@@ -0,0 +1,112 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPoll(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Poll: &config.Poll{
+			Interval: time.Minute,
+			Targets:  []config.PollTarget{{Target: "localhost:502", SubTarget: 1}},
+		},
+		Metrics: []config.MetricDef{
+			{
+				Name:       "my_metric",
+				Help:       "my help",
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := newFakeClient()
+	c.holdingRegisters[1] = 1
+
+	// Each poll connects once the test lets it through, ticks are only
+	// received once the previous poll finished.
+	gate := make(chan struct{})
+	tick := make(chan time.Time)
+	stopped := make(chan struct{})
+	connects := 0
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.newTicker = func(d time.Duration) (<-chan time.Time, func()) {
+		if d != time.Minute {
+			t.Errorf("expected poll interval of %v but got %v", time.Minute, d)
+		}
+		return tick, func() { close(stopped) }
+	}
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("unable to connect with target %s via module %s", target, module.Name)
+		}
+		connects++
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	go e.Poll(ctx)
+
+	expectCached := func(step string, expected int, expectedConnects int) {
+		t.Helper()
+		// Gathering repeatedly serves the cache without reading the target.
+		for i := 0; i < 2; i++ {
+			expectedMetrics := fmt.Sprintf(`
+# HELP my_metric my help
+# TYPE my_metric gauge
+my_metric{module="my_module",sub_target="1",target="localhost:502"} %v
+`, expected)
+			if err := testutil.GatherAndCompare(e.Polled(), strings.NewReader(expectedMetrics)); err != nil {
+				t.Fatalf("%v: %v", step, err)
+			}
+		}
+		if connects != expectedConnects {
+			t.Fatalf("%v: expected %v connects but got %v", step, expectedConnects, connects)
+		}
+	}
+
+	// The target is read immediately.
+	gate <- struct{}{}
+	tick <- time.Now()
+	expectCached("initial poll", 1, 1)
+
+	// The cache keeps its values until the next poll.
+	c.holdingRegisters[1] = 2
+	expectCached("between polls", 1, 1)
+
+	// The cache is updated on the next tick.
+	gate <- struct{}{}
+	tick <- time.Now()
+	expectCached("second poll", 2, 2)
+
+	cancel()
+	<-stopped
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ScrapeQueueOverflow defines how scrapes finding the scrape queue full are
+// handled.
+type ScrapeQueueOverflow string
+
+const (
+	// ScrapeQueueOverflowQueue makes scrapes wait for space in the queue.
+	ScrapeQueueOverflowQueue ScrapeQueueOverflow = "queue"
+	// ScrapeQueueOverflowReject fails scrapes with ErrScrapeQueueFull.
+	ScrapeQueueOverflowReject ScrapeQueueOverflow = "reject"
+)
+
+// ErrScrapeQueueFull is returned for scrapes rejected as all scrape workers are
+// busy and the scrape queue is full.
+var ErrScrapeQueueFull = errors.New("scrape queue full, all scrape workers busy")
+
+// runScrape runs the given scrape on one of the ScrapeWorkers workers, waiting
+// in the scrape queue for a worker to become idle. Scrapes are run directly
+// unless ScrapeWorkers is set.
+func (e *Exporter) runScrape(scrape func() (prometheus.Gatherer, error)) (prometheus.Gatherer, error) {
+	if e.ScrapeWorkers <= 0 {
+		return scrape()
+	}
+	e.startScrapeWorkers.Do(e.startWorkers)
+
+	var (
+		done     = make(chan struct{})
+		gatherer prometheus.Gatherer
+		err      error
+	)
+	task := func() {
+		defer close(done)
+		gatherer, err = scrape()
+	}
+
+	e.scrapeQueueDepth.Inc()
+	if e.ScrapeQueueOverflow == ScrapeQueueOverflowReject {
+		select {
+		case e.scrapeTasks <- task:
+		default:
+			e.scrapeQueueDepth.Dec()
+			e.scrapesRejected.Inc()
+			return nil, ErrScrapeQueueFull
+		}
+	} else {
+		e.scrapeTasks <- task
+	}
+	<-done
+
+	return gatherer, err
+}
+
+// startWorkers starts the scrape workers, taking scrapes off a queue of
+// ScrapeQueueSize scrapes.
+func (e *Exporter) startWorkers() {
+	e.scrapeTasks = make(chan func(), e.ScrapeQueueSize)
+	e.scrapeWorkers.Set(float64(e.ScrapeWorkers))
+
+	for i := 0; i < e.ScrapeWorkers; i++ {
+		go func() {
+			for task := range e.scrapeTasks {
+				e.scrapeQueueDepth.Dec()
+				e.scrapeWorkersBusy.Inc()
+				task()
+				e.scrapeWorkersBusy.Dec()
+			}
+		}()
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// waitFor waits up to a second for the given condition to hold.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// blockingScrape returns a scrape blocking until release is closed, tracking
+// the number of scrapes running and the maximum of it.
+func blockingScrape(release <-chan struct{}, running, maxRunning *int64) func() (prometheus.Gatherer, error) {
+	return func() (prometheus.Gatherer, error) {
+		n := atomic.AddInt64(running, 1)
+		for {
+			m := atomic.LoadInt64(maxRunning)
+			if n <= m || atomic.CompareAndSwapInt64(maxRunning, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt64(running, -1)
+
+		return prometheus.NewRegistry(), nil
+	}
+}
+
+func TestRunScrapeConcurrency(t *testing.T) {
+	e := NewExporter(config.Config{})
+	e.ScrapeWorkers = 2
+	e.ScrapeQueueSize = 10
+
+	release := make(chan struct{})
+	var running, maxRunning int64
+	scrape := blockingScrape(release, &running, &maxRunning)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := e.runScrape(scrape)
+			errs <- err
+		}()
+	}
+
+	// Two scrapes run, the others wait in the queue.
+	waitFor(t, func() bool {
+		return atomic.LoadInt64(&running) == 2 && testutil.ToFloat64(e.scrapeQueueDepth) == 3
+	})
+	if v := testutil.ToFloat64(e.scrapeWorkersBusy); v != 2 {
+		t.Fatalf("expected 2 busy workers but got %v", v)
+	}
+	if v := testutil.ToFloat64(e.scrapeWorkers); v != 2 {
+		t.Fatalf("expected 2 workers but got %v", v)
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if maxRunning != 2 {
+		t.Fatalf("expected at most 2 concurrent scrapes but got %v", maxRunning)
+	}
+	if v := testutil.ToFloat64(e.scrapeQueueDepth); v != 0 {
+		t.Fatalf("expected empty queue but got %v", v)
+	}
+	waitFor(t, func() bool { return testutil.ToFloat64(e.scrapeWorkersBusy) == 0 })
+}
+
+func TestRunScrapeOverflow(t *testing.T) {
+	for _, overflow := range []ScrapeQueueOverflow{ScrapeQueueOverflowReject, ScrapeQueueOverflowQueue} {
+		t.Run(string(overflow), func(t *testing.T) {
+			e := NewExporter(config.Config{})
+			e.ScrapeWorkers = 1
+			e.ScrapeQueueSize = 1
+			e.ScrapeQueueOverflow = overflow
+
+			release := make(chan struct{})
+			var running, maxRunning int64
+			scrape := blockingScrape(release, &running, &maxRunning)
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 3)
+			run := func() {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := e.runScrape(scrape)
+					errs <- err
+				}()
+			}
+
+			// The first scrape runs, the second one waits in the queue.
+			run()
+			waitFor(t, func() bool { return atomic.LoadInt64(&running) == 1 })
+			run()
+			waitFor(t, func() bool { return len(e.scrapeTasks) == 1 })
+
+			// The third one finds the queue full.
+			if overflow == ScrapeQueueOverflowReject {
+				if _, err := e.runScrape(scrape); !errors.Is(err, ErrScrapeQueueFull) {
+					t.Fatalf("expected %v but got %v", ErrScrapeQueueFull, err)
+				}
+				if v := testutil.ToFloat64(e.scrapesRejected); v != 1 {
+					t.Fatalf("expected 1 rejected scrape but got %v", v)
+				}
+			} else {
+				run()
+				waitFor(t, func() bool { return testutil.ToFloat64(e.scrapeQueueDepth) == 2 })
+			}
+
+			close(release)
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if maxRunning != 1 {
+				t.Fatalf("expected at most 1 concurrent scrape but got %v", maxRunning)
+			}
+			if overflow == ScrapeQueueOverflowQueue {
+				if v := testutil.ToFloat64(e.scrapesRejected); v != 0 {
+					t.Fatalf("expected no rejected scrapes but got %v", v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"golang.org/x/net/proxy"
+)
+
+// dialProxy opens a TCP connection to the given target through the SOCKS5
+// proxy of the given module. The module's timeout, or defaultStreamTimeout if
+// unset, bounds connecting to the proxy, the handshake and the proxy
+// connecting to the target.
+func dialProxy(module *config.Module, target string) (io.ReadWriteCloser, error) {
+	u, err := url.Parse(module.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %v", err)
+	}
+
+	dialer, err := proxy.FromURL(u, &net.Dialer{})
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("proxy dialer for scheme %v does not support timeouts", u.Scheme)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamTimeout(module))
+	defer cancel()
+
+	return contextDialer.DialContext(ctx, "tcp", target)
+}
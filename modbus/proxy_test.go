@@ -0,0 +1,186 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScrapeThroughProxy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// The proxy serves the registers itself instead of connecting to the
+	// target, which does not resolve.
+	targets := make(chan string, 1)
+	go serveSOCKS5(listener, targets, map[uint16]uint16{1: 42}, map[uint16]uint16{})
+
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Timeout:  1000,
+		ProxyURL: "socks5://" + listener.Addr().String(),
+		Metrics: []config.MetricDef{
+			{
+				Name:       "temperature",
+				Help:       "some help",
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+		},
+	}
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+
+	reg, err := e.Scrape("plc.invalid:502", 1, "my_module")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target := <-targets; target != "plc.invalid:502" {
+		t.Errorf("expected the proxy to connect to plc.invalid:502 but got %v", target)
+	}
+	if n, err := testutil.GatherAndCount(reg, "temperature"); err != nil || n != 1 {
+		t.Fatalf("expected the temperature read through the proxy, got %v series: %v", n, err)
+	}
+}
+
+func TestDialProxyTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// The proxy accepts connections but never completes the handshake, as
+	// if stuck connecting to an unreachable target.
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	module := &config.Module{
+		Name:     "my_module",
+		Timeout:  100,
+		ProxyURL: "socks5://" + listener.Addr().String(),
+	}
+
+	start := time.Now()
+	if _, err := dialProxy(module, "plc.invalid:502"); err == nil {
+		t.Fatal("expected dialing through a stuck proxy to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected dialing to time out after the module's timeout but took %v", elapsed)
+	}
+}
+
+// serveSOCKS5 accepts SOCKS5 connections without authentication on the given
+// listener, passing the target of each CONNECT request to the given channel and
+// serving the given registers on the connection.
+func serveSOCKS5(listener net.Listener, targets chan<- string, holdingRegisters, inputRegisters map[uint16]uint16) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		target, err := acceptSOCKS5(conn)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		targets <- target
+
+		go respond(conn, holdingRegisters, inputRegisters)
+	}
+}
+
+// acceptSOCKS5 performs the server side of a SOCKS5 handshake without
+// authentication, returning the target of the CONNECT request.
+func acceptSOCKS5(conn io.ReadWriter) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[1] != 0x01 {
+		return "", fmt.Errorf("unsupported command %v", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case 0x01:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported address type %v", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	// Succeeded, bound to 0.0.0.0:0.
+	if _, err := conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, fmt.Sprint(binary.BigEndian.Uint16(port))), nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"strings"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+// nameLabel is the label holding the metric name while relabeling.
+const nameLabel = "__name__"
+
+// relabel applies the given relabel configs to the given metrics, removing
+// the metrics dropped by them or left without a name.
+func relabel(configs []config.RelabelConfig, metrics []metric) []metric {
+	if len(configs) == 0 {
+		return metrics
+	}
+
+	relabeled := make([]metric, 0, len(metrics))
+	for _, m := range metrics {
+		labels := copyLabels(m.Labels)
+		labels[nameLabel] = m.Name
+
+		if !relabelLabels(configs, labels) || labels[nameLabel] == "" {
+			continue
+		}
+
+		m.Name = labels[nameLabel]
+		delete(labels, nameLabel)
+		m.Labels = labels
+
+		relabeled = append(relabeled, m)
+	}
+
+	return relabeled
+}
+
+// relabelLabels applies the given relabel configs to the given labels in
+// place, returning false if they drop the metric.
+func relabelLabels(configs []config.RelabelConfig, labels map[string]string) bool {
+	for _, c := range configs {
+		values := make([]string, 0, len(c.SourceLabels))
+		for _, n := range c.SourceLabels {
+			values = append(values, labels[n])
+		}
+		value := strings.Join(values, c.Separator)
+
+		switch c.Action {
+		case config.RelabelKeep:
+			if !c.Regex.MatchString(value) {
+				return false
+			}
+		case config.RelabelDrop:
+			if c.Regex.MatchString(value) {
+				return false
+			}
+		case config.RelabelLabelDrop:
+			for n := range labels {
+				if n != nameLabel && c.Regex.MatchString(n) {
+					delete(labels, n)
+				}
+			}
+		case config.RelabelLabelKeep:
+			for n := range labels {
+				if n != nameLabel && !c.Regex.MatchString(n) {
+					delete(labels, n)
+				}
+			}
+		default:
+			indexes := c.Regex.FindStringSubmatchIndex(value)
+			if indexes == nil {
+				continue
+			}
+
+			target := string(c.Regex.ExpandString(nil, c.TargetLabel, value, indexes))
+			replacement := string(c.Regex.ExpandString(nil, c.Replacement, value, indexes))
+			if replacement == "" {
+				delete(labels, target)
+				continue
+			}
+			labels[target] = replacement
+		}
+	}
+
+	return true
+}
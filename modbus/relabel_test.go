@@ -0,0 +1,137 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRelabel(t *testing.T) {
+	metrics := []metric{
+		{Name: "voltage_volts", Labels: map[string]string{"phase": "l1", "unit": "v"}, Value: 230},
+		{Name: "debug_counter", Labels: map[string]string{"phase": "l1"}, Value: 1},
+	}
+
+	for _, test := range []struct {
+		name     string
+		configs  []config.RelabelConfig
+		expected []metric
+	}{
+		{
+			name: "drop",
+			configs: []config.RelabelConfig{
+				{SourceLabels: []string{"__name__"}, Regex: config.MustNewRegexp("debug_.*"), Action: config.RelabelDrop},
+			},
+			expected: []metric{metrics[0]},
+		},
+		{
+			name: "keep",
+			configs: []config.RelabelConfig{
+				{SourceLabels: []string{"__name__"}, Regex: config.MustNewRegexp("debug_.*"), Action: config.RelabelKeep},
+			},
+			expected: []metric{metrics[1]},
+		},
+		{
+			name: "replace",
+			configs: []config.RelabelConfig{
+				{
+					SourceLabels: []string{"phase"},
+					Regex:        config.MustNewRegexp("l(.)"),
+					TargetLabel:  "phase",
+					Replacement:  "L$1",
+					Action:       config.RelabelReplace,
+				},
+			},
+			expected: []metric{
+				{Name: "voltage_volts", Labels: map[string]string{"phase": "L1", "unit": "v"}, Value: 230},
+				{Name: "debug_counter", Labels: map[string]string{"phase": "L1"}, Value: 1},
+			},
+		},
+		{
+			name: "replace metric name",
+			configs: []config.RelabelConfig{
+				{
+					SourceLabels: []string{"__name__"},
+					Regex:        config.MustNewRegexp("voltage_(.*)"),
+					TargetLabel:  "__name__",
+					Replacement:  "grid_voltage_$1",
+					Action:       config.RelabelReplace,
+				},
+			},
+			expected: []metric{
+				{Name: "grid_voltage_volts", Labels: map[string]string{"phase": "l1", "unit": "v"}, Value: 230},
+				metrics[1],
+			},
+		},
+		{
+			name: "labeldrop",
+			configs: []config.RelabelConfig{
+				{Regex: config.MustNewRegexp("unit"), Action: config.RelabelLabelDrop},
+			},
+			expected: []metric{
+				{Name: "voltage_volts", Labels: map[string]string{"phase": "l1"}, Value: 230},
+				metrics[1],
+			},
+		},
+		{
+			name: "labelkeep",
+			configs: []config.RelabelConfig{
+				{Regex: config.MustNewRegexp("unit"), Action: config.RelabelLabelKeep},
+			},
+			expected: []metric{
+				{Name: "voltage_volts", Labels: map[string]string{"unit": "v"}, Value: 230},
+				{Name: "debug_counter", Labels: map[string]string{}, Value: 1},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			relabeled := relabel(test.configs, metrics)
+			if !reflect.DeepEqual(relabeled, test.expected) {
+				t.Fatalf("expected %v but got %v", test.expected, relabeled)
+			}
+		})
+	}
+
+	// The given metrics are left untouched.
+	if metrics[0].Labels["phase"] != "l1" || len(metrics[0].Labels) != 2 {
+		t.Fatalf("expected metrics not to be modified but got %v", metrics[0])
+	}
+}
+
+func TestRelabelInconsistentLabelNames(t *testing.T) {
+	metrics := []metric{
+		{Name: "voltage_volts", Labels: map[string]string{"phase": "l1"}, Value: 230, MetricType: config.MetricTypeGauge},
+		{Name: "voltage_volts", Labels: map[string]string{"phase": "l2"}, Value: 231, MetricType: config.MetricTypeGauge},
+	}
+
+	// The replace only matches the first series, adding the target label to
+	// it alone.
+	relabeled := relabel([]config.RelabelConfig{
+		{
+			SourceLabels: []string{"phase"},
+			Regex:        config.MustNewRegexp("l1"),
+			TargetLabel:  "primary",
+			Replacement:  "true",
+			Action:       config.RelabelReplace,
+		},
+	}, metrics)
+
+	if _, err := registerMetrics(prometheus.NewRegistry(), "my_module", relabeled, 0); err == nil {
+		t.Fatal("expected registering series with different label names to fail")
+	}
+}
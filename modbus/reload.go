@@ -0,0 +1,50 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+// ReloadConfig loads the configuration from the given files and replaces the
+// current one with it, closing idle connections established with the current
+// one. If loading fails, the current configuration is kept. The outcome is
+// exposed by modbus_exporter_last_reload_success, the time of the last
+// successful load by modbus_exporter_last_reload_timestamp_seconds. Polled
+// targets keep being read as configured when polling started.
+func (e *Exporter) ReloadConfig(files []string) error {
+	c, err := config.LoadConfig(files)
+	if err != nil {
+		e.lastReloadSuccess.Set(0)
+		return err
+	}
+
+	e.configMu.Lock()
+	e.Config = c
+	e.configMu.Unlock()
+
+	e.connectionsMu.Lock()
+	idle := e.connections
+	e.connections = map[connectionKey]*connection{}
+	e.connectionsMu.Unlock()
+
+	for _, conn := range idle {
+		conn.close()
+	}
+
+	e.lastReloadSuccess.Set(1)
+	e.lastReloadTimestamp.Set(float64(e.now().UnixNano()) / 1e9)
+
+	return nil
+}
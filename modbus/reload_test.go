@@ -0,0 +1,86 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReloadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "modbus.yml")
+	write := func(module, metricType string) {
+		err := os.WriteFile(file, []byte(`modules:
+  - name: "`+module+`"
+    protocol: "tcp/ip"
+    metrics:
+      - name: "voltage"
+        address: 300001
+        dataType: uint16
+        metricType: `+metricType+`
+`), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Unix(100, 0)
+	e := NewExporter(config.Config{Modules: []config.Module{{Name: "old_module"}}})
+	e.now = func() time.Time { return now }
+
+	expected := `
+# HELP modbus_exporter_last_reload_success Whether the last reload of the configuration succeeded (1) or not (0).
+# TYPE modbus_exporter_last_reload_success gauge
+modbus_exporter_last_reload_success %v
+# HELP modbus_exporter_last_reload_timestamp_seconds Unix timestamp of the last successful load of the configuration.
+# TYPE modbus_exporter_last_reload_timestamp_seconds gauge
+modbus_exporter_last_reload_timestamp_seconds %v
+`
+	compare := func(success, timestamp int) {
+		t.Helper()
+		err := testutil.CollectAndCompare(e, strings.NewReader(fmt.Sprintf(expected, success, timestamp)),
+			"modbus_exporter_last_reload_success", "modbus_exporter_last_reload_timestamp_seconds")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("new_module", "gauge")
+	if err := e.ReloadConfig([]string{file}); err != nil {
+		t.Fatal(err)
+	}
+	if !e.GetConfig().HasModule("new_module") || e.GetConfig().HasModule("old_module") {
+		t.Fatalf("expected the reloaded config to replace the old one but got %v", e.GetConfig().Modules)
+	}
+	compare(1, 100)
+
+	// A failed reload keeps the current config and the time of the last
+	// successful one.
+	now = time.Unix(200, 0)
+	write("newer_module", "histogram")
+	if err := e.ReloadConfig([]string{file}); err == nil {
+		t.Fatal("expected reloading an invalid config to fail")
+	}
+	if !e.GetConfig().HasModule("new_module") {
+		t.Fatalf("expected the current config to be kept but got %v", e.GetConfig().Modules)
+	}
+	compare(0, 100)
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MalformedResponseError is returned for responses to read requests whose size
+// does not match the requested quantity or their own byte count, e.g. by
+// misbehaving gateways.
+type MalformedResponseError struct {
+	function byte
+	expected int
+	actual   int
+}
+
+// Error implements the Golang error interface.
+func (e *MalformedResponseError) Error() string {
+	return fmt.Sprintf("malformed response to function code %v: expected %v bytes, got %v",
+		e.function, e.expected, e.actual)
+}
+
+// validatingClient is a modbus.Client validating the size of the responses
+// to read requests.
+type validatingClient struct {
+	modbus.Client
+
+	// tolerate passes on malformed responses after counting them.
+	tolerate  bool
+	malformed prometheus.Counter
+}
+
+// validateResponses returns the given client validating the size of the
+// responses to read requests, counting malformed ones.
+func (e *Exporter) validateResponses(c modbus.Client, module *config.Module, target string) modbus.Client {
+	return &validatingClient{
+		Client:    c,
+		tolerate:  module.Workarounds.IgnoreResponseLength,
+		malformed: e.malformedResponses.WithLabelValues(module.Name, target),
+	}
+}
+
+// validate returns an error if the given response does not have the expected
+// size.
+func (c *validatingClient) validate(function byte, expected int, data []byte, err error) ([]byte, error) {
+	if err != nil || len(data) == expected {
+		return data, err
+	}
+
+	c.malformed.Inc()
+	if c.tolerate {
+		return data, nil
+	}
+
+	return nil, &MalformedResponseError{function: function, expected: expected, actual: len(data)}
+}
+
+func (c *validatingClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	data, err := c.Client.ReadCoils(address, quantity)
+	return c.validate(modbus.FuncCodeReadCoils, (int(quantity)+7)/8, data, err)
+}
+
+func (c *validatingClient) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+	data, err := c.Client.ReadDiscreteInputs(address, quantity)
+	return c.validate(modbus.FuncCodeReadDiscreteInputs, (int(quantity)+7)/8, data, err)
+}
+
+func (c *validatingClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	data, err := c.Client.ReadHoldingRegisters(address, quantity)
+	return c.validate(modbus.FuncCodeReadHoldingRegisters, 2*int(quantity), data, err)
+}
+
+func (c *validatingClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	data, err := c.Client.ReadInputRegisters(address, quantity)
+	return c.validate(modbus.FuncCodeReadInputRegisters, 2*int(quantity), data, err)
+}
+
+func (c *validatingClient) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) ([]byte, error) {
+	data, err := c.Client.ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity, value)
+	return c.validate(modbus.FuncCodeReadWriteMultipleRegisters, 2*int(readQuantity), data, err)
+}
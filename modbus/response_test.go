@@ -0,0 +1,79 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// cannedClient is a modbus.Client responding to read holding registers
+// requests with the given data, regardless of the requested quantity.
+type cannedClient struct {
+	modbus.Client
+
+	data []byte
+}
+
+func (c *cannedClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	return c.data, nil
+}
+
+func TestValidateResponses(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		data      []byte
+		tolerate  bool
+		malformed bool
+	}{
+		{name: "exact", data: []byte{0x00, 0x01, 0x00, 0x02}},
+		{name: "short", data: []byte{0x00, 0x01, 0x00}, malformed: true},
+		{name: "over-long", data: []byte{0x00, 0x01, 0x00, 0x02, 0x00, 0x03}, malformed: true},
+		{name: "tolerated over-long", data: []byte{0x00, 0x01, 0x00, 0x02, 0x00, 0x03}, tolerate: true, malformed: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			module := &config.Module{Name: "my_module", Workarounds: config.Workarounds{IgnoreResponseLength: test.tolerate}}
+			e := NewExporter(config.Config{})
+			c := e.validateResponses(&cannedClient{data: test.data}, module, "localhost:502")
+
+			data, err := c.ReadHoldingRegisters(1, 2)
+
+			var malformedErr *MalformedResponseError
+			if test.malformed && !test.tolerate {
+				if !errors.As(err, &malformedErr) {
+					t.Fatalf("expected MalformedResponseError but got %v", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("expected no error but got %v", err)
+				}
+				if len(data) != len(test.data) {
+					t.Fatalf("expected the response to be passed on but got % x", data)
+				}
+			}
+
+			expected := 0.0
+			if test.malformed {
+				expected = 1
+			}
+			if v := testutil.ToFloat64(e.malformedResponses.WithLabelValues("my_module", "localhost:502")); v != expected {
+				t.Fatalf("expected %v malformed responses but got %v", expected, v)
+			}
+		})
+	}
+}
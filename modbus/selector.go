@@ -0,0 +1,63 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+// scrapeSelectors reads the selector register of each of the given selectors,
+// then the metrics of the case matching its value.
+func scrapeSelectors(selectors []config.Selector, c modbus.Client, observe readObserver) ([]metric, error) {
+	metrics := []metric{}
+
+	for _, s := range selectors {
+		modFunction, modAddress, err := splitAddress(s.Address)
+		if err != nil {
+			return []metric{}, err
+		}
+
+		f := registerReadFunc(c, modFunction)
+		if f == nil {
+			return []metric{}, fmt.Errorf("selector address '%v' is not a holding or input register address", s.Address)
+		}
+
+		data, err := f(uint16(modAddress), 1)
+		if err != nil {
+			return []metric{}, fmt.Errorf("selector address '%v': %v", s.Address, err)
+		}
+		if len(data) != 2 {
+			return []metric{}, fmt.Errorf("selector address '%v': %v", s.Address, &InsufficientRegistersError{
+				fmt.Sprintf("expected 2 bytes, got %v", len(data)),
+			})
+		}
+
+		definitions := s.Metrics(binary.BigEndian.Uint16(data))
+		if len(definitions) == 0 {
+			continue
+		}
+
+		selected, err := scrapeObservedMetrics(definitions, c, observe)
+		if err != nil {
+			return []metric{}, fmt.Errorf("selector address '%v': %v", s.Address, err)
+		}
+		metrics = append(metrics, selected...)
+	}
+
+	return metrics, nil
+}
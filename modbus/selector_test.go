@@ -0,0 +1,95 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+func TestScrapeSelectors(t *testing.T) {
+	selector := config.Selector{
+		Address: 300001,
+		Cases: []config.SelectorCase{
+			{Value: 1, Metrics: []config.MetricDef{
+				{Name: "voltage_volts", Address: 300010, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge},
+			}},
+			{Value: 2, Metrics: []config.MetricDef{
+				{Name: "current_amperes", Address: 300010, DataType: config.ModbusInt16, MetricType: config.MetricTypeGauge},
+				{Name: "frequency_hertz", Address: 300011, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge},
+			}},
+		},
+	}
+
+	c := newFakeClient()
+	c.holdingRegisters[10] = 0xFFFE
+	c.holdingRegisters[11] = 50
+
+	for _, test := range []struct {
+		name             string
+		selector         uint16
+		expected         []metric
+		expectedRequests []fakeRequest
+	}{
+		{
+			name:     "set A",
+			selector: 1,
+			expected: []metric{
+				{Name: "voltage_volts", Value: 65534, MetricType: config.MetricTypeGauge},
+			},
+			expectedRequests: []fakeRequest{
+				{modbus.FuncCodeReadHoldingRegisters, 1, 1},
+				{modbus.FuncCodeReadHoldingRegisters, 10, 1},
+			},
+		},
+		{
+			name:     "set B",
+			selector: 2,
+			expected: []metric{
+				{Name: "current_amperes", Value: -2, MetricType: config.MetricTypeGauge},
+				{Name: "frequency_hertz", Value: 50, MetricType: config.MetricTypeGauge},
+			},
+			expectedRequests: []fakeRequest{
+				{modbus.FuncCodeReadHoldingRegisters, 1, 1},
+				{modbus.FuncCodeReadHoldingRegisters, 10, 1},
+				{modbus.FuncCodeReadHoldingRegisters, 11, 1},
+			},
+		},
+		{
+			name:     "no matching set",
+			selector: 3,
+			expected: []metric{},
+			expectedRequests: []fakeRequest{
+				{modbus.FuncCodeReadHoldingRegisters, 1, 1},
+			},
+		},
+	} {
+		c.holdingRegisters[1] = test.selector
+		c.requests = nil
+
+		metrics, err := scrapeSelectors([]config.Selector{selector}, c, func(string, config.RegisterAddr, error) {})
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(metrics, test.expected) {
+			t.Errorf("%v: expected %v but got %v", test.name, test.expected, metrics)
+		}
+		if r := c.recorded(); !reflect.DeepEqual(r, test.expectedRequests) {
+			t.Errorf("%v: expected requests %v but got %v", test.name, test.expectedRequests, r)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+// decodeLabelValue decodes the given register data of a metric exported as a
+// label. Strings are cut to their length prefix, if any, and trimmed of NUL
+// and whitespace padding as configured.
+func decodeLabelValue(definition config.MetricDef, data []byte) (string, error) {
+	switch definition.DataType {
+	case config.ModbusRawHex:
+		return hex.EncodeToString(data), nil
+	case config.ModbusIPv4:
+		data, err := convertEndianness32b(definition.Endianness, data)
+		if err != nil {
+			return "", err
+		}
+		return net.IP(data).String(), nil
+	case config.ModbusMAC:
+		data, err := convertEndiannessMAC(definition.Endianness, data)
+		if err != nil {
+			return "", err
+		}
+		return net.HardwareAddr(data).String(), nil
+	}
+
+	if definition.LengthPrefix > 0 {
+		var err error
+		if data, err = stripLengthPrefix(definition.LengthPrefix, data); err != nil {
+			return "", err
+		}
+	}
+
+	s, err := decodeString(definition.Encoding, data)
+	if err != nil {
+		return "", err
+	}
+
+	trimNull, trimSpace := definition.ShouldTrimNull(), definition.TrimSpace
+	return strings.TrimFunc(s, func(r rune) bool {
+		return (trimNull && r == 0) || (trimSpace && unicode.IsSpace(r))
+	}), nil
+}
+
+// stripLengthPrefix returns the string bytes following a big endian length
+// prefix of the given size.
+func stripLengthPrefix(size int, data []byte) ([]byte, error) {
+	var length int
+	for _, b := range data[:size] {
+		length = length<<8 | int(b)
+	}
+	data = data[size:]
+	if length > len(data) {
+		return nil, fmt.Errorf("length prefix %v exceeds the %v bytes of the string", length, len(data))
+	}
+
+	return data[:length], nil
+}
+
+// decodeString decodes the given register data in the given encoding into
+// a valid UTF-8 string.
+func decodeString(encoding config.StringEncoding, data []byte) (string, error) {
+	var s strings.Builder
+
+	switch encoding {
+	case config.StringEncodingASCII, "":
+		for _, b := range data {
+			if b > unicode.MaxASCII {
+				s.WriteRune(utf8.RuneError)
+				continue
+			}
+			s.WriteByte(b)
+		}
+	case config.StringEncodingLatin1:
+		for _, b := range data {
+			s.WriteRune(rune(b))
+		}
+	case config.StringEncodingUTF16BE, config.StringEncodingUTF16LE:
+		var order binary.ByteOrder = binary.BigEndian
+		if encoding == config.StringEncodingUTF16LE {
+			order = binary.LittleEndian
+		}
+
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[2*i:])
+		}
+		for _, r := range utf16.Decode(units) {
+			s.WriteRune(r)
+		}
+	default:
+		return "", fmt.Errorf("unknown string encoding '%v'", encoding)
+	}
+
+	return s.String(), nil
+}
+
+// convertEndiannessMAC converts the 6 bytes of a MAC address from the given
+// endianness to big endian. Mixed endianness swaps the bytes of each register
+// and yolo the order of the registers.
+func convertEndiannessMAC(endianness config.EndiannessType, rawData []byte) ([]byte, error) {
+	if len(rawData) != 6 {
+		return nil, fmt.Errorf("expected 6 bytes, got %v", len(rawData))
+	}
+
+	data := make([]byte, 6)
+	for i := range data {
+		switch endianness {
+		case config.EndiannessLittleEndian:
+			data[i] = rawData[5-i]
+		case config.EndiannessMixedEndian:
+			data[i] = rawData[i^1]
+		case config.EndiannessYolo:
+			data[i] = rawData[4-2*(i/2)+i%2]
+		default:
+			data[i] = rawData[i]
+		}
+	}
+
+	return data, nil
+}
@@ -0,0 +1,251 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+func TestDecodeString(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		encoding config.StringEncoding
+		data     []byte
+		expected string
+	}{
+		{"ascii", config.StringEncodingASCII, []byte("Pump 1\x00\x00"), "Pump 1"},
+		{"ascii non-ascii byte", config.StringEncodingASCII, []byte{'c', 'a', 'f', 0xE9}, "caf�"},
+		{"latin1", config.StringEncodingLatin1, []byte{'c', 'a', 'f', 0xE9}, "café"},
+		{"utf16be", config.StringEncodingUTF16BE, []byte{0x00, 'G', 0x00, 0xFC, 0x00, 0xDF, 0x00, 0x00}, "Güß"},
+		{"utf16le", config.StringEncodingUTF16LE, []byte{'G', 0x00, 0xFC, 0x00, 0xDF, 0x00}, "Güß"},
+		{"utf16be surrogate pair", config.StringEncodingUTF16BE, []byte{0xD8, 0x3D, 0xDE, 0x00}, "😀"},
+	} {
+		definition := config.MetricDef{DataType: config.ModbusString, Encoding: test.encoding}
+		s, err := decodeLabelValue(definition, test.data)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if s != test.expected {
+			t.Errorf("%v: expected %q but got %q", test.name, test.expected, s)
+		}
+	}
+}
+
+func TestDecodeLabelValueTrimming(t *testing.T) {
+	disabled := false
+
+	for _, test := range []struct {
+		name       string
+		definition config.MetricDef
+		data       []byte
+		expected   string
+	}{
+		{
+			"null and space padded",
+			config.MetricDef{TrimSpace: true},
+			[]byte("\x00 Pump 1 \x00 \x00"),
+			"Pump 1",
+		},
+		{
+			"space padding kept by default",
+			config.MetricDef{},
+			[]byte("Pump 1  \x00"),
+			"Pump 1  ",
+		},
+		{
+			"null padding kept",
+			config.MetricDef{TrimNull: &disabled},
+			[]byte("Pump\x00\x00"),
+			"Pump\x00\x00",
+		},
+		{
+			"one byte length prefix",
+			config.MetricDef{LengthPrefix: 1},
+			[]byte{5, 'P', 'u', 'm', 'p', '1', 'x', 'x', 'x'},
+			"Pump1",
+		},
+		{
+			"two byte length prefix",
+			config.MetricDef{LengthPrefix: 2, TrimSpace: true},
+			[]byte{0x00, 0x05, 'P', 'u', 'm', 'p', ' ', '9'},
+			"Pump",
+		},
+	} {
+		test.definition.DataType = config.ModbusString
+		s, err := decodeLabelValue(test.definition, test.data)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if s != test.expected {
+			t.Errorf("%v: expected %q but got %q", test.name, test.expected, s)
+		}
+	}
+
+	_, err := decodeLabelValue(
+		config.MetricDef{DataType: config.ModbusString, LengthPrefix: 1},
+		[]byte{4, 'a', 'b'},
+	)
+	if err == nil {
+		t.Error("expected an error for a length prefix exceeding the string")
+	}
+}
+
+func TestScrapeMetricsString(t *testing.T) {
+	definitions := []config.MetricDef{
+		{
+			Name:       "device_info",
+			Labels:     map[string]string{"kind": "pump"},
+			Address:    300001,
+			DataType:   config.ModbusString,
+			MetricType: config.MetricTypeGauge,
+			Length:     2,
+			Encoding:   config.StringEncodingLatin1,
+			ValueLabel: "location",
+		},
+	}
+
+	c := newFakeClient()
+	c.holdingRegisters[1] = 'S'<<8 | 0xE8
+	c.holdingRegisters[2] = 'v'<<8 | 'e'
+
+	metrics, err := scrapeMetrics(definitions, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l := metrics[0].Labels["location"]; l != "Sève" {
+		t.Fatalf("expected location label %q but got %q", "Sève", l)
+	}
+	if l := metrics[0].Labels["kind"]; l != "pump" {
+		t.Fatalf("expected kind label %q but got %q", "pump", l)
+	}
+	if v := metrics[0].Value; v != 1 {
+		t.Fatalf("expected value 1 but got %v", v)
+	}
+	if _, ok := definitions[0].Labels["location"]; ok {
+		t.Fatal("expected configured labels not to be modified")
+	}
+}
+
+func TestScrapeMetricsRawHex(t *testing.T) {
+	definitions := []config.MetricDef{
+		{
+			Name:       "opaque_register",
+			Address:    400001,
+			DataType:   config.ModbusRawHex,
+			MetricType: config.MetricTypeGauge,
+			Length:     1,
+		},
+	}
+
+	c := newFakeClient()
+	c.inputRegisters[1] = 0x1234
+
+	metrics, err := scrapeMetrics(definitions, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l := metrics[0].Labels["value"]; l != "1234" {
+		t.Fatalf("expected value label %q but got %q", "1234", l)
+	}
+	if v := metrics[0].Value; v != 1 {
+		t.Fatalf("expected value 1 but got %v", v)
+	}
+}
+
+func TestScrapeMetricsIPv4(t *testing.T) {
+	for _, test := range []struct {
+		endianness config.EndiannessType
+		registers  [2]uint16
+	}{
+		{config.EndiannessBigEndian, [2]uint16{0xc0a8, 0x010a}},
+		{config.EndiannessLittleEndian, [2]uint16{0x0a01, 0xa8c0}},
+		{config.EndiannessMixedEndian, [2]uint16{0xa8c0, 0x0a01}},
+		{config.EndiannessYolo, [2]uint16{0x010a, 0xc0a8}},
+	} {
+		t.Run(string(test.endianness), func(t *testing.T) {
+			definitions := []config.MetricDef{
+				{
+					Name:       "device_ip_address_info",
+					Address:    300001,
+					DataType:   config.ModbusIPv4,
+					MetricType: config.MetricTypeGauge,
+					Endianness: test.endianness,
+					ValueLabel: "address",
+				},
+			}
+
+			c := newFakeClient()
+			c.holdingRegisters[1] = test.registers[0]
+			c.holdingRegisters[2] = test.registers[1]
+
+			metrics, err := scrapeMetrics(definitions, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if l := metrics[0].Labels["address"]; l != "192.168.1.10" {
+				t.Fatalf("expected address label %q but got %q", "192.168.1.10", l)
+			}
+			if v := metrics[0].Value; v != 1 {
+				t.Fatalf("expected value 1 but got %v", v)
+			}
+		})
+	}
+}
+
+func TestScrapeMetricsMAC(t *testing.T) {
+	for _, test := range []struct {
+		endianness config.EndiannessType
+		registers  [3]uint16
+	}{
+		{config.EndiannessBigEndian, [3]uint16{0xdead, 0xbeef, 0x0001}},
+		{config.EndiannessLittleEndian, [3]uint16{0x0100, 0xefbe, 0xadde}},
+		{config.EndiannessMixedEndian, [3]uint16{0xadde, 0xefbe, 0x0100}},
+		{config.EndiannessYolo, [3]uint16{0x0001, 0xbeef, 0xdead}},
+	} {
+		t.Run(string(test.endianness), func(t *testing.T) {
+			definitions := []config.MetricDef{
+				{
+					Name:       "device_mac_address_info",
+					Address:    300001,
+					DataType:   config.ModbusMAC,
+					MetricType: config.MetricTypeGauge,
+					Endianness: test.endianness,
+					ValueLabel: "address",
+				},
+			}
+
+			c := newFakeClient()
+			for i, r := range test.registers {
+				c.holdingRegisters[uint16(i+1)] = r
+			}
+
+			metrics, err := scrapeMetrics(definitions, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if l := metrics[0].Labels["address"]; l != "de:ad:be:ef:00:01" {
+				t.Fatalf("expected address label %q but got %q", "de:ad:be:ef:00:01", l)
+			}
+			if v := metrics[0].Value; v != 1 {
+				t.Fatalf("expected value 1 but got %v", v)
+			}
+		})
+	}
+}
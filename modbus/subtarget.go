@@ -0,0 +1,82 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ScrapeSubTargets scrapes each of the sub-targets configured by the given
+// module on the given target one after another, as devices on a serial bus
+// behind a gateway can only answer one request at a time. The series of each
+// sub-target are labeled with sub_target. A failing sub-target is logged and
+// only omits its own series, reported by modbus_sub_target_up. The scrape
+// fails only if all sub-targets fail.
+func (e *Exporter) ScrapeSubTargets(targetAddress string, moduleName string) (prometheus.Gatherer, error) {
+	return e.cachedScrape(scrapeCacheKey{moduleName, targetAddress, ""}, func() (prometheus.Gatherer, error) {
+		return e.runScrape(func() (prometheus.Gatherer, error) {
+			return e.scrapeSubTargets(targetAddress, moduleName)
+		})
+	})
+}
+
+// scrapeSubTargets scrapes each of the sub-targets of the given module on the
+// given target, see ScrapeSubTargets.
+func (e *Exporter) scrapeSubTargets(targetAddress string, moduleName string) (prometheus.Gatherer, error) {
+	module := e.GetConfig().GetModule(moduleName)
+	if module == nil {
+		return nil, fmt.Errorf("failed to find '%v' in config", moduleName)
+	}
+	if len(module.SubTargets) == 0 {
+		return nil, fmt.Errorf("module '%v' does not configure sub-targets", moduleName)
+	}
+
+	up := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "modbus_sub_target_up",
+		Help: "Whether the sub-target was scraped successfully (1) or not (0).",
+	}, []string{"sub_target"})
+	upReg := prometheus.NewRegistry()
+	upReg.MustRegister(up)
+	gatherers := prometheus.Gatherers{upReg}
+
+	var lastErr error
+	for _, subTarget := range module.SubTargets {
+		label := strconv.Itoa(int(subTarget))
+
+		// Each sub-target registers with its own registry, so that a failed
+		// scrape cannot leave some of its series behind.
+		reg := prometheus.NewRegistry()
+		err := e.scrape(prometheus.WrapRegistererWith(prometheus.Labels{"sub_target": label}, reg), targetAddress, subTarget, moduleName)
+		if err != nil {
+			level.Warn(e.Logger).Log("msg", "failed to scrape sub-target", "module", moduleName,
+				"target", targetAddress, "sub_target", subTarget, "err", err)
+			up.WithLabelValues(label).Set(0)
+			lastErr = err
+			continue
+		}
+
+		up.WithLabelValues(label).Set(1)
+		gatherers = append(gatherers, reg)
+	}
+
+	if len(gatherers) == 1 {
+		return nil, fmt.Errorf("failed to scrape all sub-targets: %v", lastErr)
+	}
+
+	return gatherers, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScrapeSubTargets(t *testing.T) {
+	module := config.Module{
+		Name:       "my_module",
+		Protocol:   config.ModbusProtocolTCPIP,
+		SubTargets: []byte{1, 2, 3},
+		Metrics: []config.MetricDef{
+			{
+				Name:       "temperature",
+				Help:       "Temperature.",
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+		},
+	}
+
+	for _, test := range []struct {
+		name     string
+		failing  map[byte]bool
+		expected string
+	}{
+		{
+			name: "all sub-targets",
+			expected: `
+# HELP modbus_sub_target_up Whether the sub-target was scraped successfully (1) or not (0).
+# TYPE modbus_sub_target_up gauge
+modbus_sub_target_up{sub_target="1"} 1
+modbus_sub_target_up{sub_target="2"} 1
+modbus_sub_target_up{sub_target="3"} 1
+# HELP temperature Temperature.
+# TYPE temperature gauge
+temperature{module="my_module",sub_target="1"} 10
+temperature{module="my_module",sub_target="2"} 20
+temperature{module="my_module",sub_target="3"} 30
+`,
+		},
+		{
+			name:    "failing sub-target",
+			failing: map[byte]bool{2: true},
+			expected: `
+# HELP modbus_sub_target_up Whether the sub-target was scraped successfully (1) or not (0).
+# TYPE modbus_sub_target_up gauge
+modbus_sub_target_up{sub_target="1"} 1
+modbus_sub_target_up{sub_target="2"} 0
+modbus_sub_target_up{sub_target="3"} 1
+# HELP temperature Temperature.
+# TYPE temperature gauge
+temperature{module="my_module",sub_target="1"} 10
+temperature{module="my_module",sub_target="3"} 30
+`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			e := NewExporter(config.Config{Modules: []config.Module{module}})
+			e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+				c := newFakeClient()
+				c.holdingRegisters[1] = uint16(10 * subTarget)
+				if test.failing[subTarget] {
+					c.fail = func(fakeRequest) error { return fmt.Errorf("i/o timeout") }
+				}
+				return &connection{client: c, close: func() error { return nil }}, nil
+			}
+
+			g, err := e.ScrapeSubTargets("127.0.0.1:502", "my_module")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := testutil.GatherAndCompare(g, strings.NewReader(test.expected)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestScrapeSubTargetsAllFailing(t *testing.T) {
+	module := config.Module{
+		Name:       "my_module",
+		Protocol:   config.ModbusProtocolTCPIP,
+		SubTargets: []byte{1, 2},
+		Metrics: []config.MetricDef{
+			{
+				Name:       "temperature",
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+		},
+	}
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return nil, fmt.Errorf("unable to connect with target %s via module %s", target, module.Name)
+	}
+
+	if _, err := e.ScrapeSubTargets("127.0.0.1:502", "my_module"); err == nil {
+		t.Fatal("expected scrape to fail if all sub-targets fail")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+// readStart identifies a read by its function code and start address.
+type readStart struct {
+	function uint64
+	address  int
+}
+
+// timeoutClient is a modbus.Client performing the reads of metrics
+// configuring a read timeout with that timeout, set on the connection's
+// handler for the duration of the read.
+type timeoutClient struct {
+	modbus.Client
+
+	timeouts map[readStart]time.Duration
+	// setTimeout sets the timeout of the following requests, returning the
+	// previous one.
+	setTimeout func(time.Duration) time.Duration
+}
+
+// newTimeoutClient returns the given client applying the read timeouts of the
+// given definitions, or the client itself if none configures one.
+func newTimeoutClient(c modbus.Client, definitions []config.MetricDef, setTimeout func(time.Duration) time.Duration) (modbus.Client, error) {
+	timed := []config.MetricDef{}
+	for _, definition := range definitions {
+		if definition.ReadTimeout > 0 {
+			timed = append(timed, definition)
+		}
+	}
+	if len(timed) == 0 || setTimeout == nil {
+		return c, nil
+	}
+
+	reads, err := planReads(timed)
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts := map[readStart]time.Duration{}
+	for _, r := range reads {
+		timeouts[readStart{r.function, r.address}] = r.timeout
+	}
+	for _, definition := range timed {
+		for _, address := range definition.FallbackAddresses {
+			modFunction, modAddress, err := splitAddress(address)
+			if err != nil {
+				return nil, err
+			}
+			timeouts[readStart{modFunction, int(modAddress) - definition.PadBefore}] = definition.ReadTimeout
+		}
+	}
+
+	return &timeoutClient{Client: c, timeouts: timeouts, setTimeout: setTimeout}, nil
+}
+
+func (c *timeoutClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	return c.read(1, c.Client.ReadCoils, address, quantity)
+}
+
+func (c *timeoutClient) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+	return c.read(2, c.Client.ReadDiscreteInputs, address, quantity)
+}
+
+func (c *timeoutClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	return c.read(3, c.Client.ReadHoldingRegisters, address, quantity)
+}
+
+func (c *timeoutClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	return c.read(4, c.Client.ReadInputRegisters, address, quantity)
+}
+
+func (c *timeoutClient) read(function uint64, f modbusFunc, address, quantity uint16) ([]byte, error) {
+	timeout, ok := c.timeouts[readStart{function, int(address)}]
+	if !ok {
+		return f(address, quantity)
+	}
+
+	previous := c.setTimeout(timeout)
+	defer c.setTimeout(previous)
+
+	return f(address, quantity)
+}
+
+// isTimeout returns whether the given error is a request timing out.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
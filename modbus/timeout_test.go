@@ -0,0 +1,108 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+func TestScrapeModuleReadTimeout(t *testing.T) {
+	module := &config.Module{
+		Name:           "slow",
+		CoalesceReads:  true,
+		CoalesceMaxGap: 10,
+		Metrics: []config.MetricDef{
+			{Name: "fast", Address: 300001, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge, OnError: config.OnErrorDrop},
+			{Name: "slow", Address: 300002, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge, OnError: config.OnErrorDrop, ReadTimeout: time.Second},
+			{Name: "slower", Address: 300003, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge, OnError: config.OnErrorDrop, ReadTimeout: 2 * time.Second},
+			{Name: "other", Address: 300004, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge, OnError: config.OnErrorDrop},
+		},
+	}
+
+	// Registers take the given time to compute, failing the read if it
+	// exceeds the timeout of the connection.
+	delays := map[uint16]time.Duration{2: 500 * time.Millisecond, 3: 5 * time.Second}
+	timeout := 100 * time.Millisecond
+	timeouts := map[uint16]time.Duration{}
+
+	c := newFakeClient()
+	for i := uint16(1); i <= 4; i++ {
+		c.holdingRegisters[i] = 10 * i
+	}
+	c.fail = func(r fakeRequest) error {
+		timeouts[r.address] = timeout
+		for i := r.address; i < r.address+r.quantity; i++ {
+			if delays[i] > timeout {
+				return os.ErrDeadlineExceeded
+			}
+		}
+		return nil
+	}
+
+	conn := &connection{client: c, setTimeout: func(d time.Duration) time.Duration {
+		previous := timeout
+		timeout = d
+		return previous
+	}}
+
+	metrics, err := scrapeModule(module, conn, func(string, config.RegisterAddr, error) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]float64{}
+	for _, m := range metrics {
+		values[m.Name] = m.Value
+	}
+	expected := map[string]float64{"fast": 10, "slow": 20, "other": 40}
+	if len(values) != len(expected) {
+		t.Fatalf("expected metrics %v but got %v", expected, values)
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("expected %v to be %v but got %v", name, value, values[name])
+		}
+	}
+
+	// Reads of different timeouts are not coalesced. The module's timeout is
+	// restored after each timed read.
+	expectedRequests := []fakeRequest{
+		{0x03, 1, 1},
+		{0x03, 2, 1},
+		{0x03, 3, 1},
+		{0x03, 4, 1},
+	}
+	if len(c.requests) != len(expectedRequests) {
+		t.Fatalf("expected requests %v but got %v", expectedRequests, c.requests)
+	}
+	expectedTimeouts := map[uint16]time.Duration{1: 100 * time.Millisecond, 2: time.Second, 3: 2 * time.Second, 4: 100 * time.Millisecond}
+	for address, d := range expectedTimeouts {
+		if timeouts[address] != d {
+			t.Errorf("expected read of %v with timeout %v but got %v", address, d, timeouts[address])
+		}
+	}
+	if timeout != 100*time.Millisecond {
+		t.Errorf("expected timeout to be restored to 100ms but got %v", timeout)
+	}
+
+	// Timeouts of metrics without their own fail the scrape.
+	delays[4] = time.Second
+	if _, err := scrapeModule(module, conn, func(string, config.RegisterAddr, error) {}); err == nil {
+		t.Error("expected the scrape to fail on a timeout of a metric without read timeout")
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+const (
+	// mbapHeaderSize is the size of the Modbus TCP application protocol
+	// header, including the unit identifier.
+	mbapHeaderSize = 7
+	// maxTCPFrameSize is the maximum size of a Modbus TCP frame.
+	maxTCPFrameSize = 260
+)
+
+// dialFunc opens a stream to the given target to exchange Modbus TCP frames
+// over, e.g. a tunnel.
+type dialFunc func(module *config.Module, target string) (io.ReadWriteCloser, error)
+
+// newExporterWithDialer returns a new modbus exporter exchanging Modbus TCP
+// frames over the streams opened by the given function instead of dialing TCP
+// connections itself.
+func newExporterWithDialer(c config.Config, dial dialFunc) *Exporter {
+	e := NewExporter(c)
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return e.connectStream(module, target, subTarget, dial)
+	}
+
+	return e
+}
+
+// connectStream establishes a new modbus connection to the given target over
+// a stream opened by the given function.
+func (e *Exporter) connectStream(module *config.Module, target string, subTarget byte, dial dialFunc) (*connection, error) {
+	var rwc io.ReadWriteCloser
+	err := connectWithRetries(module, func() error {
+		var err error
+		rwc, err = dial(module, target)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect with target %s via module %s",
+			target, module.Name)
+	}
+
+	transporter := &streamTransporter{rwc: rwc, timeout: streamTimeout(module)}
+
+	handler := e.countBytes(module, target, &streamClientHandler{
+		Packager:    e.newTCPClientHandler(module, target, subTarget),
+		Transporter: transporter,
+	})
+
+	return &connection{
+		handler: handler,
+		client:  modbus.NewClient(handler),
+		close:   rwc.Close,
+		setTimeout: func(timeout time.Duration) time.Duration {
+			previous := transporter.timeout
+			transporter.timeout = timeout
+			return previous
+		},
+	}, nil
+}
+
+// defaultStreamTimeout is the timeout of connections over streams of modules
+// not configuring one, the same as of the modbus TCP client handler.
+const defaultStreamTimeout = 10 * time.Second
+
+// streamTimeout returns the timeout of the given module's connections over
+// streams, defaulting to defaultStreamTimeout.
+func streamTimeout(module *config.Module) time.Duration {
+	if module.Timeout == 0 {
+		return defaultStreamTimeout
+	}
+
+	return time.Duration(module.Timeout) * time.Millisecond
+}
+
+// streamClientHandler is a modbus.ClientHandler framing requests as Modbus TCP
+// and sending them over a stream.
+type streamClientHandler struct {
+	modbus.Packager
+	modbus.Transporter
+}
+
+// streamTransporter is a modbus.Transporter exchanging Modbus TCP frames over
+// a stream.
+type streamTransporter struct {
+	rwc io.ReadWriteCloser
+	// timeout of each request, only applied to streams supporting deadlines.
+	timeout time.Duration
+}
+
+// Send implements modbus.Transporter.
+func (t *streamTransporter) Send(aduRequest []byte) ([]byte, error) {
+	if d, ok := t.rwc.(interface{ SetDeadline(time.Time) error }); ok && t.timeout > 0 {
+		if err := d.SetDeadline(time.Now().Add(t.timeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := t.rwc.Write(aduRequest); err != nil {
+		return nil, err
+	}
+
+	aduResponse := make([]byte, maxTCPFrameSize)
+	if _, err := io.ReadFull(t.rwc, aduResponse[:mbapHeaderSize]); err != nil {
+		return nil, err
+	}
+
+	// The length covers the unit identifier, which is part of the header,
+	// and the protocol data unit.
+	length := int(binary.BigEndian.Uint16(aduResponse[4:]))
+	if length < 2 || mbapHeaderSize-1+length > maxTCPFrameSize {
+		return nil, fmt.Errorf("modbus: invalid length in response header '%v'", length)
+	}
+
+	size := mbapHeaderSize - 1 + length
+	if _, err := io.ReadFull(t.rwc, aduResponse[mbapHeaderSize:size]); err != nil {
+		return nil, err
+	}
+
+	return aduResponse[:size], nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScrapeOverStream(t *testing.T) {
+	module := config.Module{
+		Name:     "my_module",
+		Protocol: config.ModbusProtocolTCPIP,
+		Metrics: []config.MetricDef{
+			{
+				Name:       "temperature",
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+			{
+				Name:       "energy_total",
+				Address:    400002,
+				DataType:   config.ModbusUInt32,
+				MetricType: config.MetricTypeCounter,
+			},
+		},
+	}
+
+	holdingRegisters := map[uint16]uint16{1: 0xFFF6}
+	inputRegisters := map[uint16]uint16{2: 0x0001, 3: 0x0002}
+
+	dials := 0
+	e := newExporterWithDialer(config.Config{Modules: []config.Module{module}}, func(module *config.Module, target string) (io.ReadWriteCloser, error) {
+		dials++
+		client, server := net.Pipe()
+		go respond(server, holdingRegisters, inputRegisters)
+		return client, nil
+	})
+
+	reg, err := e.Scrape("tunnel:502", 1, "my_module")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dials != 1 {
+		t.Fatalf("expected 1 dial but got %v", dials)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]float64{}
+	for _, f := range families {
+		m := f.GetMetric()[0]
+		if m.GetGauge() != nil {
+			values[f.GetName()] = m.GetGauge().GetValue()
+		} else {
+			values[f.GetName()] = m.GetCounter().GetValue()
+		}
+	}
+	if values["temperature"] != -10 {
+		t.Errorf("expected temperature -10 but got %v", values["temperature"])
+	}
+	if values["energy_total"] != 0x00010002 {
+		t.Errorf("expected energy_total %v but got %v", 0x00010002, values["energy_total"])
+	}
+}
+
+func TestConnectionBytesCounter(t *testing.T) {
+	module := config.Module{
+		Name:                 "my_module",
+		Protocol:             config.ModbusProtocolTCPIP,
+		CountConnectionBytes: true,
+		Metrics: []config.MetricDef{
+			{
+				Name:       "temperature",
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+			{
+				Name:       "energy_total",
+				Address:    400002,
+				DataType:   config.ModbusUInt32,
+				MetricType: config.MetricTypeCounter,
+			},
+		},
+	}
+
+	e := newExporterWithDialer(config.Config{Modules: []config.Module{module}}, func(module *config.Module, target string) (io.ReadWriteCloser, error) {
+		client, server := net.Pipe()
+		go respond(server, map[uint16]uint16{1: 1}, map[uint16]uint16{2: 2, 3: 3})
+		return client, nil
+	})
+
+	if _, err := e.Scrape("tunnel:502", 1, "my_module"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both requests consist of the MBAP header, function code, address and
+	// quantity. The responses consist of the MBAP header, function code,
+	// byte count and the 1 and 2 registers read.
+	for direction, expected := range map[string]float64{
+		"written": 2 * (7 + 5),
+		"read":    (7 + 2 + 2) + (7 + 2 + 4),
+	} {
+		if b := testutil.ToFloat64(e.connectionBytes.WithLabelValues("my_module", "tunnel:502", direction)); b != expected {
+			t.Errorf("expected %v bytes %v but got %v", expected, direction, b)
+		}
+	}
+}
+
+// respond serves read holding / input registers requests received via the
+// given stream from the given registers until the stream is closed, responding
+// to other requests with an illegal function exception.
+func respond(rwc io.ReadWriteCloser, holdingRegisters, inputRegisters map[uint16]uint16) {
+	defer rwc.Close()
+
+	for {
+		header := make([]byte, mbapHeaderSize)
+		if _, err := io.ReadFull(rwc, header); err != nil {
+			return
+		}
+		pdu := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+		if _, err := io.ReadFull(rwc, pdu); err != nil {
+			return
+		}
+
+		var registers map[uint16]uint16
+		switch pdu[0] {
+		case modbus.FuncCodeReadHoldingRegisters:
+			registers = holdingRegisters
+		case modbus.FuncCodeReadInputRegisters:
+			registers = inputRegisters
+		}
+
+		response := []byte{pdu[0] | 0x80, modbus.ExceptionCodeIllegalFunction}
+		if registers != nil {
+			address := binary.BigEndian.Uint16(pdu[1:])
+			quantity := binary.BigEndian.Uint16(pdu[3:])
+
+			response = []byte{pdu[0], byte(2 * quantity)}
+			for i := uint16(0); i < quantity; i++ {
+				response = binary.BigEndian.AppendUint16(response, registers[address+i])
+			}
+		}
+
+		frame := append([]byte{}, header[:4]...)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(response)+1))
+		frame = append(frame, header[6])
+		if _, err := rwc.Write(append(frame, response...)); err != nil {
+			return
+		}
+	}
+}
+
+func TestStreamTimeout(t *testing.T) {
+	if timeout := streamTimeout(&config.Module{}); timeout != 10*time.Second {
+		t.Errorf("expected the default timeout of 10s but got %v", timeout)
+	}
+	if timeout := streamTimeout(&config.Module{Timeout: 500}); timeout != 500*time.Millisecond {
+		t.Errorf("expected the module's timeout of 500ms but got %v", timeout)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"sort"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+// retainedSeries is the last successfully read value of a series.
+type retainedSeries struct {
+	metric metric
+	// misses is the number of consecutive scrapes which failed to read the
+	// series.
+	misses int
+	// read is the time the series was last read successfully.
+	read time.Time
+}
+
+// retainSeries returns the metrics read from the given target along with the
+// series read on previous scrapes which failed to be read for at most the
+// module's series TTL, exported with their last read value. Series failing to
+// be read for longer are dropped. Failed scrapes count as a miss for all
+// series of the target. Modules configuring a stale after duration instead
+// retain series until it elapsed since their last successful read, then drop
+// them, for Prometheus to mark them stale.
+func (e *Exporter) retainSeries(module *config.Module, key connectionKey, metrics []metric, scrapeErr error) []metric {
+	if module.SeriesTTL <= 0 && module.StaleAfter <= 0 {
+		return metrics
+	}
+
+	e.seriesMu.Lock()
+	defer e.seriesMu.Unlock()
+
+	series, ok := e.series[key]
+	if !ok {
+		series = map[string]*retainedSeries{}
+		e.series[key] = series
+	}
+
+	read := map[string]bool{}
+	if scrapeErr == nil {
+		for _, m := range metrics {
+			id := seriesID(m)
+			series[id] = &retainedSeries{metric: m, read: e.now()}
+			read[id] = true
+		}
+	}
+
+	ids := make([]string, 0, len(series))
+	for id := range series {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if read[id] {
+			continue
+		}
+
+		s := series[id]
+		if module.StaleAfter > 0 {
+			if e.now().Sub(s.read) > module.StaleAfter {
+				delete(series, id)
+				continue
+			}
+		} else {
+			s.misses++
+			if s.misses > module.SeriesTTL {
+				delete(series, id)
+				continue
+			}
+		}
+
+		if scrapeErr == nil {
+			metrics = append(metrics, s.metric)
+		}
+	}
+
+	return metrics
+}
+
+// seriesID returns a string uniquely identifying the series of the given
+// metric.
+func seriesID(m metric) string {
+	return m.Name + "{" + labelsSignature(m.Labels) + "}"
+}
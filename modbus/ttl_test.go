@@ -0,0 +1,181 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSeriesTTL(t *testing.T) {
+	module := config.Module{
+		Name:      "my_module",
+		Protocol:  config.ModbusProtocolTCPIP,
+		SeriesTTL: 2,
+		Metrics: []config.MetricDef{
+			{
+				Name:       "always_read",
+				Address:    300001,
+				DataType:   config.ModbusInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+			{
+				Name:         "sometimes_read",
+				Address:      300002,
+				DataType:     config.ModbusInt16,
+				MetricType:   config.MetricTypeGauge,
+				SuppressZero: true,
+			},
+		},
+	}
+
+	c := newFakeClient()
+	c.holdingRegisters[1] = 1
+	reachable := true
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		if !reachable {
+			return nil, fmt.Errorf("unable to connect with target %s via module %s", target, module.Name)
+		}
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	for i, step := range []struct {
+		value     uint16
+		reachable bool
+		expected  float64
+		exported  bool
+	}{
+		{value: 5, reachable: true, expected: 5, exported: true},
+		// Failed reads keep the last value for up to two scrapes.
+		{value: 0, reachable: true, expected: 5, exported: true},
+		{value: 0, reachable: true, expected: 5, exported: true},
+		{value: 0, reachable: true, exported: false},
+		// A successful read exports the series again.
+		{value: 7, reachable: true, expected: 7, exported: true},
+		// Failed scrapes count as failed reads.
+		{value: 7, reachable: false},
+		{value: 0, reachable: true, expected: 7, exported: true},
+		{value: 0, reachable: true, exported: false},
+	} {
+		c.holdingRegisters[2] = step.value
+		reachable = step.reachable
+
+		reg, err := e.Scrape("localhost:502", 1, "my_module")
+		if !step.reachable {
+			if err == nil {
+				t.Fatalf("step %v: expected scrape to fail", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("step %v: %v", i, err)
+		}
+
+		if n, err := testutil.GatherAndCount(reg, "always_read"); err != nil || n != 1 {
+			t.Fatalf("step %v: expected always_read to be exported but got %v series: %v", i, n, err)
+		}
+
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exported := false
+		for _, f := range families {
+			if f.GetName() != "sometimes_read" {
+				continue
+			}
+			exported = true
+			if v := f.GetMetric()[0].GetGauge().GetValue(); v != step.expected {
+				t.Fatalf("step %v: expected value %v but got %v", i, step.expected, v)
+			}
+		}
+		if exported != step.exported {
+			t.Fatalf("step %v: expected sometimes_read to be exported %v but got %v", i, step.exported, exported)
+		}
+	}
+}
+
+func TestStaleAfter(t *testing.T) {
+	module := config.Module{
+		Name:       "my_module",
+		Protocol:   config.ModbusProtocolTCPIP,
+		StaleAfter: time.Minute,
+		Metrics: []config.MetricDef{
+			{
+				Name:         "sometimes_read",
+				Address:      300001,
+				DataType:     config.ModbusInt16,
+				MetricType:   config.MetricTypeGauge,
+				SuppressZero: true,
+			},
+		},
+	}
+
+	c := newFakeClient()
+	now := time.Unix(1000, 0)
+
+	e := NewExporter(config.Config{Modules: []config.Module{module}})
+	e.now = func() time.Time { return now }
+	e.connect = func(module *config.Module, target string, subTarget byte) (*connection, error) {
+		return &connection{client: c, close: func() error { return nil }}, nil
+	}
+
+	for i, step := range []struct {
+		value    uint16
+		after    time.Duration
+		expected float64
+		exported bool
+	}{
+		{value: 5, expected: 5, exported: true},
+		// Failed reads keep the last value until it is a minute old, after
+		// which the series is dropped for Prometheus to mark it stale.
+		{value: 0, after: 30 * time.Second, expected: 5, exported: true},
+		{value: 0, after: 31 * time.Second, exported: false},
+		{value: 0, after: time.Second, exported: false},
+		{value: 7, after: time.Second, expected: 7, exported: true},
+	} {
+		c.holdingRegisters[1] = step.value
+		now = now.Add(step.after)
+
+		reg, err := e.Scrape("localhost:502", 1, "my_module")
+		if err != nil {
+			t.Fatalf("step %v: %v", i, err)
+		}
+
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exported := false
+		for _, f := range families {
+			if f.GetName() != "sometimes_read" {
+				continue
+			}
+			exported = true
+			v := f.GetMetric()[0].GetGauge().GetValue()
+			if v != step.expected {
+				t.Fatalf("step %v: expected value %v but got %v", i, step.expected, v)
+			}
+		}
+		if exported != step.exported {
+			t.Fatalf("step %v: expected sometimes_read to be exported %v but got %v", i, step.exported, exported)
+		}
+	}
+}
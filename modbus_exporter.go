@@ -14,11 +14,18 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
@@ -27,11 +34,13 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
 	"github.com/prometheus/exporter-toolkit/web"
 	webflag "github.com/prometheus/exporter-toolkit/web/kingpinflag"
+	"gopkg.in/yaml.v2"
 
 	"github.com/RichiH/modbus_exporter/config"
 	"github.com/RichiH/modbus_exporter/modbus"
@@ -43,6 +52,50 @@ func main() {
 			"config.file",
 			"Sets the configuration file.",
 		).Default("modbus.yml").Strings()
+		dumpConfig = kingpin.Flag(
+			"config.dump",
+			"Prints the effective configuration as YAML, with defaults applied and aliases canonicalized, and exits.",
+		).Default("false").Bool()
+		maxConnectionsPerHost = kingpin.Flag(
+			"modbus.max-connections-per-host",
+			"Maximum number of concurrent scrapes of targets on the same host, e.g. devices behind a gateway. 0 means unlimited.",
+		).Default("0").Int()
+		scrapeWorkers = kingpin.Flag(
+			"modbus.scrape-workers",
+			"Number of workers running scrapes, bounding the number of concurrent scrapes. Further scrapes wait in a queue. 0 runs every scrape directly.",
+		).Default("0").Int()
+		scrapeQueueSize = kingpin.Flag(
+			"modbus.scrape-queue-size",
+			"Number of scrapes waiting for a worker, if scrape workers are enabled.",
+		).Default("0").Int()
+		scrapeQueueOverflow = kingpin.Flag(
+			"modbus.scrape-queue-overflow",
+			"Handling of scrapes finding the scrape queue full, either 'queue' to wait for space in the queue or 'reject' to fail them with HTTP 503.",
+		).Default(string(modbus.ScrapeQueueOverflowQueue)).Enum(string(modbus.ScrapeQueueOverflowQueue), string(modbus.ScrapeQueueOverflowReject))
+		lastErrorsSize = kingpin.Flag(
+			"debug.last-errors-size",
+			"Number of the most recent failed reads of metrics kept per module and served on /debug/last-errors. 0 keeps none.",
+		).Default("100").Int()
+		once = kingpin.Flag(
+			"once",
+			"Scrapes --once.target with --once.module a single time, prints the metrics to stdout in the text exposition format and exits, without starting the HTTP server.",
+		).Default("false").Bool()
+		onceTarget = kingpin.Flag(
+			"once.target",
+			"Target scraped by --once.",
+		).Default("").String()
+		onceModule = kingpin.Flag(
+			"once.module",
+			"Module scraped by --once.",
+		).Default("").String()
+		onceSubTarget = kingpin.Flag(
+			"once.sub-target",
+			"Sub-target scraped by --once. Optional for modules configuring sub-targets.",
+		).Default("").String()
+		identity = kingpin.Flag(
+			"exporter.identity",
+			"Identity of this exporter, added as the exporter_identity label to its own metrics to distinguish several exporters scraping the same devices. Empty means no label.",
+		).Default("").String()
 		toolkitFlags = webflag.AddFlags(kingpin.CommandLine, ":9602")
 	)
 
@@ -56,10 +109,6 @@ func main() {
 	level.Info(logger).Log("msg", "Starting modbus_exporter", "version", version.Info())
 	level.Info(logger).Log("build_context", version.BuildContext())
 
-	telemetryRegistry := prometheus.NewRegistry()
-	telemetryRegistry.MustRegister(collectors.NewGoCollector())
-	telemetryRegistry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
-
 	level.Info(logger).Log("msg", "Loading configuration file(s)", "config_file", strings.Join(*configFile, ", "))
 	config, err := config.LoadConfig(*configFile)
 	if err != nil {
@@ -67,23 +116,171 @@ func main() {
 		os.Exit(1)
 	}
 
-	http.Handle("/metrics", promhttp.HandlerFor(telemetryRegistry, promhttp.HandlerOpts{}))
+	if *dumpConfig {
+		if err := writeConfig(os.Stdout, config); err != nil {
+			level.Error(logger).Log("msg", "Error dumping config", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	exporter := modbus.NewExporter(config)
-	http.Handle("/modbus",
-		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			scrapeHandler(exporter, w, r, logger)
-		}),
-	)
+	exporter.MaxConnectionsPerHost = *maxConnectionsPerHost
+	exporter.ScrapeWorkers = *scrapeWorkers
+	exporter.ScrapeQueueSize = *scrapeQueueSize
+	exporter.ScrapeQueueOverflow = modbus.ScrapeQueueOverflow(*scrapeQueueOverflow)
+	exporter.LastErrorsSize = *lastErrorsSize
+	exporter.Logger = logger
+
+	if *once {
+		if err := scrapeOnce(os.Stdout, exporter, *onceModule, *onceTarget, *onceSubTarget); err != nil {
+			level.Error(logger).Log("msg", "Error scraping once", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	go exporter.Poll(context.Background())
 
-	srv := &http.Server{}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			level.Info(logger).Log("msg", "Reloading configuration file(s)", "config_file", strings.Join(*configFile, ", "))
+			if err := exporter.ReloadConfig(*configFile); err != nil {
+				level.Error(logger).Log("msg", "Error reloading config, keeping the current one", "err", err)
+			}
+		}
+	}()
+
+	telemetryRegistry := newTelemetryRegistry(exporter, *identity)
+
+	// TLS and basic authentication configured via --web.config.file are
+	// applied by the exporter-toolkit to every endpoint served below.
+	srv := &http.Server{Handler: newHandler(exporter, telemetryRegistry, logger)}
 	if err := web.ListenAndServe(srv, toolkitFlags, logger); err != nil {
 		level.Error(logger).Log("msg", "Error starting HTTP server", "err", err)
 		os.Exit(1)
 	}
 }
 
-func scrapeHandler(e *modbus.Exporter, w http.ResponseWriter, r *http.Request, logger log.Logger) {
+// writeConfig writes the given effective configuration as YAML.
+func writeConfig(w io.Writer, c config.Config) error {
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(out)
+	return err
+}
+
+// scrapeOnce scrapes the given target a single time and writes the metrics in
+// the text exposition format.
+func scrapeOnce(w io.Writer, e *modbus.Exporter, moduleName, target, subTarget string) error {
+	if moduleName == "" || target == "" {
+		return errors.New("--once.module and --once.target must be specified")
+	}
+	module := e.GetConfig().GetModule(moduleName)
+	if module == nil {
+		return fmt.Errorf("module '%v' not defined in configuration file", moduleName)
+	}
+
+	var (
+		gatherer prometheus.Gatherer
+		err      error
+	)
+	switch {
+	case subTarget != "":
+		id, parseErr := strconv.ParseUint(subTarget, 10, 8)
+		if parseErr != nil {
+			return fmt.Errorf("--once.sub-target must be from 0 to 255: %v", parseErr)
+		}
+		gatherer, err = e.Scrape(target, byte(id), moduleName)
+	case len(module.SubTargets) > 0:
+		gatherer, err = e.ScrapeSubTargets(target, moduleName)
+	default:
+		return errors.New("--once.sub-target must be specified")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to scrape target '%v' with module '%v': %v", target, moduleName, err)
+	}
+
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	encoder := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newTelemetryRegistry returns the registry of the exporter's own metrics,
+// labeled with the given identity unless empty.
+func newTelemetryRegistry(e *modbus.Exporter, identity string) *prometheus.Registry {
+	telemetryRegistry := prometheus.NewRegistry()
+
+	var reg prometheus.Registerer = telemetryRegistry
+	if identity != "" {
+		reg = prometheus.WrapRegistererWith(prometheus.Labels{"exporter_identity": identity}, telemetryRegistry)
+	}
+
+	reg.MustRegister(collectors.NewGoCollector())
+	reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	reg.MustRegister(e)
+
+	return telemetryRegistry
+}
+
+// newHandler returns the HTTP handler serving both the exporter's own metrics,
+// including the cached metrics of polled targets, and the modbus scrape
+// endpoint.
+func newHandler(e *modbus.Exporter, telemetryRegistry *prometheus.Registry, logger log.Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{telemetryRegistry, e.Polled()}, promhttp.HandlerOpts{}))
+	mux.Handle("/modbus",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scrapeHandler(e, w, r, logger)
+		}),
+	)
+	mux.Handle("/plan",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			planHandler(e, w, r, logger)
+		}),
+	)
+	mux.Handle("/discover",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			discoverHandler(e, w, r, logger)
+		}),
+	)
+	mux.Handle("/extremes/reset",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			resetExtremesHandler(e, w, r, logger)
+		}),
+	)
+	mux.Handle("/debug/endianness",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			endiannessHandler(w, r, logger)
+		}),
+	)
+	mux.Handle("/debug/last-errors",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lastErrorsHandler(e, w, r, logger)
+		}),
+	)
+
+	return mux
+}
+
+// planHandler responds with the read requests the exporter issues on a scrape
+// of the given module as JSON, without contacting any target.
+func planHandler(e *modbus.Exporter, w http.ResponseWriter, r *http.Request, logger log.Logger) {
 	moduleName := r.URL.Query().Get("module")
 	if moduleName == "" {
 		http.Error(w, "'module' parameter must be specified", http.StatusBadRequest)
@@ -95,31 +292,195 @@ func scrapeHandler(e *modbus.Exporter, w http.ResponseWriter, r *http.Request, l
 		return
 	}
 
+	plan, err := e.ReadPlan(moduleName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to plan reads of module '%v': %v", moduleName, err), http.StatusInternalServerError)
+		level.Error(logger).Log("msg", "failed to plan reads", "module", moduleName, "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(plan); err != nil {
+		level.Error(logger).Log("msg", "failed to write read plan", "module", moduleName, "err", err)
+	}
+}
+
+// discoverHandler responds with the unit IDs responding to the discovery read
+// of the given module on the given target as JSON.
+func discoverHandler(e *modbus.Exporter, w http.ResponseWriter, r *http.Request, logger log.Logger) {
 	target := r.URL.Query().Get("target")
 	if target == "" {
 		http.Error(w, "'target' parameter must be specified", http.StatusBadRequest)
 		return
 	}
+	if !e.GetConfig().TargetAllowed(target) {
+		http.Error(w, fmt.Sprintf("target '%v' not allowed by configuration file", target), http.StatusForbidden)
+		level.Warn(logger).Log("msg", "rejected target not allowed", "target", target)
+		return
+	}
 
-	sT := r.URL.Query().Get("sub_target")
-	if sT == "" {
-		http.Error(w, "'sub_target' parameter must be specified", http.StatusBadRequest)
+	moduleName := r.URL.Query().Get("module")
+	if moduleName == "" {
+		http.Error(w, "'module' parameter must be specified", http.StatusBadRequest)
+		return
+	}
+
+	module := e.GetConfig().GetModule(moduleName)
+	if module == nil {
+		http.Error(w, fmt.Sprintf("module '%v' not defined in configuration file", moduleName), http.StatusBadRequest)
+		return
+	}
+	if module.Discovery == nil {
+		http.Error(w, fmt.Sprintf("module '%v' does not configure discovery", moduleName), http.StatusBadRequest)
 		return
 	}
 
-	subTarget, err := strconv.ParseUint(sT, 10, 32)
+	unitIDs, err := e.DiscoverUnitIDs(target, moduleName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to discover unit IDs of target '%v': %v", target, err), http.StatusInternalServerError)
+		level.Error(logger).Log("msg", "failed to discover unit IDs", "module", moduleName, "target", target, "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(unitIDs); err != nil {
+		level.Error(logger).Log("msg", "failed to write discovered unit IDs", "module", moduleName, "target", target, "err", err)
+	}
+}
+
+// resetExtremesHandler resets the minima and maxima tracked of metrics
+// configuring trackExtremes.
+func resetExtremesHandler(e *modbus.Exporter, w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "extremes can only be reset via POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	e.ResetExtremes()
+	level.Info(logger).Log("msg", "reset tracked extremes")
+}
+
+// lastErrorsHandler responds with the most recent failed reads of metrics of
+// the given module as JSON, the most recent first.
+func lastErrorsHandler(e *modbus.Exporter, w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	moduleName := r.URL.Query().Get("module")
+	if moduleName == "" {
+		http.Error(w, "'module' parameter must be specified", http.StatusBadRequest)
+		return
+	}
+
+	if !e.GetConfig().HasModule(moduleName) {
+		http.Error(w, fmt.Sprintf("module '%v' not defined in configuration file", moduleName), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(e.LastErrors(moduleName)); err != nil {
+		level.Error(logger).Log("msg", "failed to write last errors", "module", moduleName, "err", err)
+	}
+}
+
+// endiannessHandler responds with the endianness types decoding the given
+// hex-encoded register data of the given data type into the expected value as
+// JSON.
+func endiannessHandler(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	data, err := hex.DecodeString(r.URL.Query().Get("data"))
+	if err != nil || len(data) == 0 {
+		http.Error(w, "'data' parameter must be specified as hex-encoded register data", http.StatusBadRequest)
+		return
+	}
+
+	dataType := config.ModbusDataType(r.URL.Query().Get("dataType"))
+	if dataType == "" {
+		http.Error(w, "'dataType' parameter must be specified", http.StatusBadRequest)
+		return
+	}
+
+	expected, err := strconv.ParseFloat(r.URL.Query().Get("expected"), 64)
+	if err != nil {
+		http.Error(w, "'expected' parameter must be specified as a number", http.StatusBadRequest)
+		return
+	}
+
+	tolerance := 0.0
+	if t := r.URL.Query().Get("tolerance"); t != "" {
+		tolerance, err = strconv.ParseFloat(t, 64)
+		if err != nil || tolerance < 0 {
+			http.Error(w, "'tolerance' parameter must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	suggested, err := modbus.SuggestEndianness(data, dataType, expected, tolerance)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("'sub_target' parameter must be a valid integer: %v", err), http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("failed to decode data: %v", err), http.StatusBadRequest)
 		return
 	}
-	if subTarget > 255 {
-		http.Error(w, fmt.Sprintf("'sub_target' parameter must be from 0 to 255. Invalid value: %d", subTarget), http.StatusBadRequest)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(suggested); err != nil {
+		level.Error(logger).Log("msg", "failed to write endianness suggestion", "err", err)
+	}
+}
+
+func scrapeHandler(e *modbus.Exporter, w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	moduleName := r.URL.Query().Get("module")
+	if moduleName == "" {
+		http.Error(w, "'module' parameter must be specified", http.StatusBadRequest)
 		return
 	}
 
-	level.Info(logger).Log("msg", "got scrape request", "module", moduleName, "target", target, "sub_target", subTarget)
+	// The module is looked up once, as a reload may remove it while
+	// scraping.
+	c := e.GetConfig()
+	module := c.GetModule(moduleName)
+	if module == nil {
+		http.Error(w, fmt.Sprintf("module '%v' not defined in configuration file", moduleName), http.StatusBadRequest)
+		return
+	}
 
-	gatherer, err := e.Scrape(target, byte(subTarget), moduleName) // Scrape
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "'target' parameter must be specified", http.StatusBadRequest)
+		return
+	}
+	if !c.TargetAllowed(target) {
+		http.Error(w, fmt.Sprintf("target '%v' not allowed by configuration file", target), http.StatusForbidden)
+		level.Warn(logger).Log("msg", "rejected target not allowed", "target", target)
+		return
+	}
+
+	// Modules configuring sub-targets read all of them unless one is given.
+	scrape := func() (prometheus.Gatherer, error) {
+		return e.ScrapeSubTargets(target, moduleName)
+	}
+
+	sT := r.URL.Query().Get("sub_target")
+	if sT == "" && len(module.SubTargets) == 0 {
+		http.Error(w, "'sub_target' parameter must be specified", http.StatusBadRequest)
+		return
+	}
+
+	if sT != "" {
+		subTarget, err := strconv.ParseUint(sT, 10, 32)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'sub_target' parameter must be a valid integer: %v", err), http.StatusBadRequest)
+			return
+		}
+		if subTarget > 255 {
+			http.Error(w, fmt.Sprintf("'sub_target' parameter must be from 0 to 255. Invalid value: %d", subTarget), http.StatusBadRequest)
+			return
+		}
+
+		scrape = func() (prometheus.Gatherer, error) {
+			return e.Scrape(target, byte(subTarget), moduleName)
+		}
+	}
+
+	level.Info(logger).Log("msg", "got scrape request", "module", moduleName, "target", target, "sub_target", sT)
+
+	gatherer, err := scrape() // Scrape
 
 	// No errors, export data to Prometheus
 	if err == nil {
@@ -127,11 +488,18 @@ func scrapeHandler(e *modbus.Exporter, w http.ResponseWriter, r *http.Request, l
 		return
 	}
 
+	// Retrying rejected scrapes would only add to the load.
+	if errors.Is(err, modbus.ErrScrapeQueueFull) {
+		http.Error(w, fmt.Sprintf("failed to scrape target '%v' with module '%v': %v", target, moduleName, err), http.StatusServiceUnavailable)
+		level.Warn(logger).Log("msg", "rejected scrape", "target", target, "module", moduleName, "err", err)
+		return
+	}
+
 	// In case of scraping error: sleep ScrapeErrorWait time and try again for ScrapeErrorRetryCount times.
 	// Try again if a race condition if happens where the same target is queried on different sub-targets,
 	// before a previous query has gotten a response.
-	ScrapeErrorRetryCount := e.Config.GetModule(moduleName).Workarounds.ScrapeErrorRetryCount // int cannot be nil, can arise issue if user wants to set it to 0
-	ScrapeErrorWait := e.Config.GetModule(moduleName).Workarounds.ScrapeErrorWait
+	ScrapeErrorRetryCount := module.Workarounds.ScrapeErrorRetryCount // int cannot be nil, can arise issue if user wants to set it to 0
+	ScrapeErrorWait := module.Workarounds.ScrapeErrorWait
 
 	if ScrapeErrorRetryCount == 0 { // if unset or 0, set to 3 retries
 		ScrapeErrorRetryCount = 3
@@ -146,7 +514,7 @@ func scrapeHandler(e *modbus.Exporter, w http.ResponseWriter, r *http.Request, l
 		time.Sleep(time.Duration(ScrapeErrorWait) * time.Millisecond) // sleep for y milliseconds
 
 		// Another attempt at scraping
-		gatherer, err := e.Scrape(target, byte(subTarget), moduleName)
+		gatherer, err := scrape()
 		if err == nil {
 			promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
 			return
@@ -157,7 +525,8 @@ func scrapeHandler(e *modbus.Exporter, w http.ResponseWriter, r *http.Request, l
 
 	if err != nil {
 		httpStatus := http.StatusInternalServerError
-		if strings.Contains(fmt.Sprintf("%v", err), "unable to connect with target") {
+		if strings.Contains(fmt.Sprintf("%v", err), "unable to connect with target") ||
+			strings.Contains(fmt.Sprintf("%v", err), "circuit breaker open") {
 			httpStatus = http.StatusServiceUnavailable
 			//	Throw HTTP 504 StatusGatewayTimeout error in case of module returning modbus exception 11
 		} else if strings.Contains(fmt.Sprintf("%v", err), "i/o timeout") || strings.Contains(fmt.Sprintf("%v", err), "exception '11' (gateway target device failed to respond)") {
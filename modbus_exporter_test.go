@@ -14,13 +14,31 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/RichiH/modbus_exporter/config"
 	"github.com/RichiH/modbus_exporter/modbus"
 	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/exporter-toolkit/web"
+	"github.com/tbrandon/mbserver"
 )
 
 func TestScrapeHandler(t *testing.T) {
@@ -119,3 +137,557 @@ func TestScrapeHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestScrapeOnce(t *testing.T) {
+	// Reserve a free port for the fake server, which only takes an address.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	server := mbserver.NewServer()
+	server.HoldingRegisters[1] = 240
+	if err := server.ListenTCP(address); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	c := config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "my_module",
+				Protocol: config.ModbusProtocolTCPIP,
+				Timeout:  1000,
+				Metrics: []config.MetricDef{
+					{
+						Name:       "voltage",
+						Help:       "some help",
+						Address:    300001,
+						DataType:   config.ModbusUInt16,
+						MetricType: config.MetricTypeGauge,
+					},
+				},
+			},
+		},
+	}
+	exporter := modbus.NewExporter(c)
+
+	var out strings.Builder
+	if err := scrapeOnce(&out, exporter, "my_module", address, "1"); err != nil {
+		t.Fatal(err)
+	}
+	expected := `voltage{module="my_module"} 240`
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("expected output to contain %q but got:\n%v", expected, out.String())
+	}
+
+	for _, test := range []struct {
+		name, module, target, subTarget string
+	}{
+		{"no module", "", address, "1"},
+		{"no target", "my_module", "", "1"},
+		{"unknown module", "other", address, "1"},
+		{"no sub-target", "my_module", address, ""},
+		{"invalid sub-target", "my_module", address, "256"},
+	} {
+		if err := scrapeOnce(io.Discard, exporter, test.module, test.target, test.subTarget); err == nil {
+			t.Errorf("%v: expected an error", test.name)
+		}
+	}
+}
+
+func TestTelemetryRegistryIdentity(t *testing.T) {
+	c := config.Config{Modules: []config.Module{{Name: "my_module"}}}
+
+	for _, identity := range []string{"exporter-a", ""} {
+		families, err := newTelemetryRegistry(modbus.NewExporter(c), identity).Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(families) == 0 {
+			t.Fatal("expected self-metrics to be gathered")
+		}
+
+		for _, f := range families {
+			for _, m := range f.GetMetric() {
+				label := ""
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "exporter_identity" {
+						label = l.GetValue()
+					}
+				}
+				if label != identity {
+					t.Fatalf("expected %v to have exporter_identity %q but got %q", f.GetName(), identity, label)
+				}
+			}
+		}
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "modbus.yml")
+	err := os.WriteFile(file, []byte(`modules:
+  - name: "my_module"
+    protocol: "tcp/ip"
+    helpTemplate: "{name} read from register {address}"
+    defaultRegisterType: holding
+    metrics:
+      - name: "voltage"
+        address: 1
+        dataType: float
+        metricType: gauge
+      - name: "current"
+        address: 3
+        registerType: input
+        dataType: uint16
+        metricType: gauge
+    relabelConfigs:
+      - sourceLabels: [target]
+        targetLabel: "site"
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := config.LoadConfig([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := writeConfig(&out, c); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"help: voltage read from register 300001\n",
+		"dataType: float32\n",
+		"endianness: big\n",
+		"onError: drop\n",
+		"regex: (.*)\n",
+		"replacement: $1\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected dumped config to contain %q but got:\n%v", expected, out.String())
+		}
+	}
+
+	for _, unexpected := range []string{"defaultRegisterType", "registerType"} {
+		if strings.Contains(out.String(), unexpected) {
+			t.Errorf("expected dumped config to have %v resolved but got:\n%v", unexpected, out.String())
+		}
+	}
+
+	// The dumped config loads as the effective config it was dumped from.
+	dumpedFile := filepath.Join(t.TempDir(), "dumped.yml")
+	if err := os.WriteFile(dumpedFile, []byte(out.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dumped, err := config.LoadConfig([]string{dumpedFile})
+	if err != nil {
+		t.Fatalf("failed to load dumped config: %v\n%v", err, out.String())
+	}
+
+	var redumped strings.Builder
+	if err := writeConfig(&redumped, dumped); err != nil {
+		t.Fatal(err)
+	}
+	if redumped.String() != out.String() {
+		t.Errorf("expected dumped config to load as\n%v\nbut got\n%v", out.String(), redumped.String())
+	}
+}
+
+func TestPlanHandler(t *testing.T) {
+	c := config.Config{
+		Modules: []config.Module{
+			{
+				Name:          "my_module",
+				CoalesceReads: true,
+				Metrics: []config.MetricDef{
+					{Name: "a", Address: 300001, DataType: config.ModbusInt16},
+					{Name: "b", Address: 300002, DataType: config.ModbusInt16},
+				},
+			},
+		},
+	}
+	handler := newHandler(modbus.NewExporter(c), prometheus.NewRegistry(), log.NewNopLogger())
+
+	for _, test := range []struct {
+		name   string
+		query  string
+		code   int
+		expect string
+	}{
+		{"no module", "", http.StatusBadRequest, ""},
+		{"unknown module", "?module=other", http.StatusBadRequest, ""},
+		{"plan", "?module=my_module", http.StatusOK, `[{"functionCode":3,"address":1,"count":2,"metrics":["a","b"]}]` + "\n"},
+	} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/plan"+test.query, nil))
+
+		if rr.Code != test.code {
+			t.Errorf("%v: expected status code %v but got %v", test.name, test.code, rr.Code)
+		}
+		if test.expect != "" && rr.Body.String() != test.expect {
+			t.Errorf("%v: expected body %q but got %q", test.name, test.expect, rr.Body.String())
+		}
+	}
+}
+
+func TestLastErrorsHandler(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	server := mbserver.NewServer()
+	if err := server.ListenTCP(address); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	c := config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "my_module",
+				Protocol: config.ModbusProtocolTCPIP,
+				Timeout:  1000,
+				Metrics: []config.MetricDef{
+					{
+						// The second register is beyond the last one of the
+						// server, failing the read with an exception.
+						Name:       "energy",
+						Help:       "some help",
+						Address:    365535,
+						DataType:   config.ModbusUInt32,
+						MetricType: config.MetricTypeCounter,
+					},
+				},
+			},
+		},
+	}
+	exporter := modbus.NewExporter(c)
+	handler := newHandler(exporter, prometheus.NewRegistry(), log.NewNopLogger())
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/last-errors?module=my_module", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "[]\n" {
+		t.Fatalf("expected no errors before the first scrape but got %v: %q", rr.Code, rr.Body.String())
+	}
+
+	scrapeOnce(io.Discard, exporter, "my_module", address, "1")
+
+	for _, test := range []struct {
+		name   string
+		query  string
+		code   int
+		expect []string
+	}{
+		{"no module", "", http.StatusBadRequest, nil},
+		{"unknown module", "?module=other", http.StatusBadRequest, nil},
+		{"errors", "?module=my_module", http.StatusOK, []string{
+			`"module":"my_module"`,
+			`"target":"` + address + `"`,
+			`"metric":"energy"`,
+			`"address":365535`,
+			`"class":"exception"`,
+		}},
+	} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/last-errors"+test.query, nil))
+
+		if rr.Code != test.code {
+			t.Errorf("%v: expected status code %v but got %v", test.name, test.code, rr.Code)
+		}
+		for _, expect := range test.expect {
+			if !strings.Contains(rr.Body.String(), expect) {
+				t.Errorf("%v: expected body to contain %q but got %q", test.name, expect, rr.Body.String())
+			}
+		}
+	}
+}
+
+func TestEndiannessHandler(t *testing.T) {
+	handler := newHandler(modbus.NewExporter(config.Config{}), prometheus.NewRegistry(), log.NewNopLogger())
+
+	for _, test := range []struct {
+		name   string
+		query  string
+		code   int
+		expect string
+	}{
+		{"no data", "?dataType=uint32&expected=1", http.StatusBadRequest, ""},
+		{"invalid data", "?data=xyz&dataType=uint32&expected=1", http.StatusBadRequest, ""},
+		{"no expected value", "?data=00020001&dataType=uint32", http.StatusBadRequest, ""},
+		{"unknown data type", "?data=00020001&dataType=int128&expected=1", http.StatusBadRequest, ""},
+		{"word swap", "?data=00020001&dataType=uint32&expected=65538", http.StatusOK, `["yolo"]` + "\n"},
+		{"tolerance", "?data=e97942f6&dataType=float32&expected=123.456&tolerance=0.001", http.StatusOK, `["yolo"]` + "\n"},
+		{"no match", "?data=00020001&dataType=uint32&expected=42", http.StatusOK, `[]` + "\n"},
+	} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/endianness"+test.query, nil))
+
+		if rr.Code != test.code {
+			t.Errorf("%v: expected status code %v but got %v", test.name, test.code, rr.Code)
+		}
+		if test.expect != "" && rr.Body.String() != test.expect {
+			t.Errorf("%v: expected body %q but got %q", test.name, test.expect, rr.Body.String())
+		}
+	}
+}
+
+func TestDiscoverHandler(t *testing.T) {
+	c := config.Config{
+		Modules: []config.Module{
+			{Name: "my_module"},
+			{Name: "discovering", Discovery: &config.Discovery{Address: 300001}},
+		},
+	}
+	handler := newHandler(modbus.NewExporter(c), prometheus.NewRegistry(), log.NewNopLogger())
+
+	for _, test := range []struct {
+		name  string
+		query string
+	}{
+		{"no target", "?module=discovering"},
+		{"no module", "?target=127.0.0.1:502"},
+		{"unknown module", "?target=127.0.0.1:502&module=other"},
+		{"no discovery", "?target=127.0.0.1:502&module=my_module"},
+	} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/discover"+test.query, nil))
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected status code %v but got %v", test.name, http.StatusBadRequest, rr.Code)
+		}
+	}
+}
+
+func TestAllowedTargets(t *testing.T) {
+	c := config.Config{
+		Modules:        []config.Module{{Name: "my_module"}},
+		AllowedTargets: []string{"127.0.0.0/8"},
+	}
+	handler := newHandler(modbus.NewExporter(c), prometheus.NewRegistry(), log.NewNopLogger())
+
+	for _, test := range []struct {
+		name  string
+		query string
+		code  int
+	}{
+		// The allowed target passes the allow-list and is then rejected for
+		// the missing sub-target, without connecting to it.
+		{"allowed target", "?module=my_module&target=127.0.0.1:502", http.StatusBadRequest},
+		{"blocked target", "?module=my_module&target=10.0.0.1:502&sub_target=1", http.StatusForbidden},
+	} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/modbus"+test.query, nil))
+
+		if rr.Code != test.code {
+			t.Errorf("%v: expected status code %v but got %v", test.name, test.code, rr.Code)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/discover?module=my_module&target=10.0.0.1:502", nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected discovery of blocked target to return %v but got %v", http.StatusForbidden, rr.Code)
+	}
+}
+
+func TestResetExtremesHandler(t *testing.T) {
+	handler := newHandler(modbus.NewExporter(config.Config{}), prometheus.NewRegistry(), log.NewNopLogger())
+
+	for _, test := range []struct {
+		method string
+		code   int
+	}{
+		{http.MethodGet, http.StatusMethodNotAllowed},
+		{http.MethodPost, http.StatusOK},
+	} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(test.method, "/extremes/reset", nil))
+
+		if rr.Code != test.code {
+			t.Errorf("%v: expected status code %v but got %v", test.method, test.code, rr.Code)
+		}
+	}
+}
+
+func TestWebConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, certPool := writeSelfSignedCert(t, dir)
+
+	// The password of user "carol" is "carol123".
+	webConfigFile := filepath.Join(dir, "web-config.yml")
+	webConfig := fmt.Sprintf(`tls_server_config:
+  cert_file: %v
+  key_file: %v
+basic_auth_users:
+  carol: $2y$10$qRTBuFoULoYNA7AQ/F3ck.trZBPyjV64.oA4ZsSBCIWvXuvQlQTuu
+`, certFile, keyFile)
+	if err := os.WriteFile(webConfigFile, []byte(webConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exporter := modbus.NewExporter(config.Config{})
+	srv := &http.Server{Handler: newHandler(exporter, prometheus.NewRegistry(), log.NewNopLogger())}
+	systemdSocket := false
+	flags := &web.FlagConfig{
+		WebListenAddresses: &[]string{listener.Addr().String()},
+		WebSystemdSocket:   &systemdSocket,
+		WebConfigFile:      &webConfigFile,
+	}
+	go web.Serve(listener, srv, flags, log.NewNopLogger())
+	defer srv.Close()
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: certPool},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		username string
+		password string
+		code     int
+	}{
+		{
+			name: "metrics without credentials",
+			path: "/metrics",
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "modbus without credentials",
+			path: "/modbus",
+			code: http.StatusUnauthorized,
+		},
+		{
+			name:     "metrics with wrong password",
+			path:     "/metrics",
+			username: "carol",
+			password: "wrong",
+			code:     http.StatusUnauthorized,
+		},
+		{
+			name:     "metrics with credentials",
+			path:     "/metrics",
+			username: "carol",
+			password: "carol123",
+			code:     http.StatusOK,
+		},
+		{
+			// Authenticated, but rejected by the handler itself for
+			// lack of parameters.
+			name:     "modbus with credentials",
+			path:     "/modbus",
+			username: "carol",
+			password: "carol123",
+			code:     http.StatusBadRequest,
+		},
+	}
+
+	for _, loopTest := range tests {
+		test := loopTest
+
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "https://"+listener.Addr().String()+test.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.username != "" {
+				req.SetBasicAuth(test.username, test.password)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != test.code {
+				t.Errorf("expected status code %v but got %v", test.code, resp.StatusCode)
+			}
+		})
+	}
+
+	t.Run("plain http is rejected", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "http://"+listener.Addr().String()+"/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("carol", "carol123")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			// Connection reset by the TLS listener.
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("expected plain http request to be rejected")
+		}
+	})
+}
+
+// writeSelfSignedCert writes a self-signed certificate for 127.0.0.1 and its
+// key to the given directory and returns their paths and a pool trusting the
+// certificate.
+func writeSelfSignedCert(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "modbus_exporter"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return certFile, keyFile, pool
+}